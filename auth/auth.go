@@ -0,0 +1,94 @@
+// Copyright © 2016, The T Authors.
+
+// Package auth provides optional token authentication
+// for the HTTP APIs of T's servers.
+//
+// A server requires a shared, secret token with each request
+// by wrapping its handler with Handler.
+// Clients give the token as the user name of the server's URL,
+// for example:
+//
+//	http://secret@localhost:8080/
+//
+// Clients send the token in the Authorization header of each request,
+// as a bearer token.
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Handler returns an http.Handler that serves requests with h
+// only if they have the token
+// and are not from a web page of another origin.
+// If token is empty, all requests are served.
+//
+// The token may be given as a bearer token,
+//
+//	Authorization: Bearer <token>
+//
+// or as the user name of basic authentication.
+// Requests without the token are rejected with Unauthorized,
+// and requests from another origin are rejected with Forbidden.
+func Handler(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !hasToken(req, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="T"`)
+			http.Error(w, "bad or missing token", http.StatusUnauthorized)
+			return
+		}
+		if !SameOrigin(req) {
+			http.Error(w, "bad origin", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func hasToken(req *http.Request, token string) bool {
+	var got string
+	if user, _, ok := req.BasicAuth(); ok {
+		got = user
+	} else if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		got = strings.TrimPrefix(h, "Bearer ")
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// SameOrigin returns whether a request is not from a web page
+// of an origin other than the requested host.
+// Requests without an Origin header,
+// such as those not made by web browsers, are not from another origin.
+func SameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// Token returns the token of a URL, which is its user name,
+// or the empty string if it has none.
+func Token(URL *url.URL) string {
+	if URL.User == nil {
+		return ""
+	}
+	return URL.User.Username()
+}
+
+// Authorize sets the Authorization header of a request
+// to the token of its URL, if any, as a bearer token.
+func Authorize(req *http.Request) {
+	if token := Token(req.URL); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright © 2016, The T Authors.
+
+// T-editor serves the T editor API.
+//
+// It serves the API of an editor.Server,
+// documented here:
+// https://godoc.org/github.com/eaburns/T/editor#Server.RegisterHandlers.
+//
+// The server listens on a TCP address, given by -addr,
+// or on a Unix domain socket, given by -unix.
+// Once it is listening, its URL is printed to standard output,
+// written to the file given by -urlfile, if any,
+// and set as the T_EDITOR_URL environment variable
+// of the commands that it runs.
+// If -token is set, each request must have the token,
+// as described by the auth package:
+// https://godoc.org/github.com/eaburns/T/auth.
+// The token is then the user name of the server's URL.
+//
+// The URL of a Unix domain socket has the scheme unix
+// and the absolute path of the socket, for example:
+//
+//	unix:///tmp/T-editor.sock
+//
+// If -snapshot is set, T-editor restores its buffers and editors
+// from the snapshot in the directory, if any,
+// and writes a snapshot to the directory when it exits.
+// The buffers and editors of a restored server keep their paths,
+// so a restarted T-editor serves them at the same URLs.
+//
+// On an interrupt or termination signal,
+// T-editor stops accepting connections,
+// waits for a short time for in-progress requests to finish,
+// writes its snapshot, if -snapshot is set,
+// closes all of its buffers, removes its URL file and socket, and exits.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/eaburns/T/auth"
+	"github.com/eaburns/T/editor"
+	"github.com/gorilla/mux"
+)
+
+// ShutdownTimeout is how long in-progress requests
+// are given to finish on shutdown.
+const shutdownTimeout = 5 * time.Second
+
+var (
+	addr    = flag.String("addr", "localhost:0", "the TCP address on which to listen")
+	unix    = flag.String("unix", "", "the path of a Unix domain socket on which to listen, instead of -addr")
+	urlFile = flag.String("urlfile", "", "a file to which the server's URL is written")
+	token   = flag.String("token", "", "a secret token required with each request")
+	snap    = flag.String("snapshot", "", "a directory from which to restore and to which to snapshot the server")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	l, u, err := listen()
+	if err != nil {
+		return err
+	}
+	if *unix != "" {
+		defer os.Remove(*unix)
+	}
+
+	es := editor.NewServer()
+	if *snap != "" {
+		switch restored, err := editor.Restore(*snap); {
+		case err == nil:
+			es = restored
+		case !os.IsNotExist(err):
+			l.Close()
+			return err
+		}
+	}
+	r := mux.NewRouter()
+	es.RegisterHandlers(r)
+	hs := &http.Server{Handler: auth.Handler(*token, r)}
+	if *token != "" {
+		u.User = url.User(*token)
+	}
+
+	if err := os.Setenv("T_EDITOR_URL", u.String()); err != nil {
+		l.Close()
+		return err
+	}
+	if *urlFile != "" {
+		if err := ioutil.WriteFile(*urlFile, []byte(u.String()+"\n"), 0600); err != nil {
+			l.Close()
+			return err
+		}
+		defer os.Remove(*urlFile)
+	}
+	fmt.Println(u)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- hs.Serve(l) }()
+
+	select {
+	case err = <-serveErr:
+	case sig := <-sigs:
+		log.Printf("Shutting down on %v", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = hs.Shutdown(ctx)
+		cancel()
+	}
+	if *snap != "" {
+		if snapErr := es.Snapshot(*snap, true); err == nil {
+			err = snapErr
+		}
+	}
+	if closeErr := es.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Listen returns a Listener on the address given by the flags,
+// and the URL of the server.
+func listen() (net.Listener, *url.URL, error) {
+	if *unix != "" {
+		path, err := filepath.Abs(*unix)
+		if err != nil {
+			return nil, nil, err
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, &url.URL{Scheme: "unix", Path: path}, nil
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, &url.URL{Scheme: "http", Host: l.Addr().String()}, nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"regexp"
+	"regexp/syntax"
 	"strconv"
 	"strings"
 	"unicode"
@@ -31,6 +32,27 @@ type RangeError int64
 
 func (err RangeError) Error() string { return "out of range" }
 
+// A ParseError is returned by Addr and Ed
+// if the Address or Edit is malformed.
+type ParseError struct {
+	// Offset is the offset, in runes, into the input
+	// at which the malformed token begins.
+	Offset int64
+
+	// Token is the malformed token.
+	Token string
+
+	// Expected describes what was expected at Offset.
+	Expected string
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (err *ParseError) Error() string {
+	return "#" + strconv.FormatInt(err.Offset, 10) + ": " + err.Err.Error()
+}
+
 // An Address identifies a Span within a Text.
 type Address interface {
 	// String returns the string representation of the Address.
@@ -103,6 +125,24 @@ func (text withDot) Mark(r rune) Span {
 	return text.Text.Mark(r)
 }
 
+// LineIndexerOf returns the LineIndexer underlying a Text, if any.
+// It looks through the wrappers used internally by this package.
+func lineIndexerOf(text Text) (LineIndexer, bool) {
+	switch t := text.(type) {
+	case LineIndexer:
+		return t, true
+	case withDot:
+		return lineIndexerOf(t.Text)
+	case ignoreApply:
+		return lineIndexerOf(t.Editor)
+	case byteEditor:
+		if lines, ok := lineIndexerOf(t.Editor); ok {
+			return byteLineIndex{byteEditor: t, lines: lines}, true
+		}
+	}
+	return nil, false
+}
+
 func (a then) Where(text Text) (Span, error) {
 	left, err := a.left.Where(text)
 	if err != nil {
@@ -290,6 +330,9 @@ func (a line) where(from int64, text Text) (Span, error) {
 }
 
 func lineForward(n int, from int64, text Text) (Span, error) {
+	if ix, ok := lineIndexerOf(text); ok {
+		return indexedLineForward(n, from, ix)
+	}
 	s := Span{from, from}
 	if from > 0 {
 		// Position s1 at the beginning of the next full line.
@@ -345,6 +388,9 @@ func lineForward(n int, from int64, text Text) (Span, error) {
 }
 
 func lineBackward(n int, from int64, text Text) (Span, error) {
+	if ix, ok := lineIndexerOf(text); ok {
+		return indexedLineBackward(n, from, ix)
+	}
 	s := Span{from, from}
 	if s[0] < text.Size() {
 		rr := text.RuneReader(Span{from, 0})
@@ -395,6 +441,133 @@ func lineBackward(n int, from int64, text Text) (Span, error) {
 	return s, nil
 }
 
+// IndexedLineForward is lineForward using a LineIndexer.
+func indexedLineForward(n int, from int64, ix LineIndexer) (Span, error) {
+	size := ix.Size()
+	// K is the number of newlines before s[1].
+	s, k := Span{from, from}, int64(0)
+	if from > 0 {
+		// Position s1 at the beginning of the next full line.
+		// If s1 is already at the beginning of a full line, we've got it.
+		k = ix.NewlinesBefore(from - 1)
+		if nl := ix.Newline(k); nl < 0 {
+			s[1] = size
+		} else {
+			s[1] = nl + 1
+			k++
+		}
+		if n > 0 {
+			s[0] = s[1]
+		}
+	}
+	if n == 0 {
+		return s, nil
+	}
+
+	// J is the newline ending the nth line.
+	j := k + int64(n) - 1
+	if nl := ix.Newline(j); nl >= 0 {
+		if j > k {
+			s[0] = ix.Newline(j-1) + 1
+		}
+		s[1] = nl + 1
+		return s, nil
+	}
+	// The nth line can only be the last line, with no terminating newline.
+	total := ix.NewlinesBefore(size)
+	if j > total {
+		return Span{}, RangeError(size)
+	}
+	if total > k {
+		s[0] = ix.Newline(total-1) + 1
+	}
+	s[1] = size
+	return s, nil
+}
+
+// IndexedLineBackward is lineBackward using a LineIndexer.
+func indexedLineBackward(n int, from int64, ix LineIndexer) (Span, error) {
+	k := ix.NewlinesBefore(from)
+	if n == 0 {
+		if k == 0 {
+			return Span{0, from}, nil
+		}
+		return Span{ix.Newline(k-1) + 1, from}, nil
+	}
+
+	// J is the newline ending the nth previous line.
+	switch j := k - int64(n); {
+	case j < -1:
+		return Span{}, RangeError(0)
+	case j == -1:
+		return Span{}, nil
+	case j == 0:
+		return Span{0, ix.Newline(0) + 1}, nil
+	default:
+		return Span{ix.Newline(j-1) + 1, ix.Newline(j) + 1}, nil
+	}
+}
+
+type lineCol struct {
+	line line
+	col  int
+}
+
+// LineCol returns the Address of the empty string
+// before column col of the line addressed by Line(l).
+//
+// Columns are numbered from 1, and each rune is a single column;
+// in particular, a tab is a single column.
+// A col less than 1 is interpreted as col=1.
+// A col beyond the end of the line is clamped
+// to the end of the line, before its terminating newline, if any.
+// If the line is out of range, a RangeError is returned,
+// just as for Line(l).
+func LineCol(l, col int) SimpleAddress {
+	if col < 1 {
+		col = 1
+	}
+	return lineCol{line: Line(l).(line), col: col}
+}
+
+func (a lineCol) String() string {
+	return strconv.Itoa(a.line.n) + ":" + strconv.Itoa(a.col)
+}
+
+func (a lineCol) To(b AdditiveAddress) Address      { return to{left: a, right: b} }
+func (a lineCol) Then(b AdditiveAddress) Address    { return then{left: a, right: b} }
+func (a lineCol) Between(b AdditiveAddress) Address { return between{left: a, right: b} }
+
+func (a lineCol) Plus(b SimpleAddress) AdditiveAddress  { return plus{left: a, right: b} }
+func (a lineCol) Minus(b SimpleAddress) AdditiveAddress { return minus{left: a, right: b} }
+
+func (a lineCol) reverse() SimpleAddress {
+	a.line.rev = !a.line.rev
+	return a
+}
+
+func (a lineCol) Where(text Text) (Span, error) { return a.where(0, text) }
+
+func (a lineCol) where(from int64, text Text) (Span, error) {
+	s, err := a.line.where(from, text)
+	if err != nil {
+		return Span{}, err
+	}
+	at := s[0]
+	rr := text.RuneReader(s)
+	for c := 1; c < a.col; c++ {
+		switch r, w, err := rr.ReadRune(); {
+		case err == io.EOF || err == nil && r == '\n':
+			return Span{at, at}, nil
+		case err != nil:
+			return Span{}, err
+		default:
+			at += int64(w)
+		}
+	}
+	return Span{at, at}, nil
+}
+
 type mark rune
 
 // Mark returns the Address of the named mark rune.
@@ -450,6 +623,17 @@ type regexpAddr struct {
 // the second "abc" in the first line.
 // Likewise, in a reverse search, the relative start location
 // is considered to be the end of text.
+//
+// A reverse search first reads the Text backward from the start location
+// to find the nearest match: the match ending closest before the start location.
+// It then finds the successive, non-overlapping matches
+// of a forward search from the start of the line on which the nearest match begins,
+// or from 4096 runes before the nearest match if that line begins earlier,
+// to the start location.
+// The last of these matches is returned.
+// So, of overlapping matches, the one found by the forward search is returned,
+// and a match beginning before the forward search begins is never returned,
+// even if it spans lines.
 func Regexp(regexp string) SimpleAddress               { return regexpAddr{regexp: regexp} }
 func (a regexpAddr) String() string                    { return "/" + Escape(a.regexp, '/') + "/" }
 func (a regexpAddr) To(b AdditiveAddress) Address      { return to{left: a, right: b} }
@@ -467,13 +651,21 @@ func (a regexpAddr) reverse() SimpleAddress {
 func (a regexpAddr) Where(text Text) (Span, error) { return a.where(text.Mark('.')[1], text) }
 
 func (a regexpAddr) where(from int64, text Text) (Span, error) {
+	var m []int
 	re, err := regexpCompile(a.regexp)
 	if err != nil {
 		return Span{}, err
 	}
-	var m []int
 	if a.rev {
-		m = prevMatch(re, from, text, true)
+		rev, err := regexpCompileReverse(a.regexp)
+		if err != nil {
+			return Span{}, err
+		}
+		after, err := regexpCompileAfter(a.regexp)
+		if err != nil {
+			return Span{}, err
+		}
+		m = prevMatch(regexps{re: re, rev: rev, after: after}, from, text, true)
 	} else {
 		m = nextMatch(re, from, text, true)
 	}
@@ -502,10 +694,47 @@ func nextMatch(re *regexp.Regexp, from int64, text Text, wrap bool) []int {
 	return nil
 }
 
-func prevMatch(re *regexp.Regexp, from int64, text Text, wrap bool) []int {
+// Regexps are the compiled forms of a regular expression
+// used by prevMatch.
+type regexps struct {
+	// Re is the regexp, as returned by regexpCompile.
+	re *regexp.Regexp
+	// Rev is its reverse, as returned by regexpCompileReverse.
+	rev *regexp.Regexp
+	// After matches it after a rune of context,
+	// as returned by regexpCompileAfter.
+	after *regexp.Regexp
+}
+
+// PrevMatchRunes is the maximum number of runes before the nearest match
+// from which prevMatch searches forward for successive matches.
+const prevMatchRunes = 1 << 12
+
+// PrevMatch returns the last of the successive matches of a regexp
+// ending at or before the given location,
+// as described in the documentation of Regexp.
+//
+// The nearest match is found by reading the text in reverse from the location
+// with the reverse of the regexp.
+// The successive matches are then found from prevMatchStart of that match.
+// So, the search reads only the runes between from
+// and at most prevMatchRunes before the nearest match.
+func prevMatch(re regexps, from int64, text Text, wrap bool) []int {
+	m := re.rev.FindReaderIndex(text.RuneReader(Span{from, 0}))
+	if len(m) < 2 {
+		if size := text.Size(); from < size && wrap {
+			return prevMatch(re, size, text, false)
+		}
+		return nil
+	}
+	near := []int{int(from) - m[1], int(from) - m[0]}
+	start, err := prevMatchStart(int64(near[0]), text)
+	if err != nil {
+		return near
+	}
 	var prev []int
 	for {
-		span := Span{0, from}
+		span := Span{start, from}
 		if len(prev) >= 2 {
 			if prev[0] == prev[1] {
 				span[0] = int64(prev[1]) + 1
@@ -516,27 +745,113 @@ func prevMatch(re *regexp.Regexp, from int64, text Text, wrap bool) []int {
 		if span[0] > span[1] {
 			break
 		}
-		cur := match(re, span, text)
+		cur := matchAfter(re, span, text)
 		if len(cur) < 2 || len(prev) >= 2 && prev[1] == cur[1] && int64(cur[1]) == from {
 			break
 		}
 		prev = cur
 	}
-	if prev != nil {
-		return prev
+	if prev == nil {
+		return near
 	}
-	if size := text.Size(); from < size && wrap {
-		return prevMatch(re, size, text, false)
+	return prev
+}
+
+// PrevMatchStart returns the start of the line containing the location,
+// or prevMatchRunes before the location if the line begins earlier.
+func prevMatchStart(at int64, text Text) (int64, error) {
+	min := at - prevMatchRunes
+	if min < 0 {
+		min = 0
+	}
+	rr := text.RuneReader(Span{at, min})
+	for {
+		switch r, w, err := rr.ReadRune(); {
+		case err == io.EOF:
+			return at, nil
+		case err != nil:
+			return 0, err
+		case r == '\n':
+			return at, nil
+		default:
+			at -= int64(w)
+		}
 	}
-	return nil
+}
+
+// MatchAfter returns the first match of a regexp within a Span.
+// Unlike match, the rune before the Span, if any,
+// is the context for assertions, such as ^ and \b,
+// at the start of the Span.
+func matchAfter(re regexps, s Span, text Text) []int {
+	if s[0] == 0 {
+		return match(re.re, s, text)
+	}
+	m := match(re.after, Span{s[0] - 1, s[1]}, text)
+	if len(m) < 4 {
+		return nil
+	}
+	// Submatch 1 is the match of the regexp after the context rune.
+	return m[2:]
 }
 
 func regexpCompile(re string) (*regexp.Regexp, error) {
+	return regexp.Compile(regexpSyntax(re))
+}
+
+// RegexpCompileAfter returns a regexp
+// that matches any rune followed by a match of re,
+// with the match of re as submatch 1.
+func regexpCompileAfter(re string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?s:.)(" + regexpSyntax(re) + ")")
+}
+
+// RegexpCompileReverse returns a regexp
+// that matches the reverse of the strings matched by re.
+// Reading a Text in reverse with the returned regexp
+// finds matches of re ending at or before the start of the read.
+func regexpCompileReverse(re string) (*regexp.Regexp, error) {
+	syn, err := syntax.Parse(regexpSyntax(re), syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(reverseSyntax(syn).String())
+}
+
+func regexpSyntax(re string) string {
 	if re == "\\" || len(re) > 2 && re[len(re)-1] == '\\' && re[len(re)-2] != '\\' {
 		// Escape a trailing, unescaped \.
 		re = re + "\\"
 	}
-	return regexp.Compile("(?m:" + re + ")")
+	return "(?m:" + re + ")"
+}
+
+// ReverseSyntax reverses a regexp syntax tree in place, and returns it.
+// Concatenations and literals are reversed,
+// and the beginning and ending assertions are swapped.
+func reverseSyntax(re *syntax.Regexp) *syntax.Regexp {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for i, j := 0, len(re.Rune)-1; i < j; i, j = i+1, j-1 {
+			re.Rune[i], re.Rune[j] = re.Rune[j], re.Rune[i]
+		}
+	case syntax.OpConcat:
+		for i, j := 0, len(re.Sub)-1; i < j; i, j = i+1, j-1 {
+			re.Sub[i], re.Sub[j] = re.Sub[j], re.Sub[i]
+		}
+	case syntax.OpBeginLine:
+		re.Op = syntax.OpEndLine
+	case syntax.OpEndLine:
+		re.Op = syntax.OpBeginLine
+	case syntax.OpBeginText:
+		re.Op = syntax.OpEndText
+	case syntax.OpEndText:
+		re.Op = syntax.OpBeginText
+	}
+	for _, sub := range re.Sub {
+		reverseSyntax(sub)
+	}
+	return re
 }
 
 type runeAddr int64
@@ -587,6 +902,95 @@ func (a runeAddr) where(from int64, text Text) (Span, error) {
 	return Span{from, from}, nil
 }
 
+type byteAddr int64
+
+// Byte returns the Address of the empty Span
+// beginning at byte n of the UTF-8 encoding of the Text.
+// If byte n is within the encoding of a rune,
+// the Address is the empty Span before the rune.
+// A negative n is interpreted as n=0.
+func Byte(n int64) SimpleAddress {
+	if n < 0 {
+		return byteAddr(0)
+	}
+	return byteAddr(n)
+}
+
+func (a byteAddr) String() string                    { return "#b" + strconv.FormatInt(int64(a), 10) }
+func (a byteAddr) To(b AdditiveAddress) Address      { return to{left: a, right: b} }
+func (a byteAddr) Then(b AdditiveAddress) Address    { return then{left: a, right: b} }
+func (a byteAddr) Between(b AdditiveAddress) Address { return between{left: a, right: b} }
+
+func (a byteAddr) Plus(b SimpleAddress) AdditiveAddress  { return plus{left: a, right: b} }
+func (a byteAddr) reverse() SimpleAddress                { return byteAddr(-a) }
+func (a byteAddr) Minus(b SimpleAddress) AdditiveAddress { return minus{left: a, right: b} }
+func (a byteAddr) Where(text Text) (Span, error)         { return a.where(0, text) }
+
+func (a byteAddr) where(from int64, text Text) (Span, error) {
+	if ix, ok := byteIndexerOf(text); ok {
+		b := ix.ByteOffset(from) + int64(a)
+		switch {
+		case b < 0:
+			return Span{}, RangeError(0)
+		case b > ix.ByteOffset(text.Size()):
+			return Span{}, RangeError(text.Size())
+		}
+		offs := ix.FromByteOffset(b)
+		return Span{offs, offs}, nil
+	}
+
+	n := int64(a)
+	if n < 0 {
+		// Move back over whole runes until reaching
+		// the rune containing the target byte.
+		rr := text.RuneReader(Span{from, 0})
+		for n < 0 {
+			switch r, w, err := rr.ReadRune(); {
+			case err == io.EOF:
+				return Span{}, RangeError(0)
+			case err != nil:
+				return Span{}, err
+			default:
+				n += int64(runeBytes(r))
+				from -= int64(w)
+			}
+		}
+		return Span{from, from}, nil
+	}
+	rr := text.RuneReader(Span{from, text.Size()})
+	for n > 0 {
+		switch r, w, err := rr.ReadRune(); {
+		case err == io.EOF:
+			return Span{}, RangeError(text.Size())
+		case err != nil:
+			return Span{}, err
+		case int64(runeBytes(r)) > n:
+			// The target byte is within the rune.
+			return Span{from, from}, nil
+		default:
+			n -= int64(runeBytes(r))
+			from += int64(w)
+		}
+	}
+	return Span{from, from}, nil
+}
+
+// ByteIndexerOf returns the ByteIndexer underlying a Text, if any.
+// It looks through the wrappers used internally by this package.
+func byteIndexerOf(text Text) (ByteIndexer, bool) {
+	switch t := text.(type) {
+	case ByteIndexer:
+		return t, true
+	case withDot:
+		return byteIndexerOf(t.Text)
+	case ignoreApply:
+		return byteIndexerOf(t.Editor)
+	case byteEditor:
+		return byteIndex{t}, true
+	}
+	return nil, false
+}
+
 const (
 	digits      = "0123456789"
 	simpleFirst = "!#/$.'" + digits
@@ -597,7 +1001,7 @@ const (
 // The address syntax for address a is:
 // 	a: {a} , {aa} | {a} ; {aa} | {aa}
 // 	aa: {aa} + {sa} | {aa} - {sa} | {aa} {sa} | {!} {sa}
-// 	sa: $ | . | 'r | #{n} | n | / regexp {/}
+// 	sa: $ | . | 'r | #{n} | #b{n} | n | n:n | / regexp {/}
 // 	n: [0-9]+
 // 	r: any non-space rune
 // 	regexp: any valid re1 regular expression
@@ -608,7 +1012,15 @@ const (
 //	. is the current address of the editor, called dot.
 //	'{r} is the address of the non-space rune, r. If r is missing, . is used.
 //	#{n} is the empty string after rune number n. If n is missing then 1 is used.
+//	#b{n} is the empty string at byte number n of the UTF-8 encoding of the buffer.
+//		If byte n is within the encoding of a rune, it is the empty string before the rune.
+//		If n is missing then 1 is used.
 //	n is the nth line in the buffer. 0 is the string before the first full line.
+//	n:m is the empty string before column m of the nth line in the buffer.
+//		Columns are numbered from 1, and each rune, including a tab, is one column.
+//		If m is 0, 1 is used.
+//		If m is beyond the end of the line, it is the empty string
+//		at the end of the line, before its terminating newline.
 //	'/' regexp {'/'} is the first match of the regular expression.
 // 		The regexp uses the syntax of the standard library regexp package,
 // 		except that \, raw newlines, and / must be escaped with \.
@@ -662,7 +1074,43 @@ const (
 //
 // 	1,5dabc
 // 		Is terminated at 5, the end of the address.
-func Addr(rs io.RuneScanner) (Address, error) {
+//
+// If the address is malformed, a *ParseError is returned.
+func Addr(rs io.RuneScanner) (Address, error) { return parseAddr(newScanner(rs)) }
+
+// A scanner is an io.RuneScanner
+// that tracks the offset, in runes, into its input.
+type scanner struct {
+	io.RuneScanner
+	offs int64
+}
+
+// NewScanner returns rs if it is already a *scanner,
+// otherwise it returns a new *scanner reading from rs.
+func newScanner(rs io.RuneScanner) *scanner {
+	if s, ok := rs.(*scanner); ok {
+		return s
+	}
+	return &scanner{RuneScanner: rs}
+}
+
+func (s *scanner) ReadRune() (rune, int, error) {
+	r, w, err := s.RuneScanner.ReadRune()
+	if err == nil {
+		s.offs++
+	}
+	return r, w, err
+}
+
+func (s *scanner) UnreadRune() error {
+	err := s.RuneScanner.UnreadRune()
+	if err == nil {
+		s.offs--
+	}
+	return err
+}
+
+func parseAddr(rs *scanner) (Address, error) {
 	aa, err := parseAdditiveAddress(rs)
 	if err != nil {
 		return nil, err
@@ -674,7 +1122,7 @@ func Addr(rs io.RuneScanner) (Address, error) {
 	return a, nil
 }
 
-func parseAddressTail(left Address, rs io.RuneScanner) (Address, error) {
+func parseAddressTail(left Address, rs *scanner) (Address, error) {
 	if err := skipSpace(rs); err != nil {
 		return nil, err
 	}
@@ -710,7 +1158,7 @@ func parseAddressTail(left Address, rs io.RuneScanner) (Address, error) {
 	return left, nil
 }
 
-func parseAdditiveAddress(rs io.RuneScanner) (AdditiveAddress, error) {
+func parseAdditiveAddress(rs *scanner) (AdditiveAddress, error) {
 	a, err := parseSimpleAddress(rs)
 	if err != nil {
 		return nil, err
@@ -718,7 +1166,7 @@ func parseAdditiveAddress(rs io.RuneScanner) (AdditiveAddress, error) {
 	return parseAdditiveAddressTail(a, rs)
 }
 
-func parseAdditiveAddressTail(left AdditiveAddress, rs io.RuneScanner) (AdditiveAddress, error) {
+func parseAdditiveAddressTail(left AdditiveAddress, rs *scanner) (AdditiveAddress, error) {
 	if err := skipSpace(rs); err != nil {
 		return nil, err
 	}
@@ -770,7 +1218,7 @@ func parseAdditiveAddressTail(left AdditiveAddress, rs io.RuneScanner) (Additive
 	return left, nil
 }
 
-func parseSimpleAddress(rs io.RuneScanner) (SimpleAddress, error) {
+func parseSimpleAddress(rs *scanner) (SimpleAddress, error) {
 	if err := skipSpace(rs); err != nil {
 		return nil, err
 	}
@@ -786,13 +1234,10 @@ func parseSimpleAddress(rs io.RuneScanner) (SimpleAddress, error) {
 	case strings.ContainsRune(digits, r):
 		return parseLineAddr(r, rs)
 	case r == '/':
-		re, err := parseDelimited(r, rs)
+		re, err := parseRegexp(r, rs)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := regexpCompile(re); err != nil {
-			return nil, err
-		}
 		return Regexp(re), nil
 	case r == '$':
 		return End, nil
@@ -825,7 +1270,19 @@ func parseMarkAddr(rs io.RuneScanner) (SimpleAddress, error) {
 	}
 }
 
-func parseRuneAddr(rs io.RuneScanner) (SimpleAddress, error) {
+func parseRuneAddr(rs *scanner) (SimpleAddress, error) {
+	newAddr := Rune
+	switch r, _, err := rs.ReadRune(); {
+	case err != nil && err != io.EOF:
+		return nil, err
+	case err == nil && r == 'b':
+		newAddr = Byte
+	case err == nil:
+		if err := rs.UnreadRune(); err != nil {
+			return nil, err
+		}
+	}
+	offs := rs.offs
 	s, err := scanDigits(rs)
 	if err != nil {
 		return nil, err
@@ -835,16 +1292,59 @@ func parseRuneAddr(rs io.RuneScanner) (SimpleAddress, error) {
 	}
 	const base, bits = 10, 64
 	r, err := strconv.ParseInt(s, base, bits)
-	return Rune(r), err
+	if err != nil {
+		return nil, &ParseError{Offset: offs, Token: s, Expected: "number", Err: err}
+	}
+	return newAddr(r), nil
 }
 
-func parseLineAddr(r rune, rs io.RuneScanner) (SimpleAddress, error) {
+func parseLineAddr(r rune, rs *scanner) (SimpleAddress, error) {
+	offs := rs.offs - 1 // r was already read.
 	s, err := scanDigits(rs)
 	if err != nil {
 		return nil, err
 	}
-	l, err := strconv.Atoi(string(r) + s)
-	return Line(l), err
+	s = string(r) + s
+	l, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, &ParseError{Offset: offs, Token: s, Expected: "number", Err: err}
+	}
+	switch r, _, err := rs.ReadRune(); {
+	case err == io.EOF:
+		return Line(l), nil
+	case err != nil:
+		return nil, err
+	case r != ':':
+		return Line(l), rs.UnreadRune()
+	}
+	offs = rs.offs
+	s, err = scanDigits(rs)
+	if err != nil {
+		return nil, err
+	}
+	if len(s) == 0 {
+		return nil, &ParseError{Offset: offs, Expected: "column number", Err: errors.New("missing column number")}
+	}
+	c, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, &ParseError{Offset: offs, Token: s, Expected: "column number", Err: err}
+	}
+	return LineCol(l, c), nil
+}
+
+// ParseRegexp parses and returns a delimited regular expression.
+// The opening delimiter must already be consumed.
+// If the regular expression fails to compile, a *ParseError is returned.
+func parseRegexp(delim rune, rs *scanner) (string, error) {
+	offs := rs.offs
+	re, err := parseDelimited(delim, rs)
+	if err != nil {
+		return "", err
+	}
+	if _, err := regexpCompile(re); err != nil {
+		return "", &ParseError{Offset: offs, Token: re, Expected: "regular expression", Err: err}
+	}
+	return re, nil
 }
 
 func scanDigits(rs io.RuneScanner) (string, error) {
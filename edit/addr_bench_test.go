@@ -12,6 +12,7 @@ package edit
 import (
 	"bytes"
 	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -75,6 +76,74 @@ func BenchmarkLinex1K(b *testing.B)  { benchmarkLine(b, 1<<10) }
 func BenchmarkLinex1M(b *testing.B)  { benchmarkLine(b, 1<<20) }
 func BenchmarkLinex32M(b *testing.B) { benchmarkLine(b, 32<<20) }
 
+func benchmarkLineUnindexed(b *testing.B, n int) {
+	buf, lines, _ := makeEditor(n)
+	defer buf.Close()
+	if lines == 0 {
+		b.Fatalf("too few lines: %d", lines)
+	}
+	b.ResetTimer()
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		if _, err := Line(lines).Where(unindexed{buf}); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkLineUnindexedx32(b *testing.B)  { benchmarkLineUnindexed(b, 32<<0) }
+func BenchmarkLineUnindexedx1K(b *testing.B)  { benchmarkLineUnindexed(b, 1<<10) }
+func BenchmarkLineUnindexedx1M(b *testing.B)  { benchmarkLineUnindexed(b, 1<<20) }
+func BenchmarkLineUnindexedx32M(b *testing.B) { benchmarkLineUnindexed(b, 32<<20) }
+
+func benchmarkLineBackward(b *testing.B, n int) {
+	buf, lines, _ := makeEditor(n)
+	defer buf.Close()
+	if lines == 0 {
+		b.Fatalf("too few lines: %d", lines)
+	}
+	b.ResetTimer()
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		if _, err := End.Minus(Line(lines)).Where(buf); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkLineBackwardx32(b *testing.B)  { benchmarkLineBackward(b, 32<<0) }
+func BenchmarkLineBackwardx1K(b *testing.B)  { benchmarkLineBackward(b, 1<<10) }
+func BenchmarkLineBackwardx1M(b *testing.B)  { benchmarkLineBackward(b, 1<<20) }
+func BenchmarkLineBackwardx32M(b *testing.B) { benchmarkLineBackward(b, 32<<20) }
+
+// BenchmarkLineAfterChange benchmarks a line address
+// following a change that updates the line index.
+func benchmarkLineAfterChange(b *testing.B, n int) {
+	buf, lines, _ := makeEditor(n)
+	defer buf.Close()
+	if lines == 0 {
+		b.Fatalf("too few lines: %d", lines)
+	}
+	b.ResetTimer()
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		if _, err := buf.Change(Span{0, 1}, strings.NewReader("\n")); err != nil {
+			b.Fatal(err.Error())
+		}
+		if err := buf.Apply(); err != nil {
+			b.Fatal(err.Error())
+		}
+		if _, err := Line(lines).Where(buf); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkLineAfterChangex32(b *testing.B)  { benchmarkLineAfterChange(b, 32<<0) }
+func BenchmarkLineAfterChangex1K(b *testing.B)  { benchmarkLineAfterChange(b, 1<<10) }
+func BenchmarkLineAfterChangex1M(b *testing.B)  { benchmarkLineAfterChange(b, 1<<20) }
+func BenchmarkLineAfterChangex32M(b *testing.B) { benchmarkLineAfterChange(b, 32<<20) }
+
 func benchmarkRegexp(b *testing.B, re string, n int) {
 	buf, _, _ := makeEditor(n)
 	defer buf.Close()
@@ -113,3 +182,28 @@ func BenchmarkRegexpHardx32(b *testing.B)    { benchmarkRegexp(b, hard, 32<<0) }
 func BenchmarkRegexpHardx1K(b *testing.B)    { benchmarkRegexp(b, hard, 1<<10) }
 func BenchmarkRegexpHardx1M(b *testing.B)    { benchmarkRegexp(b, hard, 1<<20) }
 func BenchmarkRegexpHardx32M(b *testing.B)   { benchmarkRegexp(b, hard, 32<<20) }
+
+// BenchmarkRegexpReverse benchmarks a reverse regexp search
+// from the end of the text for a match near the end.
+func benchmarkRegexpReverse(b *testing.B, n int) {
+	buf, _, _ := makeEditor(n)
+	defer buf.Close()
+	if _, err := buf.Change(Span{buf.Size() - 10, buf.Size() - 10}, strings.NewReader("\x00")); err != nil {
+		b.Fatal(err.Error())
+	}
+	if err := buf.Apply(); err != nil {
+		b.Fatal(err.Error())
+	}
+	b.ResetTimer()
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		if _, err := End.Minus(Regexp(`\x00`)).Where(buf); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkRegexpReversex32(b *testing.B)  { benchmarkRegexpReverse(b, 32<<0) }
+func BenchmarkRegexpReversex1K(b *testing.B)  { benchmarkRegexpReverse(b, 1<<10) }
+func BenchmarkRegexpReversex1M(b *testing.B)  { benchmarkRegexpReverse(b, 1<<20) }
+func BenchmarkRegexpReversex32M(b *testing.B) { benchmarkRegexpReverse(b, 32<<20) }
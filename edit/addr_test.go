@@ -49,6 +49,23 @@ func TestAddr(t *testing.T) {
 		{a: " 1\t\n\txyz", left: "\n\txyz", want: Line(1)},
 		{a: strconv.FormatInt(math.MaxInt64, 10) + "0", err: "out of range"},
 
+		{a: "0:0", want: LineCol(0, 1)},
+		{a: "1:1", want: LineCol(1, 1)},
+		{a: "42:7", want: LineCol(42, 7)},
+		{a: "42:7xyz", left: "xyz", want: LineCol(42, 7)},
+		{a: " 42:7\t\n\txyz", left: "\n\txyz", want: LineCol(42, 7)},
+		{a: "42 :7", left: ":7", want: Line(42)},
+		{a: "42:", err: "missing column"},
+		{a: "42:xyz", err: "missing column"},
+		{a: "42:" + strconv.FormatInt(math.MaxInt64, 10) + "0", err: "out of range"},
+		{a: ".+42:7", want: Dot.Plus(LineCol(42, 7))},
+		{a: ".-42:7", want: Dot.Minus(LineCol(42, 7))},
+		{a: "1:2,3:4", want: LineCol(1, 2).To(LineCol(3, 4))},
+		{a: "1:2;3:4", want: LineCol(1, 2).Then(LineCol(3, 4))},
+		{a: "1:2~3:4", want: LineCol(1, 2).Between(LineCol(3, 4))},
+		{a: "1:2#3", want: LineCol(1, 2).Plus(Rune(3))},
+		{a: "!1:2", want: Clamp(LineCol(1, 2))},
+
 		{a: "/", want: Regexp("")},
 		{a: "//", want: Regexp("")},
 		{a: "/abcdef", want: Regexp("abcdef")},
@@ -72,6 +89,7 @@ func TestAddr(t *testing.T) {
 		{a: "'☺", want: Mark('☺')},
 		{a: "' ☺", want: Mark('☺')},
 		{a: "'", want: Mark('.')},
+		{a: "'\xff", want: Mark('\uFFFD')},
 
 		{a: "+", want: Dot.Plus(Line(1))},
 		{a: "+\n2", left: "\n2", want: Dot.Plus(Line(1))},
@@ -217,9 +235,15 @@ func TestAddressString(t *testing.T) {
 		{addr: Rune(0)},
 		{addr: Rune(100)},
 		{addr: Rune(-100), want: Rune(0)},
+		{addr: Byte(0)},
+		{addr: Byte(100)},
+		{addr: Byte(-100), want: Byte(0)},
 		{addr: Line(0)},
 		{addr: Line(100)},
 		{addr: Line(-100), want: Line(0)},
+		{addr: LineCol(0, 1)},
+		{addr: LineCol(42, 7)},
+		{addr: LineCol(-100, -100), want: LineCol(0, 1)},
 		{addr: Mark('a')},
 		{addr: Mark('z')},
 		{addr: Mark(' ')},
@@ -303,8 +327,9 @@ func TestIOErrors(t *testing.T) {
 		}
 
 		// All subsequent reads will be errors.
+		// Hide the line index, so that line addresses must read.
 		f.error = errors.New("read error")
-		if a, err := addr.Where(buf); !matchesError(test.error, err) {
+		if a, err := addr.Where(unindexed{buf}); !matchesError(test.error, err) {
 			t.Errorf("Addr(%q).addr()=%v,%v, want addr{},%q", test, a, err, test.error)
 			continue
 		}
@@ -548,6 +573,100 @@ var runeTests = []editTest{
 	},
 }
 
+var byteTests = []editTest{
+	{
+		name:  "out of range",
+		given: "{..}",
+		do:    address(Byte(1)),
+		error: "out of range",
+	},
+	{
+		name:  "out of range negative",
+		given: "{..}",
+		do:    address(Dot.Minus(Byte(1))),
+		error: "out of range",
+	},
+	{
+		name:  "out of range multi-byte",
+		given: "{..}世",
+		do:    address(Byte(4)),
+		error: "out of range",
+		want:  "{..}世",
+	},
+	{
+		name:  "empty buffer",
+		given: "{..}",
+		do:    address(Byte(0)),
+		want:  "{..aa}",
+	},
+	{
+		name:  "ASCII",
+		given: "{..}abc",
+		do:    address(Byte(2)),
+		want:  "{..}ab{aa}c",
+	},
+	{
+		name:  "after multi-byte",
+		given: "{..}a世界b",
+		do:    address(Byte(4)),
+		want:  "{..}a世{aa}界b",
+	},
+	{
+		name:  "end",
+		given: "{..}a世界b",
+		do:    address(Byte(8)),
+		want:  "{..}a世界b{aa}",
+	},
+	{
+		name:  "within multi-byte",
+		given: "{..}a世界b",
+		do:    address(Byte(5)),
+		want:  "{..}a世{aa}界b",
+	},
+	{
+		name:  "relative to dot",
+		given: "世{..}界b",
+		do:    address(Dot.Plus(Byte(3))),
+		want:  "世{..}界{aa}b",
+	},
+	{
+		name:  "reverse",
+		given: "a世界{..}b",
+		do:    address(Dot.Minus(Byte(3))),
+		want:  "a世{aa}界{..}b",
+	},
+	{
+		name:  "reverse within multi-byte",
+		given: "a世界{..}b",
+		do:    address(Dot.Minus(Byte(1))),
+		want:  "a世{aa}界{..}b",
+	},
+	{
+		name:  "range",
+		given: "{..}a世界b",
+		do:    address(Byte(1).To(Byte(7))),
+		want:  "{..}a{a}世界{a}b",
+	},
+	{
+		name:  "line",
+		given: "{..}世\n界\n",
+		do:    address(Byte(4).Plus(Line(1))),
+		want:  "{..}世\n{a}界\n{a}",
+	},
+}
+
+func TestAddressByte(t *testing.T) {
+	for _, test := range byteTests {
+		test.run(t)
+	}
+}
+
+func TestAddressByteFromString(t *testing.T) {
+	for _, test := range byteTests {
+		test.runFromString(t)
+	}
+}
+
 func TestAddressRune(t *testing.T) {
 	for _, test := range runeTests {
 		test.run(t)
@@ -679,6 +798,147 @@ func TestAddressLineFromString(t *testing.T) {
 	}
 }
 
+var lineColTests = []editTest{
+	{
+		name:  "out of range",
+		given: "{..}",
+		do:    address(LineCol(2, 1)),
+		error: "out of range",
+	},
+	{
+		name:  "negative out of range",
+		given: "{..}",
+		do:    address(Dot.Minus(LineCol(2, 1))),
+		error: "out of range",
+	},
+	{
+		name:  "empty buffer",
+		given: "{..}",
+		do:    address(LineCol(1, 1)),
+		want:  "{..aa}",
+	},
+	{
+		name:  "line 0",
+		given: "{..}abc\n",
+		do:    address(LineCol(0, 3)),
+		want:  "{..aa}abc\n",
+	},
+	{
+		name:  "column 1",
+		given: "{..}abc\nxyz\n",
+		do:    address(LineCol(2, 1)),
+		want:  "{..}abc\n{aa}xyz\n",
+	},
+	{
+		name:  "column 0 is 1",
+		given: "{..}abc\nxyz\n",
+		do:    address(LineCol(2, 0)),
+		want:  "{..}abc\n{aa}xyz\n",
+	},
+	{
+		name:  "negative column is 1",
+		given: "{..}abc\nxyz\n",
+		do:    address(LineCol(2, -1)),
+		want:  "{..}abc\n{aa}xyz\n",
+	},
+	{
+		name:  "column",
+		given: "{..}abc\nxyz\n",
+		do:    address(LineCol(2, 3)),
+		want:  "{..}abc\nxy{aa}z\n",
+	},
+	{
+		name:  "last column",
+		given: "{..}abc\nxyz\n",
+		do:    address(LineCol(2, 4)),
+		want:  "{..}abc\nxyz{aa}\n",
+	},
+	{
+		name:  "column clamped before newline",
+		given: "{..}abc\nxyz\n",
+		do:    address(LineCol(1, 100)),
+		want:  "{..}abc{aa}\nxyz\n",
+	},
+	{
+		name:  "column clamped no newline",
+		given: "{..}abc\nxyz",
+		do:    address(LineCol(2, 100)),
+		want:  "{..}abc\nxyz{aa}",
+	},
+	{
+		name:  "column clamped empty line",
+		given: "{..}abc\n\nxyz",
+		do:    address(LineCol(2, 5)),
+		want:  "{..}abc\n{aa}\nxyz",
+	},
+	{
+		name:  "tab is one column",
+		given: "{..}\t\tabc",
+		do:    address(LineCol(1, 3)),
+		want:  "{..}\t\t{aa}abc",
+	},
+	{
+		name:  "multi-byte runes",
+		given: "{..}αβξ\n☺☹\n",
+		do:    address(LineCol(2, 2)),
+		want:  "{..}αβξ\n☺{aa}☹\n",
+	},
+	{
+		name:  "plus",
+		given: "abc\n{..}def\nghi\njkl",
+		do:    address(Dot.Plus(LineCol(2, 2))),
+		want:  "abc\n{..}def\ng{aa}hi\njkl",
+	},
+	{
+		name:  "minus",
+		given: "abc\ndef\nghi\n{..}jkl",
+		do:    address(Dot.Minus(LineCol(2, 2))),
+		want:  "abc\nd{aa}ef\nghi\n{..}jkl",
+	},
+	{
+		name:  "plus rune",
+		given: "{..}abc\ndef\n",
+		do:    address(LineCol(2, 2).Plus(Rune(1))),
+		want:  "{..}abc\nde{aa}f\n",
+	},
+	{
+		name:  "to",
+		given: "{..}abc\ndef\nghi",
+		do:    address(LineCol(1, 2).To(LineCol(3, 2))),
+		want:  "{..}a{a}bc\ndef\ng{a}hi",
+	},
+	{
+		name:  "then",
+		given: "{..}abc\ndef\nghi",
+		do:    address(LineCol(1, 2).Then(Dot.Plus(LineCol(1, 2)))),
+		want:  "{..}a{a}bc\nd{a}ef\nghi",
+	},
+	{
+		name:  "between",
+		given: "{..}abc\ndef\nghi",
+		do:    address(LineCol(3, 2).Between(LineCol(1, 3))),
+		want:  "{..}ab{a}c\ndef\ng{a}hi",
+	},
+	{
+		name:  "clamp",
+		given: "{..}abc\ndef",
+		do:    address(Clamp(LineCol(5, 2))),
+		want:  "{..}abc\ndef{aa}",
+	},
+}
+
+func TestAddressLineCol(t *testing.T) {
+	for _, test := range lineColTests {
+		test.run(t)
+	}
+}
+
+func TestAddressLineColFromString(t *testing.T) {
+	for _, test := range lineColTests {
+		test.runFromString(t)
+	}
+}
+
 var regexpTests = []editTest{
 	{
 		name:  "bad regexp",
@@ -976,6 +1236,66 @@ var regexpTests = []editTest{
 		do:    address(Regexp("(?:abc)")),
 		want:  "{..a}abc{a}",
 	},
+	{
+		name:  "reverse alternation",
+		given: "abc xyz abc {..}xyz",
+		do:    address(Dot.Minus(Regexp("xyz|abc"))),
+		want:  "abc xyz {a}abc{a} {..}xyz",
+	},
+	{
+		name:  "reverse alternation is leftmost-first",
+		given: "xab{..}",
+		do:    address(Dot.Minus(Regexp("a|ab"))),
+		want:  "x{a}a{a}b{..}",
+	},
+	{
+		name:  "reverse lazy repetition",
+		given: "a a b{..}",
+		do:    address(Dot.Minus(Regexp("a.*?b"))),
+		want:  "{a}a a b{..a}",
+	},
+	{
+		name:  "reverse case folding",
+		given: "abc ABC {..}abc",
+		do:    address(Dot.Minus(Regexp("(?i)abc"))),
+		want:  "abc {a}ABC{a} {..}abc",
+	},
+	{
+		name:  "reverse word boundary",
+		given: "abcabc abc{..}",
+		do:    address(Dot.Minus(Regexp(`\babc`))),
+		want:  "abcabc {a}abc{..a}",
+	},
+	{
+		name:  "reverse repetition",
+		given: "ab abab ababab{..}",
+		do:    address(Dot.Minus(Regexp(`(ab){2}`))),
+		want:  "ab abab {a}abab{a}ab{..}",
+	},
+	{
+		name:  "reverse match spanning lines",
+		given: "a\nb{..}",
+		do:    address(Dot.Minus(Regexp(`b|a\nb`))),
+		want:  "a\n{a}b{..a}",
+	},
+	{
+		name:  "reverse at most 4096 runes before the nearest match",
+		given: strings.Repeat("x", 5000) + "ab{..}",
+		do:    address(Dot.Minus(Regexp(`x.*?b`))),
+		want:  strings.Repeat("x", 903) + "{a}" + strings.Repeat("x", 4097) + "ab{..a}",
+	},
+	{
+		name:  "reverse \\A matches beginning of text",
+		given: "abc abc{..}",
+		do:    address(Dot.Minus(Regexp(`\Aabc`))),
+		want:  "{a}abc{a} abc{..}",
+	},
+	{
+		name:  "previous ^",
+		given: "abc\nxy{..}z",
+		do:    address(Dot.Minus(Regexp(`^`))),
+		want:  "abc\n{aa}xy{..}z",
+	},
 
 	// BUG(eaburns): Buggy cases with ^ and $. Issue #274.
 	//	{
@@ -991,12 +1311,6 @@ var regexpTests = []editTest{
 		want:  "a{..}bc{aa}\nxyz",
 	},
 	//	{
-	//		name:  "previous ^",
-	//		given: "abc\nxy{..}z",
-	//		do:    address(Dot.Minus(Regexp(`^`))),
-	//		want:  "abc\n{aa}xy{..}z",
-	//	},
-	//	{
 	//		name:  "previous $",
 	//		given: "abc\nxy{..}z",
 	//		do:    address(Dot.Minus(Regexp(`$`))),
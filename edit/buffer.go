@@ -5,6 +5,7 @@ package edit
 import (
 	"bufio"
 	"io"
+	"time"
 
 	"github.com/eaburns/T/edit/runes"
 )
@@ -12,10 +13,19 @@ import (
 // A Buffer implements the Editor interface,
 // editing an unbounded sequence of runes.
 type Buffer struct {
-	runes               *runes.Buffer
-	pending, undo, redo *log
-	seq                 int32
-	marks               map[rune]Span
+	runes        *runes.Buffer
+	pending      *log
+	tree         *undoTree
+	seq          int32
+	marks        map[rune]Span
+	registers    map[rune][]byte
+	lines, bytes *runeIndex
+	// Now returns the current time.
+	// It is the time of states of the undo tree.
+	now func() time.Time
+	// Moved, if non-nil, is called for each change
+	// made by Undo, Redo, and SetState.
+	moved func(Span, int64)
 }
 
 // NewBuffer returns a new, empty Buffer.
@@ -23,11 +33,14 @@ func NewBuffer() *Buffer { return newBuffer(runes.NewBuffer(1 << 12)) }
 
 func newBuffer(rs *runes.Buffer) *Buffer {
 	return &Buffer{
-		runes:   rs,
-		undo:    newLog(),
-		redo:    newLog(),
-		pending: newLog(),
-		marks:   make(map[rune]Span),
+		runes:     rs,
+		tree:      newUndoTree(time.Now()),
+		pending:   newLog(),
+		marks:     make(map[rune]Span),
+		registers: make(map[rune][]byte),
+		lines:     newOffsetIndex(),
+		bytes:     newCountIndex(rs, extraBytes),
+		now:       time.Now,
 	}
 }
 
@@ -36,8 +49,7 @@ func (buf *Buffer) Close() error {
 	errs := []error{
 		buf.runes.Close(),
 		buf.pending.close(),
-		buf.undo.close(),
-		buf.redo.close(),
+		buf.tree.close(),
 	}
 	for _, e := range errs {
 		if e != nil {
@@ -48,17 +60,30 @@ func (buf *Buffer) Close() error {
 }
 
 // Change changes the string identified by at
-// to contain the runes from the Reader.
+// to contain the size runes from the Reader.
 //
 // This method must be called with the Lock held.
-func (buf *Buffer) change(s Span, src runes.Reader) error {
+func (buf *Buffer) change(s Span, size int64, src runes.Reader) error {
+	// The byte index needs the weight of the deleted runes,
+	// which must be read before they are deleted.
+	removed, err := buf.bytes.sum(s[0], s.Size())
+	if err != nil {
+		return err
+	}
 	if err := buf.runes.Delete(s.Size(), s[0]); err != nil {
 		return err
 	}
-	n, err := runes.Copy(buf.runes.Writer(s[0]), src)
+	ir := &indexReader{Reader: src, size: size}
+	n, err := runes.Copy(buf.runes.Writer(s[0]), ir)
 	if err != nil {
 		return err
 	}
+	if err := buf.lines.update(s, n, 0, ir.newlines.done(n)); err != nil {
+		return err
+	}
+	if err := buf.bytes.update(s, n, removed, ir.bytes.chunks); err != nil {
+		return err
+	}
 	for m := range buf.marks {
 		buf.marks[m] = buf.marks[m].Update(s, n)
 	}
@@ -70,6 +95,18 @@ func (buf *Buffer) change(s Span, src runes.Reader) error {
 // It returns the number of Runes in the Buffer.
 func (buf *Buffer) Size() int64 { return buf.runes.Size() }
 
+// NewlinesBefore implements the NewlinesBefore method of the LineIndexer interface.
+func (buf *Buffer) NewlinesBefore(offs int64) int64 { return buf.lines.sumBefore(offs) }
+
+// Newline implements the Newline method of the LineIndexer interface.
+func (buf *Buffer) Newline(i int64) int64 { return buf.lines.nth(i) }
+
+// ByteOffset implements the ByteOffset method of the ByteIndexer interface.
+func (buf *Buffer) ByteOffset(offs int64) int64 { return offs + buf.bytes.sumBefore(offs) }
+
+// FromByteOffset implements the FromByteOffset method of the ByteIndexer interface.
+func (buf *Buffer) FromByteOffset(b int64) int64 { return buf.bytes.offsetAt(b) }
+
 func (buf *Buffer) Mark(m rune) Span { return buf.marks[m] }
 
 func (buf *Buffer) SetMark(m rune, s Span) error {
@@ -80,6 +117,10 @@ func (buf *Buffer) SetMark(m rune, s Span) error {
 	return nil
 }
 
+func (buf *Buffer) Register(r rune) []byte { return buf.registers[r] }
+
+func (buf *Buffer) SetRegister(r rune, text []byte) { buf.registers[r] = text }
+
 type runeReader struct {
 	span   Span
 	buffer *Buffer
@@ -135,114 +176,85 @@ func (buf *Buffer) Change(s Span, r io.Reader) (n int64, err error) {
 	return n, err
 }
 
+// Apply applies the staged changes,
+// creating a new state of the undo tree
+// as a child of the current state,
+// or merging them into the current state
+// within an undo group.
 func (buf *Buffer) Apply() error {
+	t := buf.tree
+	undoOffs, redoOffs := t.undo.buf.Size(), t.redo.buf.Size()
 	for e := logFirst(buf.pending); !e.end(); e = e.next() {
 		undoSpan := Span{e.span[0], e.span[0] + e.size}
 		undoSrc := buf.runes.Reader(e.span[0])
 		undoSrc = runes.LimitReader(undoSrc, e.span.Size())
-		if _, err := buf.undo.append(buf.seq, undoSpan, undoSrc); err != nil {
+		if _, err := t.undo.append(buf.seq, undoSpan, undoSrc); err != nil {
 			return err
 		}
 	}
 	dot := buf.marks['.']
+	changed := false
+	// Staged changes are in sequence,
+	// so each begins at or after the end of the previous.
+	// The preceding changes simply move it
+	// by the difference in their sizes, delta.
+	var delta int64
 	for e := logFirst(buf.pending); !e.end(); e = e.next() {
-		if e.span[0] == dot[0] {
+		span := Span{e.span[0] + delta, e.span[1] + delta}
+		if span[0] == dot[0] {
 			// If they have the same start, grow dot.
 			// Otherwise, update would simply leave it
 			// as a point address and move it.
-			dot[1] = dot.Update(e.span, e.size)[1]
+			dot[1] = dot.Update(span, e.size)[1]
 		} else {
-			dot = dot.Update(e.span, e.size)
-		}
-		for f := e.next(); !f.end(); f = f.next() {
-			f.span = f.span.Update(e.span, e.size)
-			if err := f.store(); err != nil {
-				return err
-			}
+			dot = dot.Update(span, e.size)
 		}
+		delta += e.size - e.span.Size()
 
-		if err := buf.change(e.span, e.data()); err != nil {
+		// The span is updated for the preceding changes,
+		// so the redo frame applies the changes in order.
+		if _, err := t.redo.append(buf.seq, span, e.data()); err != nil {
+			return err
+		}
+		if err := buf.change(span, e.size, e.data()); err != nil {
+			return err
+		}
+		changed = true
+	}
+	switch {
+	case changed && t.open:
+		if err := t.extend(buf.seq); err != nil {
+			return err
+		}
+	case changed:
+		if err := t.add(buf.seq, undoOffs, redoOffs, buf.now()); err != nil {
 			return err
 		}
+		t.open = t.group > 0
+		t.applied = t.cur
 	}
 	buf.pending.reset()
-	buf.redo.reset()
 	buf.marks['.'] = dot
 	buf.seq++
 	return nil
 }
 
+// Undo changes the Buffer to the parent of the current state of the undo tree.
 func (buf *Buffer) Undo() error {
-	marks0 := make(map[rune]Span, len(buf.marks))
-	for r, s := range buf.marks {
-		marks0[r] = s
-	}
-	defer func() { buf.marks = marks0 }()
-
-	all := Span{-1, 0}
-	start := logLastFrame(buf.undo)
-	if start.end() {
+	if buf.tree.cur == 0 {
 		return nil
 	}
-	for e := start; !e.end(); e = e.next() {
-		redoSpan := Span{e.span[0], e.span[0] + e.size}
-		redoSrc := buf.runes.Reader(e.span[0])
-		redoSrc = runes.LimitReader(redoSrc, e.span.Size())
-		if _, err := buf.redo.append(buf.seq, redoSpan, redoSrc); err != nil {
-			return err
-		}
-
-		if all[0] < 0 {
-			all[0] = e.span[0]
-		}
-		all[1] = e.span[0] + e.size
-		if err := buf.change(e.span, e.data()); err != nil {
-			return err
-		}
-	}
-	buf.marks['.'] = all
-	marks0 = buf.marks
-	buf.seq++
-	return start.pop()
+	return buf.move(buf.up)
 }
 
+// Redo changes the Buffer to the most recently visited child
+// of the current state of the undo tree.
 func (buf *Buffer) Redo() error {
-	marks0 := make(map[rune]Span, len(buf.marks))
-	for r, s := range buf.marks {
-		marks0[r] = s
-	}
-	defer func() { buf.marks = marks0 }()
-
-	start := logLastFrame(buf.redo)
-	if start.end() {
-		return nil
-	}
-	for e := start; !e.end(); e = e.next() {
-		undoSpan := Span{e.span[0], e.span[0] + e.size}
-		undoSrc := buf.runes.Reader(e.span[0])
-		undoSrc = runes.LimitReader(undoSrc, e.span.Size())
-		if _, err := buf.undo.append(buf.seq, undoSpan, undoSrc); err != nil {
-			return err
-		}
-	}
-
-	all := Span{0, -1}
-	for e := logLast(buf.redo); e != start.prev(); e = e.prev() {
-		all[0] = e.span[0]
-		if all[1] < 0 {
-			all[1] = e.span[0] + e.size
-		} else {
-			all[1] += e.size - e.span.Size()
-		}
-		if err := buf.change(e.span, e.data()); err != nil {
-			return err
-		}
+	nd, err := buf.tree.node(buf.tree.cur)
+	if err != nil || nd.child < 0 {
+		return err
 	}
-
-	buf.marks['.'] = all
-	marks0 = buf.marks
-	buf.seq++
-	return start.pop()
+	return buf.move(func() (Span, error) { return buf.down(nd.child) })
 }
 
 // A log holds a record of changes made to a buffer.
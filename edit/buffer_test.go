@@ -3,10 +3,15 @@
 package edit
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 	"unicode/utf8"
 
 	"github.com/eaburns/T/edit/runes"
@@ -108,6 +113,565 @@ func TestBufferChangeSize(t *testing.T) {
 	}
 }
 
+// TestBufferIndex tests that the line and byte indices
+// are maintained across Apply, Undo, and Redo.
+func TestBufferIndex(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+	checkIndex(t, "empty", buf)
+
+	rand.Seed(0) // For reproducibility.
+	for i := 0; i < 200; i++ {
+		var op string
+		switch r := rand.Intn(10); {
+		case r < 2 && i > 0:
+			op = "undo"
+			if err := buf.Undo(); err != nil {
+				t.Fatalf("buf.Undo()=%v, want nil", err)
+			}
+		case r < 3 && i > 0:
+			op = "redo"
+			if err := buf.Redo(); err != nil {
+				t.Fatalf("buf.Redo()=%v, want nil", err)
+			}
+		default:
+			s0 := rand.Int63n(buf.Size() + 1)
+			s := Span{s0, s0 + rand.Int63n(buf.Size()-s0+1)}
+			str := randomText(rand.Intn(3000))
+			op = fmt.Sprintf("change %v to %d runes", s, len(str))
+			if _, err := buf.Change(s, strings.NewReader(str)); err != nil {
+				t.Fatalf("buf.Change(%v, _)=%v, want nil", s, err)
+			}
+			if err := buf.Apply(); err != nil {
+				t.Fatalf("buf.Apply()=%v, want nil", err)
+			}
+		}
+		checkIndex(t, fmt.Sprintf("%d: %s", i, op), buf)
+	}
+}
+
+// TestBufferIndexChunks tests that the chunks of the line index
+// are merged as lines are deleted.
+func TestBufferIndexChunks(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+
+	const lines = 20000
+	str := strings.Repeat("line\n", lines)
+	if _, err := buf.Change(Span{}, strings.NewReader(str)); err != nil {
+		t.Fatalf("buf.Change(Span{}, _)=%v, want nil", err)
+	}
+	if err := buf.Apply(); err != nil {
+		t.Fatalf("buf.Apply()=%v, want nil", err)
+	}
+	checkChunks(t, "insert", buf.lines, lines)
+
+	rand.Seed(0) // For reproducibility.
+	for n := int64(lines); n > 10; n-- {
+		i := rand.Int63n(n)
+		s := Span{buf.Newline(i) - 4, buf.Newline(i) + 1}
+		if _, err := buf.Change(s, strings.NewReader("")); err != nil {
+			t.Fatalf("buf.Change(%v, _)=%v, want nil", s, err)
+		}
+		if err := buf.Apply(); err != nil {
+			t.Fatalf("buf.Apply()=%v, want nil", err)
+		}
+		if n%500 == 0 {
+			checkChunks(t, fmt.Sprintf("%d lines", n), buf.lines, n-1)
+		}
+	}
+	checkIndex(t, "deleted", buf)
+}
+
+// CheckChunks checks that the chunks of a line index
+// are neither too large nor too many for the number of lines.
+func checkChunks(t *testing.T, name string, ix *runeIndex, lines int64) {
+	var chunks int64
+	var visit func(*indexNode)
+	visit = func(n *indexNode) {
+		if n == nil {
+			return
+		}
+		visit(n.left)
+		if len(n.chunk.offs) > indexChunkRunes {
+			t.Fatalf("%s: chunk has %d indexed runes, want at most %d",
+				name, len(n.chunk.offs), indexChunkRunes)
+		}
+		chunks++
+		visit(n.right)
+	}
+	visit(ix.root)
+	if max := 8*lines/indexChunkRunes + 2; chunks > max {
+		t.Fatalf("%s: %d chunks, want at most %d", name, chunks, max)
+	}
+}
+
+// TestBufferUndoTree tests that every state of the undo tree
+// is reachable with SetState, Undo, and Redo,
+// including states with changes merged by undo groups.
+func TestBufferUndoTree(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+
+	rand.Seed(0) // For reproducibility.
+	texts := []string{""}
+	for i := 0; i < 200; i++ {
+		var op string
+		switch r := rand.Intn(10); {
+		case r < 2:
+			op = "undo"
+			if err := buf.Undo(); err != nil {
+				t.Fatalf("buf.Undo()=%v, want nil", err)
+			}
+		case r < 3:
+			op = "redo"
+			if err := buf.Redo(); err != nil {
+				t.Fatalf("buf.Redo()=%v, want nil", err)
+			}
+		case r < 4:
+			switch rand.Intn(3) {
+			case 0:
+				op = "begin group"
+				buf.BeginGroup()
+			case 1:
+				op = "continue group"
+				buf.ContinueGroup()
+			default:
+				op = "end group"
+				buf.EndGroup()
+			}
+		case r < 6:
+			n := rand.Intn(buf.States())
+			op = fmt.Sprintf("set state %d", n)
+			if err := buf.SetState(n); err != nil {
+				t.Fatalf("buf.SetState(%d)=%v, want nil", n, err)
+			}
+			if s := buf.State(); s != n {
+				t.Fatalf("%d: %s: buf.State()=%d, want %d", i, op, s, n)
+			}
+		default:
+			// Stage one or two changes in ascending order.
+			var s Span
+			op = "change"
+			for j := rand.Intn(2); j >= 0; j-- {
+				s0 := s[1] + rand.Int63n(buf.Size()-s[1]+1)
+				s = Span{s0, s0 + rand.Int63n(buf.Size()-s0+1)}
+				str := randomText(rand.Intn(100))
+				op += fmt.Sprintf(" %v to %d runes", s, len(str))
+				if _, err := buf.Change(s, strings.NewReader(str)); err != nil {
+					t.Fatalf("buf.Change(%v, _)=%v, want nil", s, err)
+				}
+			}
+			if err := buf.Apply(); err != nil {
+				t.Fatalf("buf.Apply()=%v, want nil", err)
+			}
+			if buf.States() == len(texts) {
+				// The change was merged into the current state.
+				texts[buf.State()] = buf.String()
+				break
+			}
+			texts = append(texts, buf.String())
+			if s := buf.State(); s != len(texts)-1 {
+				t.Fatalf("%d: %s: buf.State()=%d, want %d", i, op, s, len(texts)-1)
+			}
+		}
+		if n := buf.States(); n != len(texts) {
+			t.Fatalf("%d: %s: buf.States()=%d, want %d", i, op, n, len(texts))
+		}
+		if got, want := buf.String(), texts[buf.State()]; got != want {
+			t.Fatalf("%d: %s: state %d is %q, want %q", i, op, buf.State(), got, want)
+		}
+		checkIndex(t, fmt.Sprintf("%d: %s", i, op), buf)
+	}
+}
+
+func TestBufferStateAt(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	var now time.Time
+	buf.now = func() time.Time { return now }
+	for i := 1; i <= 3; i++ {
+		now = t0.Add(time.Duration(i) * time.Minute)
+		if _, err := buf.Change(Span{}, strings.NewReader("x")); err != nil {
+			t.Fatalf("buf.Change(Span{}, x)=%v, want nil", err)
+		}
+		if err := buf.Apply(); err != nil {
+			t.Fatalf("buf.Apply()=%v, want nil", err)
+		}
+	}
+	if err := buf.SetState(1); err != nil {
+		t.Fatalf("buf.SetState(1)=%v, want nil", err)
+	}
+
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{d: 0, want: 0},
+		{d: time.Minute - 1, want: 0},
+		{d: time.Minute, want: 1},
+		{d: 2*time.Minute + 30*time.Second, want: 2},
+		{d: 3 * time.Minute, want: 3},
+		{d: time.Hour, want: 3},
+	}
+	for _, test := range tests {
+		tm := t0.Add(test.d)
+		if got, err := buf.StateAt(tm); got != test.want || err != nil {
+			t.Errorf("buf.StateAt(%v)=%d,%v, want %d,nil", tm, got, err, test.want)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		want := t0.Add(time.Duration(i) * time.Minute)
+		if got, err := buf.StateTime(i); !got.Equal(want) || err != nil {
+			t.Errorf("buf.StateTime(%d)=%v,%v, want %v,nil", i, got, err, want)
+		}
+	}
+	if _, err := buf.StateTime(4); err != ErrInvalidArgument {
+		t.Errorf("buf.StateTime(4)=_,%v, want %v", err, ErrInvalidArgument)
+	}
+}
+
+func TestBufferSetMoveFunc(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+
+	type moved struct {
+		s    Span
+		size int64
+	}
+	var got []moved
+	buf.SetMoveFunc(func(s Span, size int64) { got = append(got, moved{s, size}) })
+	changes := []struct {
+		s    Span
+		text string
+	}{
+		{s: Span{0, 0}, text: "abc"},
+		{s: Span{1, 2}, text: "XY"},
+	}
+	for _, c := range changes {
+		if _, err := buf.Change(c.s, strings.NewReader(c.text)); err != nil {
+			t.Fatalf("buf.Change(%v, %q)=%v, want nil", c.s, c.text, err)
+		}
+		if err := buf.Apply(); err != nil {
+			t.Fatalf("buf.Apply()=%v, want nil", err)
+		}
+	}
+	if len(got) > 0 {
+		t.Fatalf("moved after Apply: %v, want none", got)
+	}
+
+	tests := []struct {
+		name string
+		move func() error
+		want []moved
+	}{
+		{name: "undo", move: buf.Undo, want: []moved{{Span{1, 3}, 1}}},
+		{name: "undo", move: buf.Undo, want: []moved{{Span{0, 3}, 0}}},
+		{name: "redo", move: buf.Redo, want: []moved{{Span{0, 0}, 3}}},
+		{
+			name: "set state 2",
+			move: func() error { return buf.SetState(2) },
+			want: []moved{{Span{1, 2}, 2}},
+		},
+		{
+			name: "set state 0",
+			move: func() error { return buf.SetState(0) },
+			want: []moved{{Span{1, 3}, 1}, {Span{0, 3}, 0}},
+		},
+	}
+	for _, test := range tests {
+		got = nil
+		if err := test.move(); err != nil {
+			t.Fatalf("%s: %v, want nil", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: moved %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBufferUndoGroup(t *testing.T) {
+	// Each op is either a string to append to the buffer,
+	// or one of "begin", "continue", "end", "undo", or "redo".
+	tests := []struct {
+		ops  []string
+		want string
+		// States is the wanted number of states of the undo tree.
+		states int
+	}{
+		{
+			ops:    []string{"a", "b", "c", "undo"},
+			want:   "ab",
+			states: 4,
+		},
+		{
+			ops:    []string{"begin", "a", "b", "c", "end", "undo"},
+			want:   "",
+			states: 2,
+		},
+		{
+			ops:    []string{"begin", "a", "b", "c", "end", "undo", "redo"},
+			want:   "abc",
+			states: 2,
+		},
+		{
+			ops:    []string{"a", "begin", "b", "c", "end", "d", "undo", "undo"},
+			want:   "a",
+			states: 4,
+		},
+		{
+			ops:    []string{"begin", "a", "begin", "b", "end", "c", "end", "undo"},
+			want:   "",
+			states: 2,
+		},
+		{
+			ops:    []string{"begin", "a", "b", "undo", "c", "d", "end", "undo"},
+			want:   "",
+			states: 3,
+		},
+		{
+			ops:    []string{"begin", "a", "b", "undo", "c", "d", "end", "undo", "redo"},
+			want:   "cd",
+			states: 3,
+		},
+		{
+			ops:    []string{"a", "continue", "b", "end", "continue", "c", "end", "undo"},
+			want:   "",
+			states: 2,
+		},
+		{
+			ops:    []string{"a", "undo", "continue", "b", "end", "undo"},
+			want:   "",
+			states: 3,
+		},
+		{
+			ops:    []string{"a", "b", "undo", "continue", "c", "end", "undo"},
+			want:   "a",
+			states: 4,
+		},
+		{
+			ops:    []string{"end", "a", "end", "b", "undo"},
+			want:   "a",
+			states: 3,
+		},
+	}
+	for _, test := range tests {
+		buf := NewBuffer()
+		defer buf.Close()
+		for _, op := range test.ops {
+			var err error
+			switch op {
+			case "begin":
+				buf.BeginGroup()
+			case "continue":
+				buf.ContinueGroup()
+			case "end":
+				buf.EndGroup()
+			case "undo":
+				err = buf.Undo()
+			case "redo":
+				err = buf.Redo()
+			default:
+				s := Span{buf.Size(), buf.Size()}
+				if _, err = buf.Change(s, strings.NewReader(op)); err == nil {
+					err = buf.Apply()
+				}
+			}
+			if err != nil {
+				t.Fatalf("%v: %s failed: %v", test.ops, op, err)
+			}
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.ops, got, test.want)
+		}
+		if got := buf.States(); got != test.states {
+			t.Errorf("%v: buf.States()=%d, want %d", test.ops, got, test.states)
+		}
+	}
+}
+
+// RandomText returns a string of n runes,
+// many of which are newlines or multi-byte runes.
+func TestBufferSnapshot(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+	rand.Seed(0) // For reproducibility.
+	for i := 0; i < 50; i++ {
+		if rand.Intn(4) == 0 {
+			if err := buf.Undo(); err != nil {
+				t.Fatalf("buf.Undo()=%v, want nil", err)
+			}
+			continue
+		}
+		s0 := rand.Int63n(buf.Size() + 1)
+		s := Span{s0, s0 + rand.Int63n(buf.Size()-s0+1)}
+		if _, err := buf.Change(s, strings.NewReader(randomText(rand.Intn(100)))); err != nil {
+			t.Fatalf("buf.Change(%v, _)=%v, want nil", s, err)
+		}
+		if err := buf.Apply(); err != nil {
+			t.Fatalf("buf.Apply()=%v, want nil", err)
+		}
+	}
+	if err := buf.SetMark('a', Span{1, 5}); err != nil {
+		t.Fatalf("buf.SetMark('a', {1, 5})=%v, want nil", err)
+	}
+	buf.SetRegister('r', []byte("Hello, 世界"))
+
+	for _, history := range []bool{true, false} {
+		var b bytes.Buffer
+		if err := buf.Snapshot(&b, history); err != nil {
+			t.Fatalf("buf.Snapshot(_, %v)=%v, want nil", history, err)
+		}
+		restored, err := ReadSnapshot(&b)
+		if err != nil {
+			t.Fatalf("ReadSnapshot(buf.Snapshot(_, %v))=_,%v, want nil", history, err)
+		}
+		defer restored.Close()
+		name := fmt.Sprintf("history=%v", history)
+		if got, want := restored.String(), buf.String(); got != want {
+			t.Errorf("%s: restored text is %q, want %q", name, got, want)
+		}
+		checkIndex(t, name, restored)
+		for _, m := range []rune{'.', 'a'} {
+			if got, want := restored.Mark(m), buf.Mark(m); got != want {
+				t.Errorf("%s: restored.Mark(%q)=%v, want %v", name, m, got, want)
+			}
+		}
+		if got, want := string(restored.Register('r')), string(buf.Register('r')); got != want {
+			t.Errorf("%s: restored.Register('r')=%q, want %q", name, got, want)
+		}
+		if !history {
+			if n := restored.States(); n != 1 {
+				t.Errorf("%s: restored.States()=%d, want 1", name, n)
+			}
+			continue
+		}
+		if got, want := restored.States(), buf.States(); got != want {
+			t.Fatalf("%s: restored.States()=%d, want %d", name, got, want)
+		}
+		if got, want := restored.State(), buf.State(); got != want {
+			t.Errorf("%s: restored.State()=%d, want %d", name, got, want)
+		}
+		for i := 0; i < buf.States(); i++ {
+			if err := buf.SetState(i); err != nil {
+				t.Fatalf("buf.SetState(%d)=%v, want nil", i, err)
+			}
+			if err := restored.SetState(i); err != nil {
+				t.Fatalf("%s: restored.SetState(%d)=%v, want nil", name, i, err)
+			}
+			if got, want := restored.String(), buf.String(); got != want {
+				t.Errorf("%s: restored state %d is %q, want %q", name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestBufferSnapshotPending(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+	if _, err := buf.Change(Span{}, strings.NewReader("Hello")); err != nil {
+		t.Fatalf("buf.Change({}, \"Hello\")=%v, want nil", err)
+	}
+	if err := buf.Snapshot(ioutil.Discard, true); err == nil {
+		t.Errorf("buf.Snapshot(_, true)=nil, want error")
+	}
+}
+
+func TestReadSnapshotError(t *testing.T) {
+	buf := NewBuffer()
+	defer buf.Close()
+	if _, err := buf.Change(Span{}, strings.NewReader("Hello, 世界")); err != nil {
+		t.Fatalf("buf.Change({}, _)=%v, want nil", err)
+	}
+	if err := buf.Apply(); err != nil {
+		t.Fatalf("buf.Apply()=%v, want nil", err)
+	}
+	var b bytes.Buffer
+	if err := buf.Snapshot(&b, true); err != nil {
+		t.Fatalf("buf.Snapshot(_, true)=%v, want nil", err)
+	}
+	snapshot := b.Bytes()
+	for n := 0; n < len(snapshot); n++ {
+		if restored, err := ReadSnapshot(bytes.NewReader(snapshot[:n])); err == nil {
+			restored.Close()
+			t.Errorf("ReadSnapshot(snapshot[:%d])=_,nil, want error", n)
+		}
+	}
+	bad := append([]byte{}, snapshot...)
+	bad[0] = 'X'
+	if restored, err := ReadSnapshot(bytes.NewReader(bad)); err == nil {
+		restored.Close()
+		t.Errorf("ReadSnapshot(bad magic)=_,nil, want error")
+	}
+}
+
+func randomText(n int) string {
+	rs := make([]rune, n)
+	for i := range rs {
+		switch rand.Intn(4) {
+		case 0:
+			rs[i] = '\n'
+		case 1:
+			rs[i] = []rune("αβ世界☺\U0001F600")[rand.Intn(6)]
+		default:
+			rs[i] = 'a' + rune(rand.Intn(26))
+		}
+	}
+	return string(rs)
+}
+
+func checkIndex(t *testing.T, name string, buf *Buffer) {
+	var nls []int64
+	var b int64
+	rs := []rune(buf.String())
+	// Byte offsets are converted by reading the Buffer,
+	// so only a sample of the offsets of large Buffers is checked.
+	check := func(i int) bool { return len(rs) <= 1000 || rand.Intn(len(rs)) < 1000 }
+	for i, r := range rs {
+		if r == '\n' {
+			nls = append(nls, int64(i))
+		}
+		if !check(i) {
+			b += int64(utf8.RuneLen(r))
+			continue
+		}
+		if got := buf.ByteOffset(int64(i)); got != b {
+			t.Fatalf("%s: buf.ByteOffset(%d)=%d, want %d", name, i, got, b)
+		}
+		for j := 0; j < utf8.RuneLen(r); j++ {
+			if got := buf.FromByteOffset(b); got != int64(i) {
+				t.Fatalf("%s: buf.FromByteOffset(%d)=%d, want %d", name, b, got, i)
+			}
+			b++
+		}
+	}
+	if got := buf.ByteOffset(buf.Size()); got != b {
+		t.Fatalf("%s: buf.ByteOffset(%d)=%d, want %d", name, buf.Size(), got, b)
+	}
+	if got := buf.FromByteOffset(b); got != buf.Size() {
+		t.Fatalf("%s: buf.FromByteOffset(%d)=%d, want %d", name, b, got, buf.Size())
+	}
+	for i, nl := range nls {
+		if got := buf.Newline(int64(i)); got != nl {
+			t.Fatalf("%s: buf.Newline(%d)=%d, want %d", name, i, got, nl)
+		}
+		if got := buf.NewlinesBefore(nl); got != int64(i) {
+			t.Fatalf("%s: buf.NewlinesBefore(%d)=%d, want %d", name, nl, got, i)
+		}
+		if got := buf.NewlinesBefore(nl + 1); got != int64(i+1) {
+			t.Fatalf("%s: buf.NewlinesBefore(%d)=%d, want %d", name, nl+1, got, i+1)
+		}
+	}
+	if got := buf.Newline(int64(len(nls))); got != -1 {
+		t.Fatalf("%s: buf.Newline(%d)=%d, want -1", name, len(nls), got)
+	}
+	if got := buf.NewlinesBefore(buf.Size()); got != int64(len(nls)) {
+		t.Fatalf("%s: buf.NewlinesBefore(%d)=%d, want %d", name, buf.Size(), got, len(nls))
+	}
+}
+
 func TestLogEntryEmpty(t *testing.T) {
 	l := newLog()
 	defer l.close()
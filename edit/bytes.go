@@ -0,0 +1,171 @@
+// Copyright © 2016, The T Authors.
+
+package edit
+
+import "io"
+
+type byteEditor struct {
+	Editor
+	ix ByteIndexer
+}
+
+// Bytes returns an Editor that edits ed
+// using Spans with units of bytes of the UTF-8 encoding of its text.
+//
+// Offsets are converted using the methods of ed's ByteIndexer,
+// if it implements ByteIndexer.
+// Otherwise, offsets are converted by reading ed's text
+// from the beginning, which is slow for large texts.
+//
+// A byte offset within the encoding of a rune
+// is converted to the offset of the beginning of the rune.
+func Bytes(ed Editor) Editor {
+	if ix, ok := byteIndexerOf(ed); ok {
+		return byteEditor{Editor: ed, ix: ix}
+	}
+	return byteEditor{Editor: ed, ix: scanIndexer{ed}}
+}
+
+// Size returns the size of the text in bytes.
+func (ed byteEditor) Size() int64 { return ed.ix.ByteOffset(ed.Editor.Size()) }
+
+func (ed byteEditor) valid(s Span) bool {
+	size := ed.Size()
+	return s[0] >= 0 && s[1] >= 0 && s[0] <= size && s[1] <= size
+}
+
+func (ed byteEditor) toBytes(s Span) Span {
+	return Span{ed.ix.ByteOffset(s[0]), ed.ix.ByteOffset(s[1])}
+}
+
+func (ed byteEditor) fromBytes(s Span) Span {
+	return Span{ed.ix.FromByteOffset(s[0]), ed.ix.FromByteOffset(s[1])}
+}
+
+func (ed byteEditor) Mark(m rune) Span { return ed.toBytes(ed.Editor.Mark(m)) }
+
+func (ed byteEditor) SetMark(m rune, s Span) error {
+	if !ed.valid(s) {
+		return ErrInvalidArgument
+	}
+	return ed.Editor.SetMark(m, ed.fromBytes(s))
+}
+
+// RuneReader returns a RuneReader that reads the runes of the Span.
+// The width returned by ReadRune is the number of bytes
+// in the UTF-8 encoding of the rune.
+func (ed byteEditor) RuneReader(s Span) io.RuneReader {
+	if !ed.valid(s) {
+		return badRange{}
+	}
+	return byteRuneReader{ed.Editor.RuneReader(ed.fromBytes(s))}
+}
+
+func (ed byteEditor) Reader(s Span) io.Reader {
+	if !ed.valid(s) {
+		return badRange{}
+	}
+	return ed.Editor.Reader(ed.fromBytes(s))
+}
+
+// Change changes the Span to the text of the Reader,
+// and returns the number of bytes read from the Reader.
+func (ed byteEditor) Change(s Span, r io.Reader) (int64, error) {
+	if !ed.valid(s) {
+		return 0, ErrInvalidArgument
+	}
+	cr := &countReader{r: r}
+	_, err := ed.Editor.Change(ed.fromBytes(s), cr)
+	return cr.n, err
+}
+
+type byteRuneReader struct{ rr io.RuneReader }
+
+func (rr byteRuneReader) ReadRune() (rune, int, error) {
+	r, _, err := rr.rr.ReadRune()
+	if err != nil {
+		return r, 0, err
+	}
+	return r, runeBytes(r), nil
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// ByteIndex is the ByteIndexer of a byteEditor.
+// The offsets of a byteEditor are already byte offsets,
+// so it only rounds byte offsets to the beginning of their rune.
+type byteIndex struct{ byteEditor }
+
+func (ix byteIndex) ByteOffset(offs int64) int64 { return offs }
+
+func (ix byteIndex) FromByteOffset(b int64) int64 {
+	return ix.ix.ByteOffset(ix.ix.FromByteOffset(b))
+}
+
+// ByteLineIndex is the LineIndexer of a byteEditor
+// whose Editor is a LineIndexer.
+type byteLineIndex struct {
+	byteEditor
+	lines LineIndexer
+}
+
+func (ix byteLineIndex) NewlinesBefore(b int64) int64 {
+	return ix.lines.NewlinesBefore(ix.ix.FromByteOffset(b))
+}
+
+func (ix byteLineIndex) Newline(i int64) int64 {
+	offs := ix.lines.Newline(i)
+	if offs < 0 {
+		return -1
+	}
+	return ix.ix.ByteOffset(offs)
+}
+
+// ByteReleaser is the Releaser of a byteEditor
+// whose Editor is a Releaser.
+type byteReleaser struct {
+	byteEditor
+	rel Releaser
+}
+
+func (ed byteReleaser) Release() bool { return ed.rel.Release() }
+
+func (ed byteReleaser) Acquire() error { return ed.rel.Acquire() }
+
+// A scanIndexer is a ByteIndexer that reads its Text to convert offsets.
+// Errors reading the text are treated as the end of the text.
+type scanIndexer struct{ Text }
+
+func (ix scanIndexer) ByteOffset(offs int64) int64 {
+	var b int64
+	rr := ix.RuneReader(Span{0, offs})
+	for {
+		r, _, err := rr.ReadRune()
+		if err != nil {
+			return b
+		}
+		b += int64(runeBytes(r))
+	}
+}
+
+func (ix scanIndexer) FromByteOffset(b int64) int64 {
+	var offs int64
+	rr := ix.RuneReader(Span{0, ix.Size()})
+	for {
+		r, w, err := rr.ReadRune()
+		if err != nil || int64(runeBytes(r)) > b {
+			return offs
+		}
+		b -= int64(runeBytes(r))
+		offs += int64(w)
+	}
+}
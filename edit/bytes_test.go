@@ -0,0 +1,111 @@
+// Copyright © 2016, The T Authors.
+
+package edit
+
+import "testing"
+
+var bytesTests = []editTest{
+	{
+		name:  "where",
+		given: "a世{..}界b",
+		do:    []Edit{Where(Dot)},
+		want:  "a世{..}界b",
+		print: "#4\n",
+	},
+	{
+		name:  "where range",
+		given: "a{.}世界{.}b",
+		do:    []Edit{Where(Dot)},
+		want:  "a{.}世界{.}b",
+		print: "#1,#7\n",
+	},
+	{
+		name:  "where line",
+		given: "世\n界\n{..}",
+		do:    []Edit{WhereLine(Rune(1).To(Line(2)))},
+		want:  "世{.}\n界\n{.}",
+		print: "1,2\n",
+	},
+	{
+		name:  "rune address",
+		given: "{..}a世界b",
+		do:    []Edit{Where(Rune(2))},
+		want:  "a世{..}界b",
+		print: "#4\n",
+	},
+	{
+		name:  "line address",
+		given: "{..}世\n界\nb",
+		do:    []Edit{Where(Line(2))},
+		want:  "世\n{.}界\n{.}b",
+		print: "#4,#8\n",
+	},
+	{
+		name:  "change",
+		given: "{..}a世界b",
+		do:    []Edit{Change(Byte(1).To(Byte(4)), "xyz")},
+		want:  "a{.}xyz{.}界b",
+	},
+	{
+		name:  "change print",
+		given: "{..}a世界b",
+		do:    []Edit{Change(Byte(1).To(Byte(4)), "☺"), Where(Dot)},
+		want:  "a{.}☺{.}界b",
+		print: "#1,#4\n",
+	},
+	{
+		name:  "set mark",
+		given: "{..}a世界b",
+		do:    []Edit{Set(Byte(4).To(Byte(7)), 'm')},
+		want:  "{..}a世{m}界{m}b",
+	},
+	{
+		name:  "substitute",
+		given: "{..}世a界a",
+		do:    []Edit{SubGlobal(All, "a", "☺"), Where(Dot)},
+		want:  "{.}世☺界☺{.}",
+		print: "#0,#12\n",
+	},
+	{
+		name:  "substitute empty matches",
+		given: "{..}世界",
+		do:    []Edit{SubGlobal(All, "a*", "-"), Where(Dot)},
+		want:  "{.}-世-界-{.}",
+		print: "#0,#9\n",
+	},
+	{
+		name:  "substitute submatch",
+		given: "{..}a世界b",
+		do:    []Edit{SubGlobal(All, "(世)(界)", "$2$1")},
+		want:  "{.}a界世b{.}",
+	},
+	{
+		name:  "reverse regexp",
+		given: "a世界b{..}",
+		do:    []Edit{Where(Dot.Minus(Regexp("界")))},
+		want:  "a世{.}界{.}b",
+		print: "#4,#7\n",
+	},
+	{
+		name:  "loop",
+		given: "{..}世a界a",
+		do:    []Edit{Loop(All, "a", Where(Dot))},
+		want:  "世a界{.}a{.}",
+		print: "#3,#4\n#7,#8\n",
+	},
+	{
+		name:  "out of range",
+		given: "{..}世",
+		do:    []Edit{Where(Rune(2))},
+		want:  "{..}世",
+		error: "out of range",
+	},
+}
+
+func TestBytes(t *testing.T) {
+	for _, test := range bytesTests {
+		test.runEditor(t, func(buf *Buffer) Editor { return Bytes(buf) })
+		test.name += " (unindexed)"
+		test.runEditor(t, func(buf *Buffer) Editor { return Bytes(unindexed{buf}) })
+	}
+}
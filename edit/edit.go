@@ -49,7 +49,8 @@
 // The Change method stages a change to a specified Span of the Text.
 // It does not modify the Text itself.
 // The Apply method modifies the Text by applying all staged changes in sequence.
-// Undo and Redo, undo and redo batches of changes made with Apply.
+// Undo and Redo move between the states of the Editor's undo tree,
+// undoing and redoing the batches of changes made with Apply.
 //
 // Edits provide a high-level language for modifying a Text.
 // Like Addresses, they can be constructed in two different ways.
@@ -90,7 +91,9 @@
 package edit
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -100,8 +103,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/eaburns/T/edit/runes"
 )
 
 // An Edit is an operation that can be made on a Buffer by an Editor.
@@ -274,6 +280,96 @@ func (e set) Do(ed Editor, _ io.Writer) error {
 	return ed.SetMark(e.mark, s)
 }
 
+type yank struct {
+	Address
+	register rune
+}
+
+// Yank returns an Edit
+// that copies the string at a into register r
+// and sets dot to a.
+// The register r can by any rune.
+// If the register is whitespace then the register . is used.
+//
+// It is an error if the Editor is not a Registerer.
+func Yank(a Address, r rune) Edit {
+	if unicode.IsSpace(r) {
+		r = '.'
+	}
+	return yank{Address: a, register: r}
+}
+
+func (e yank) String() string { return e.Address.String() + "h" + string(e.register) }
+
+func (e yank) Do(ed Editor, _ io.Writer) error {
+	regs, ok := registersOf(ed)
+	if !ok {
+		return errors.New("no registers")
+	}
+	s, err := e.Where(ed)
+	if err != nil {
+		return err
+	}
+	text, err := ioutil.ReadAll(ed.Reader(s))
+	if err != nil {
+		return err
+	}
+	regs.SetRegister(e.register, text)
+	setDot(ed, s)
+	return nil
+}
+
+type put struct {
+	Address
+	register rune
+}
+
+// Put returns an Edit
+// that changes the string at a to the text of register r,
+// and sets dot to the changed runes.
+// The register r can by any rune.
+// If the register is whitespace then the register . is used.
+//
+// It is an error if the Editor is not a Registerer.
+func Put(a Address, r rune) Edit {
+	if unicode.IsSpace(r) {
+		r = '.'
+	}
+	return put{Address: a, register: r}
+}
+
+func (e put) String() string { return e.Address.String() + "l" + string(e.register) }
+
+func (e put) Do(ed Editor, _ io.Writer) error {
+	regs, ok := registersOf(ed)
+	if !ok {
+		return errors.New("no registers")
+	}
+	s, err := e.Where(ed)
+	if err != nil {
+		return err
+	}
+	setDot(ed, s)
+	if _, err := ed.Change(s, bytes.NewReader(regs.Register(e.register))); err != nil {
+		return err
+	}
+	return ed.Apply()
+}
+
+// RegistersOf returns the Registerer underlying an Editor, if any.
+// It looks through the wrappers used internally by this package.
+func registersOf(ed Editor) (Registerer, bool) {
+	switch e := ed.(type) {
+	case Registerer:
+		return e, true
+	case ignoreApply:
+		return registersOf(e.Editor)
+	case byteEditor:
+		return registersOf(e.Editor)
+	}
+	return nil, false
+}
+
 type print struct{ Address }
 
 // Print returns an Edit
@@ -344,23 +440,35 @@ func (e where) Do(ed Editor, print io.Writer) error {
 }
 
 func lines(ed Editor, s Span) (l0, l1 int64, err error) {
+	if ix, ok := lineIndexerOf(ed); ok {
+		l0 = 1 + ix.NewlinesBefore(s[0])
+		l1 = l0
+		if s[1]-1 > s[0] {
+			l1 = 1 + ix.NewlinesBefore(s[1]-1)
+		}
+		return l0, l1, nil
+	}
 	var i int64
 	l0 = int64(1) // line numbers are 1 based.
 	rr := ed.RuneReader(Span{0, ed.Size()})
-	for ; i < s[0]; i++ {
-		switch r, _, err := rr.ReadRune(); {
-		case err != nil:
+	for i < s[0] {
+		r, w, err := rr.ReadRune()
+		if err != nil {
 			return 0, 0, err
-		case r == '\n':
+		}
+		i += int64(w)
+		if r == '\n' {
 			l0++
 		}
 	}
 	l1 = l0
-	for ; i < s[1]-1; i++ {
-		switch r, _, err := rr.ReadRune(); {
-		case err != nil:
+	for i < s[1]-1 {
+		r, w, err := rr.ReadRune()
+		if err != nil {
 			return 0, 0, err
-		case r == '\n':
+		}
+		i += int64(w)
+		if r == '\n' {
 			l1++
 		}
 	}
@@ -437,6 +545,14 @@ func (e Substitute) String() string {
 	return e.Address.String() + "s" + n + "/" + Escape(e.Regexp, '/') + "/" + Escape(e.With, '/') + "/" + g
 }
 
+// Do performs the substitution in a single pass over the Address.
+//
+// Each substituted match is staged as its own change,
+// so text between the matches is left unchanged.
+// The number of staged changes, and any per-change state
+// kept by the Editor, grows with the number of matches.
+// A Buffer applies its staged changes in a single pass,
+// so the time per match does not grow with the number of matches.
 func (e Substitute) Do(ed Editor, _ io.Writer) error {
 	re, err := regexpCompile(e.Regexp)
 	if err != nil {
@@ -456,7 +572,16 @@ func (e Substitute) Do(ed Editor, _ io.Writer) error {
 			break
 		}
 		if m[0] == m[1] {
-			from++
+			// Advance past the rune following the empty match,
+			// or past the end of the Address if there is none.
+			_, w, err := ed.RuneReader(Span{int64(m[1]), s[1]}).ReadRune()
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if w == 0 {
+				w = 1
+			}
+			from = int64(m[1] + w)
 		} else {
 			from = int64(m[1])
 		}
@@ -467,50 +592,61 @@ func (e Substitute) Do(ed Editor, _ io.Writer) error {
 		}
 		prev = m
 		e.From--
-		if e.From <= 0 {
-			if err := regexpSub(re, m, e.With, ed); err != nil {
-				return nil
-			}
-			if !e.Global {
-				break
-			}
+		if e.From > 0 {
+			continue
+		}
+		repl, err := regexpExpand(re, m, e.With, ed)
+		if err != nil {
+			return err
+		}
+		dst := Span{int64(m[0]), int64(m[1])}
+		if _, err := ed.Change(dst, bytes.NewReader(repl)); err != nil {
+			return err
+		}
+		if !e.Global {
+			break
 		}
 	}
 	return ed.Apply()
 }
 
-func regexpSub(re *regexp.Regexp, match []int, with string, ed Editor) error {
-	dst := Span{int64(match[0]), int64(match[1])}
-	src, err := ioutil.ReadAll(ed.Reader(dst))
-	if err != nil {
-		return err
+// RegexpExpand returns the expansion of the template, with,
+// for a match of the regular expression.
+// The text of the match is only read
+// if the template refers to submatches.
+func regexpExpand(re *regexp.Regexp, match []int, with string, ed Editor) ([]byte, error) {
+	if !strings.ContainsRune(with, '$') {
+		return []byte(with), nil
 	}
-
+	var src []byte
 	matchSrc := make([]int, len(match))
-	var bi, ri int
+	rr := ed.RuneReader(Span{int64(match[0]), int64(match[1])})
+	var ri int
 	for {
 		for i := range match {
 			if match[i]-match[0] == ri {
-				matchSrc[i] = bi
+				matchSrc[i] = len(src)
 			}
 		}
-		if bi >= len(src) {
+		r, w, err := rr.ReadRune()
+		if err == io.EOF {
 			break
 		}
-		_, w := utf8.DecodeRune(src[bi:])
-		bi += w
-		ri++
+		if err != nil {
+			return nil, err
+		}
+		var b [utf8.UTFMax]byte
+		src = append(src, b[:utf8.EncodeRune(b[:], r)]...)
+		ri += w
 	}
-
-	repl := re.Expand(nil, []byte(with), src, matchSrc)
-	_, err = ed.Change(dst, bytes.NewReader(repl))
-	return err
+	return re.Expand(nil, []byte(with), src, matchSrc), nil
 }
 
 type loop struct {
 	Address
-	regexp string
-	body   Edit
+	regexp     string
+	body       Edit
+	complement bool
 }
 
 // Loop returns an Edit that performs another Edit, body,
@@ -527,8 +663,27 @@ func Loop(a Address, re string, body Edit) Edit {
 	return loop{Address: a, regexp: re, body: body}
 }
 
+// LoopComplement returns an Edit that performs another Edit, body,
+// for each string before, between, or after
+// the matches of a regular expression within an Address.
+// The body edit is executed with dot set to the corresponding string.
+// After all strings, dot is set to the last string;
+// if there were no matches then it is set to the Address.
+//
+// If the regexp is empty, ".*\n" is used.
+func LoopComplement(a Address, re string, body Edit) Edit {
+	if re == "" {
+		re = ".*\n"
+	}
+	return loop{Address: a, regexp: re, body: body, complement: true}
+}
+
 func (e loop) String() string {
-	return e.Address.String() + "x/" + Escape(e.regexp, '/') + "/" + e.body.String()
+	cmd := "x/"
+	if e.complement {
+		cmd = "y/"
+	}
+	return e.Address.String() + cmd + Escape(e.regexp, '/') + "/" + e.body.String()
 }
 
 type ignoreApply struct{ Editor }
@@ -547,6 +702,9 @@ func (e loop) Do(ed Editor, print io.Writer) error {
 
 	dot := s
 	var prev []int
+	// Op is the end of the previous match,
+	// the start of the next string between matches.
+	op := s[0]
 	from := s[0]
 	for from <= s[1] { // Allow one run on an empty input.
 		m := match(re, Span{from, s[1]}, ed)
@@ -565,7 +723,27 @@ func (e loop) Do(ed Editor, print io.Writer) error {
 		}
 		prev = m
 
-		dot = Span{int64(m[0]), int64(m[1])}
+		if e.complement {
+			if m[0] == m[1] && int64(m[0]) == op {
+				// Skip an empty match at the start of the string;
+				// there is nothing between it and the previous match.
+				continue
+			}
+			dot = Span{op, int64(m[0])}
+			op = int64(m[1])
+		} else {
+			dot = Span{int64(m[0]), int64(m[1])}
+		}
+		setDot(ed, dot)
+		if err := e.body.Do(ignoreApply{ed}, print); err != nil {
+			return err
+		}
+	}
+	if e.complement && from <= s[1] {
+		// The string following the last match.
+		// If an empty match consumed the end of the address,
+		// there is no such string.
+		dot = Span{op, s[1]}
 		setDot(ed, dot)
 		if err := e.body.Do(ignoreApply{ed}, print); err != nil {
 			return err
@@ -575,6 +753,56 @@ func (e loop) Do(ed Editor, print io.Writer) error {
 	return ed.Apply()
 }
 
+type guard struct {
+	Address
+	regexp string
+	body   Edit
+	not    bool
+}
+
+// Guard returns an Edit that performs another Edit, body,
+// only if the string at an Address contains a match of a regular expression.
+// If there is a match, the body edit is executed with dot set to the Address;
+// otherwise dot is unchanged.
+//
+// The beginning and end of the Address
+// are the beginning and end of text for the regexp match.
+func Guard(a Address, re string, body Edit) Edit {
+	return guard{Address: a, regexp: re, body: body}
+}
+
+// GuardNot returns an Edit like Guard,
+// but the body edit is performed only if
+// the string at the Address does not contain a match
+// of the regular expression.
+func GuardNot(a Address, re string, body Edit) Edit {
+	return guard{Address: a, regexp: re, body: body, not: true}
+}
+
+func (e guard) String() string {
+	cmd := "g/"
+	if e.not {
+		cmd = "v/"
+	}
+	return e.Address.String() + cmd + Escape(e.regexp, '/') + "/" + e.body.String()
+}
+
+func (e guard) Do(ed Editor, print io.Writer) error {
+	s, err := e.Address.Where(ed)
+	if err != nil {
+		return err
+	}
+	re, err := regexpCompile(e.regexp)
+	if err != nil {
+		return err
+	}
+	if m := match(re, s, ed); (len(m) >= 2) == e.not {
+		return nil
+	}
+	setDot(ed, s)
+	return e.body.Do(ed, print)
+}
+
 type pipe struct {
 	Address
 	cmd      string
@@ -595,6 +823,15 @@ type pipe struct {
 // The shell is either the value of
 // the SHELL environment variable
 // or DefaultShell if SHELL is unset.
+//
+// If the Editor is a Canceler,
+// the command is killed when its Context is done.
+// If the Editor is a Releaser, and the edit is not
+// within a loop or a block, the Editor is released
+// while the command runs. The command's output
+// then replaces the string, as adjusted for changes
+// made by other Editors, or if another Editor
+// changed the string, ErrConflict is returned.
 func Pipe(a Address, cmd string) Edit {
 	return pipe{Address: a, cmd: cmd, to: true, from: true}
 }
@@ -649,6 +886,10 @@ func shell() string {
 	return DefaultShell
 }
 
+// PipeWaitDelay is how long a killed command's output is read
+// before it is closed.
+const pipeWaitDelay = 100 * time.Millisecond
+
 func (e pipe) Do(ed Editor, print io.Writer) error {
 	s, err := e.Where(ed)
 	if err != nil {
@@ -656,17 +897,37 @@ func (e pipe) Do(ed Editor, print io.Writer) error {
 	}
 	setDot(ed, s)
 
-	cmd := exec.Command(shell(), "-c", e.cmd)
+	ctx := contextOf(ed)
+	cmd := exec.CommandContext(ctx, shell(), "-c", e.cmd)
 	cmd.Stderr = print
+	// The command's children may keep its output open after it is killed.
+	// WaitDelay requires Go 1.20.
+	cmd.WaitDelay = pipeWaitDelay
 
 	if e.to {
 		cmd.Stdin = ed.Reader(s)
 	}
 
+	if rel, ok := releaserOf(ed); ok {
+		if e.to {
+			// The text cannot be read while the Editor is released,
+			// so it is first copied to a buffer.
+			in, err := spool(cmd.Stdin)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			cmd.Stdin = runes.UTF8Reader(in.Reader(0))
+		}
+		if rel.Release() {
+			return e.doReleased(ctx, cmd, rel, print)
+		}
+	}
+
 	if !e.from {
 		cmd.Stdout = print
 		if err := cmd.Run(); err != nil {
-			return err
+			return cmdError(ctx, err)
 		}
 		return nil
 	}
@@ -676,11 +937,11 @@ func (e pipe) Do(ed Editor, print io.Writer) error {
 		return err
 	}
 	if err := cmd.Start(); err != nil {
-		return err
+		return cmdError(ctx, err)
 	}
 	_, changeErr := ed.Change(s, r)
 	if err = cmd.Wait(); err != nil {
-		return err
+		return cmdError(ctx, err)
 	}
 	if changeErr != nil {
 		return changeErr
@@ -688,6 +949,74 @@ func (e pipe) Do(ed Editor, print io.Writer) error {
 	return ed.Apply()
 }
 
+// DoReleased runs the command of the pipe
+// while the Releaser is released.
+// The output of the command is copied to a buffer,
+// and changes dot once the Releaser is reacquired.
+func (e pipe) doReleased(ctx context.Context, cmd *exec.Cmd, rel Releaser, print io.Writer) error {
+	var runErr error
+	var out *runes.Buffer
+	if !e.from {
+		cmd.Stdout = print
+		runErr = cmd.Run()
+	} else if out, runErr = spoolCmd(cmd); runErr == nil {
+		defer out.Close()
+	}
+	if err := rel.Acquire(); err != nil && (e.from || err != ErrConflict) {
+		return err
+	}
+	if runErr != nil {
+		return cmdError(ctx, runErr)
+	}
+	if !e.from {
+		return nil
+	}
+	if _, err := rel.Change(rel.Mark('.'), runes.UTF8Reader(out.Reader(0))); err != nil {
+		return err
+	}
+	return rel.Apply()
+}
+
+// SpoolCmd runs the command,
+// returning its standard output copied to a buffer.
+func spoolCmd(cmd *exec.Cmd) (*runes.Buffer, error) {
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	out, copyErr := spool(r)
+	if err := cmd.Wait(); err != nil {
+		if out != nil {
+			out.Close()
+		}
+		return nil, err
+	}
+	return out, copyErr
+}
+
+// Spool returns a buffer containing the UTF-8 text read from the reader.
+// Invalid UTF-8 is replaced with U+FFFD, as it is by Buffer.Change.
+func spool(r io.Reader) (*runes.Buffer, error) {
+	b := runes.NewBuffer(1 << 12)
+	if _, err := runes.Copy(b.Writer(0), runes.RunesReader(bufio.NewReader(r))); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// CmdError returns the error of the Context
+// if it ended the command, otherwise err.
+func cmdError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
 type undo int
 
 // Undo returns an Edit
@@ -746,6 +1075,198 @@ func (e redo) Do(ed Editor, _ io.Writer) error {
 	return nil
 }
 
+type undoLocal int
+
+// UndoLocal returns an Edit
+// that undoes the n most recent changes
+// made to the buffer by the Editor,
+// and sets dot to the address
+// covering the last undone change.
+// If n ≤ 0 then 1 change is undone.
+//
+// If the Editor is a LocalUndoer,
+// its UndoLocal method is used;
+// changes made by other Editors are not undone.
+// Otherwise, the Editor is assumed to be the only Editor of its text,
+// and UndoLocal is the same as Undo.
+func UndoLocal(n int) Edit { return undoLocal(n) }
+
+func (e undoLocal) String() string {
+	if e <= 0 {
+		return "U1"
+	}
+	return "U" + strconv.Itoa(int(e))
+}
+
+func (e undoLocal) Do(ed Editor, _ io.Writer) error {
+	if e <= 0 {
+		e = 1
+	}
+	undo := ed.Undo
+	if lu, ok := localUndoerOf(ed); ok {
+		undo = lu.UndoLocal
+	}
+	for i := 0; i < int(e); i++ {
+		if err := undo(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type redoLocal int
+
+// RedoLocal returns an Edit
+// that redoes the n most recent changes
+// undone by an UndoLocal edit,
+// and sets dot to the address
+// covering the last redone change.
+// If n ≤ 0 then 1 change is redone.
+//
+// If the Editor is a LocalUndoer,
+// its RedoLocal method is used.
+// Otherwise, the Editor is assumed to be the only Editor of its text,
+// and RedoLocal is the same as Redo.
+func RedoLocal(n int) Edit { return redoLocal(n) }
+
+func (e redoLocal) String() string {
+	if e <= 0 {
+		return "R1"
+	}
+	return "R" + strconv.Itoa(int(e))
+}
+
+func (e redoLocal) Do(ed Editor, _ io.Writer) error {
+	if e <= 0 {
+		e = 1
+	}
+	redo := ed.Redo
+	if lu, ok := localUndoerOf(ed); ok {
+		redo = lu.RedoLocal
+	}
+	for i := 0; i < int(e); i++ {
+		if err := redo(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContextOf returns the Context of the Canceler underlying an Editor,
+// or the background Context if there is none.
+// It looks through the wrappers used internally by this package.
+func contextOf(ed Editor) context.Context {
+	switch e := ed.(type) {
+	case Canceler:
+		if ctx := e.Context(); ctx != nil {
+			return ctx
+		}
+	case ignoreApply:
+		return contextOf(e.Editor)
+	case byteEditor:
+		return contextOf(e.Editor)
+	}
+	return context.Background()
+}
+
+// ReleaserOf returns the Releaser underlying an Editor, if any.
+// It looks through the byte offset wrapper,
+// but not through the wrapper of the edits of loops and blocks,
+// whose changes are applied together, after all of their edits.
+func releaserOf(ed Editor) (Releaser, bool) {
+	switch e := ed.(type) {
+	case Releaser:
+		return e, true
+	case byteEditor:
+		if rel, ok := releaserOf(e.Editor); ok {
+			return byteReleaser{byteEditor: e, rel: rel}, true
+		}
+	}
+	return nil, false
+}
+
+// LocalUndoerOf returns the LocalUndoer underlying an Editor, if any.
+// It looks through the wrappers used internally by this package.
+func localUndoerOf(ed Editor) (LocalUndoer, bool) {
+	switch e := ed.(type) {
+	case LocalUndoer:
+		return e, true
+	case ignoreApply:
+		return localUndoerOf(e.Editor)
+	case byteEditor:
+		return localUndoerOf(e.Editor)
+	}
+	return nil, false
+}
+
+type jump int
+
+// Jump returns an Edit
+// that changes the text to state n of the Editor's UndoTree,
+// and sets dot to the address covering the last change.
+//
+// It is an error if the Editor is not an UndoTree.
+func Jump(n int) Edit { return jump(n) }
+
+func (e jump) String() string { return "j" + strconv.Itoa(int(e)) }
+
+func (e jump) Do(ed Editor, _ io.Writer) error {
+	tree, ok := undoTreeOf(ed)
+	if !ok {
+		return errors.New("no undo tree")
+	}
+	return tree.SetState(int(e))
+}
+
+type jumpTime time.Duration
+
+// JumpTime returns an Edit
+// that changes the text to the most recent state of the Editor's UndoTree
+// created at or before the time of the current state plus d,
+// and sets dot to the address covering the last change.
+// A negative d jumps to an earlier state,
+// and a positive d jumps to a later state.
+//
+// It is an error if the Editor is not an UndoTree.
+func JumpTime(d time.Duration) Edit { return jumpTime(d) }
+
+func (e jumpTime) String() string {
+	if e < 0 {
+		return "j" + time.Duration(e).String()
+	}
+	return "j+" + time.Duration(e).String()
+}
+
+func (e jumpTime) Do(ed Editor, _ io.Writer) error {
+	tree, ok := undoTreeOf(ed)
+	if !ok {
+		return errors.New("no undo tree")
+	}
+	t, err := tree.StateTime(tree.State())
+	if err != nil {
+		return err
+	}
+	n, err := tree.StateAt(t.Add(time.Duration(e)))
+	if err != nil {
+		return err
+	}
+	return tree.SetState(n)
+}
+
+// UndoTreeOf returns the UndoTree underlying an Editor, if any.
+// It looks through the wrappers used internally by this package.
+func undoTreeOf(ed Editor) (UndoTree, bool) {
+	switch e := ed.(type) {
+	case UndoTree:
+		return e, true
+	case ignoreApply:
+		return undoTreeOf(e.Editor)
+	case byteEditor:
+		return undoTreeOf(e.Editor)
+	}
+	return nil, false
+}
+
 type block struct {
 	Address
 	body []Edit
@@ -861,6 +1382,29 @@ func (e block) Do(ed Editor, print io.Writer) error {
 // 		After all matches, dot is set to the last match;
 // 		if there were no matches then it is set to the Address.
 //
+// 	[addr] y/regexp/edit
+// 		Like x, but executes the edit for each string
+// 		before, between, or after the matches of regexp
+// 		within the Address.
+// 		The edit is executed with dot set to the string.
+//
+//		If an address is not supplied, dot is used.
+// 		After all strings, dot is set to the last string;
+// 		if there were no matches then it is set to the Address.
+//
+// 	[addr] g/regexp/edit
+// 	[addr] v/regexp/edit
+// 		g executes the edit if the Address contains a match of regexp,
+// 		and v executes the edit if it does not.
+// 		The edit is executed with dot set to the Address.
+//
+// 		The regexp uses the same syntax as described for substitute.
+// 		The beginning and end of the Address
+// 		are the beginning and end of text for the regexp match.
+//
+//		If an address is not supplied, dot is used.
+// 		If the edit is not executed, dot is unchanged.
+//
 //	[addr] k [name]
 //		Sets the named mark to the address.
 //		If an address is not supplied, dot is used.
@@ -868,6 +1412,20 @@ func (e block) Do(ed Editor, print io.Writer) error {
 // 		If name is not supplied or is the rune . then dot is set.
 //		Regardless of which mark is set,
 // 		dot is also set to the address.
+//	[addr] h [name]
+//		Holds a copy of the addressed text in the named register.
+//		If an address is not supplied, dot is used.
+//		The name is any non-whitespace rune.
+// 		If name is not supplied, the register named . is used.
+//		Dot is set to the address.
+//	[addr] l [name]
+//		Loads the text of the named register,
+//		changing the addressed text to it.
+//		If an address is not supplied, dot is used.
+//		The name is any non-whitespace rune.
+// 		If name is not supplied, the register named . is used.
+//		If the register was never set, the addressed text is deleted.
+//		Dot is set to the address.
 //	[addr] p
 //		Returns the runes identified by the address.
 //		If an address is not supplied, dot is used.
@@ -908,6 +1466,37 @@ func (e block) Do(ed Editor, print io.Writer) error {
 //		If n is not specified, it defaults to 1.
 //		Dot is set to the address covering
 // 		the last redone change.
+//	U[n]
+//		Undoes the n most recent changes
+// 		made to the buffer by the Editor.
+//		Changes made by other Editors are not undone.
+//		It is an error if the text changed by a change
+//		was since changed by another Editor.
+//		If n is not specified, it defaults to 1.
+//		Dot is set to the address covering
+// 		the last undone change.
+//	R[n]
+//		Redoes the n most recent changes
+//		undone by U with the Editor.
+//		It is an error if the text changed by a change
+//		was since changed by another Editor.
+//		If n is not specified, it defaults to 1.
+//		Dot is set to the address covering
+// 		the last redone change.
+//	jn
+//		Changes the text to state n of the undo tree.
+//		Every change creates a new state,
+//		numbered in the order that they were created.
+//		State 0 is the initial state.
+//		Dot is set to the address covering the last change.
+//	j+d
+//	j-d
+//		Changes the text to the most recent state of the undo tree
+//		created at or before the time of the current state
+//		plus or minus the duration d.
+//		The duration is given in the syntax of time.ParseDuration.
+//		For example, j-10m changes the text to its state 10 minutes earlier.
+//		Dot is set to the address covering the last change.
 //
 // 	[addr] {
 // 		edit
@@ -924,8 +1513,12 @@ func (e block) Do(ed Editor, print io.Writer) error {
 //
 // 		If EOF is encountered before }, the block is closed at EOF.
 // 		An empty group performs no edits and simply sets dot.
-func Ed(rs io.RuneScanner) (Edit, error) {
-	a, err := Addr(rs)
+//
+// If the edit is malformed, a *ParseError is returned.
+func Ed(rs io.RuneScanner) (Edit, error) { return parseEd(newScanner(rs)) }
+
+func parseEd(rs *scanner) (Edit, error) {
+	a, err := parseAddr(rs)
 	switch {
 	case err != nil:
 		return nil, err
@@ -947,6 +1540,20 @@ func Ed(rs io.RuneScanner) (Edit, error) {
 				return nil, err
 			}
 			return Redo(n), nil
+		case r == 'U':
+			n, err := parseNumber(rs)
+			if err != nil {
+				return nil, err
+			}
+			return UndoLocal(n), nil
+		case r == 'R':
+			n, err := parseNumber(rs)
+			if err != nil {
+				return nil, err
+			}
+			return RedoLocal(n), nil
+		case r == 'j':
+			return parseJump(rs)
 		default:
 			if err := rs.UnreadRune(); err != nil {
 				return nil, err
@@ -985,6 +1592,15 @@ func Ed(rs io.RuneScanner) (Edit, error) {
 			return nil, err
 		}
 		return Set(a, m), nil
+	case r == 'h' || r == 'l':
+		reg, err := parseMarkRune(rs)
+		if err != nil {
+			return nil, err
+		}
+		if r == 'h' {
+			return Yank(a, reg), nil
+		}
+		return Put(a, reg), nil
 	case r == 'p':
 		return Print(a), nil
 	case r == '=':
@@ -1027,13 +1643,10 @@ func Ed(rs io.RuneScanner) (Edit, error) {
 		case delim == '\n':
 			return Sub(a, "", ""), rs.UnreadRune()
 		}
-		re, err := parseDelimited(delim, rs)
+		re, err := parseRegexp(delim, rs)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := regexpCompile(re); err != nil {
-			return nil, err
-		}
 		with, err := parseDelimited(delim, rs)
 		if err != nil {
 			return nil, err
@@ -1052,7 +1665,11 @@ func Ed(rs io.RuneScanner) (Edit, error) {
 			}
 		}
 		return sub, nil
-	case r == 'x':
+	case r == 'x' || r == 'y':
+		newLoop := Loop
+		if r == 'y' {
+			newLoop = LoopComplement
+		}
 		if err := skipSpace(rs); err != nil {
 			return nil, err
 		}
@@ -1061,22 +1678,45 @@ func Ed(rs io.RuneScanner) (Edit, error) {
 		case err != nil && err != io.EOF:
 			return nil, err
 		case err == io.EOF:
-			return Loop(a, "", Set(Dot, '.')), nil
+			return newLoop(a, "", Set(Dot, '.')), nil
 		case delim == '\n':
-			return Loop(a, "", Set(Dot, '.')), rs.UnreadRune()
+			return newLoop(a, "", Set(Dot, '.')), rs.UnreadRune()
 		}
-		re, err := parseDelimited(delim, rs)
+		re, err := parseRegexp(delim, rs)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := regexpCompile(re); err != nil {
+		edit, err := parseEd(rs)
+		if err != nil {
 			return nil, err
 		}
-		edit, err := Ed(rs)
+		return newLoop(a, re, edit), nil
+	case r == 'g' || r == 'v':
+		newGuard := Guard
+		if r == 'v' {
+			newGuard = GuardNot
+		}
+		if err := skipSpace(rs); err != nil {
+			return nil, err
+		}
+		delim, _, err := rs.ReadRune()
+		switch {
+		case err != nil && err != io.EOF:
+			return nil, err
+		case err == io.EOF:
+			return newGuard(a, "", Set(Dot, '.')), nil
+		case delim == '\n':
+			return newGuard(a, "", Set(Dot, '.')), rs.UnreadRune()
+		}
+		re, err := parseRegexp(delim, rs)
 		if err != nil {
 			return nil, err
 		}
-		return Loop(a, re, edit), nil
+		edit, err := parseEd(rs)
+		if err != nil {
+			return nil, err
+		}
+		return newGuard(a, re, edit), nil
 	case r == '|' || r == '>' || r == '<':
 		c, err := parseCmd(rs)
 		if err != nil {
@@ -1104,7 +1744,7 @@ func Ed(rs io.RuneScanner) (Edit, error) {
 				if err := rs.UnreadRune(); err != nil {
 					return nil, err
 				}
-				b, err := Ed(rs)
+				b, err := parseEd(rs)
 				if err != nil {
 					return nil, err
 				}
@@ -1112,12 +1752,17 @@ func Ed(rs io.RuneScanner) (Edit, error) {
 			}
 		}
 	default:
-		return nil, errors.New("unknown command: " + string(r))
+		return nil, &ParseError{
+			Offset:   rs.offs - 1, // r was already read.
+			Token:    string(r),
+			Expected: "command",
+			Err:      errors.New("unknown command: " + string(r)),
+		}
 	}
 }
 
-func parseAddrOrDot(rs io.RuneScanner) (Address, error) {
-	switch a, err := Addr(rs); {
+func parseAddrOrDot(rs *scanner) (Address, error) {
+	switch a, err := parseAddr(rs); {
 	// parseCompoundAddr returns never returns io.EOF, but nil, nil.
 	case err != nil:
 		return nil, err
@@ -1248,13 +1893,52 @@ func parseMarkRune(rs io.RuneScanner) (rune, error) {
 	}
 }
 
+// ParseJump parses the state number or duration of a jump edit.
+func parseJump(rs *scanner) (Edit, error) {
+	if err := skipSpace(rs); err != nil {
+		return nil, err
+	}
+	offs := rs.offs
+	var s []rune
+	for {
+		r, _, err := rs.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !unicode.IsDigit(r) && !unicode.IsLetter(r) && r != '.' &&
+			!(len(s) == 0 && (r == '+' || r == '-')) {
+			if err := rs.UnreadRune(); err != nil {
+				return nil, err
+			}
+			break
+		}
+		s = append(s, r)
+	}
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		d, err := time.ParseDuration(string(s))
+		if err != nil {
+			return nil, &ParseError{Offset: offs, Token: string(s), Expected: "duration", Err: err}
+		}
+		return JumpTime(d), nil
+	}
+	n, err := strconv.Atoi(string(s))
+	if err != nil {
+		return nil, &ParseError{Offset: offs, Token: string(s), Expected: "state number or duration", Err: err}
+	}
+	return Jump(n), nil
+}
+
 // ParseNumber parses and returns a positive integer.
 // Leading spaces are ignored.
 // If EOF is reached before any digits are encountered, 1 is returned.
-func parseNumber(rs io.RuneScanner) (int, error) {
+func parseNumber(rs *scanner) (int, error) {
 	if err := skipSpace(rs); err != nil {
 		return 0, err
 	}
+	offs := rs.offs
 	var s []rune
 	for {
 		switch r, _, err := rs.ReadRune(); {
@@ -1274,7 +1958,11 @@ func parseNumber(rs io.RuneScanner) (int, error) {
 		if len(s) == 0 {
 			return 1, nil
 		}
-		return strconv.Atoi(string(s))
+		n, err := strconv.Atoi(string(s))
+		if err != nil {
+			return 0, &ParseError{Offset: offs, Token: string(s), Expected: "number", Err: err}
+		}
+		return n, nil
 	}
 }
 
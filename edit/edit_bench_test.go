@@ -0,0 +1,41 @@
+// Copyright © 2016, The T Authors.
+
+package edit
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// benchmarkSubGlobal benchmarks a global substitution
+// with a number of matches proportional to the size of the buffer.
+// The throughput and the reported ns/match should be independent of the size
+// if the cost of each substituted match does not grow with the number of matches.
+func benchmarkSubGlobal(b *testing.B, n int) {
+	buf, _, _ := makeEditor(n)
+	defer buf.Close()
+	matches := len(regexp.MustCompile("[0-9]+").FindAllStringIndex(buf.String(), -1))
+	sub := SubGlobal(All, "[0-9]+", "<$0>")
+	var elapsed time.Duration
+	b.ResetTimer()
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		if err := sub.Do(buf, nil); err != nil {
+			b.Fatal(err.Error())
+		}
+		elapsed += time.Since(start)
+		b.StopTimer()
+		if err := buf.Undo(); err != nil {
+			b.Fatal(err.Error())
+		}
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N*matches), "ns/match")
+}
+
+func BenchmarkSubGlobalx1K(b *testing.B)  { benchmarkSubGlobal(b, 1<<10) }
+func BenchmarkSubGlobalx32K(b *testing.B) { benchmarkSubGlobal(b, 32<<10) }
+func BenchmarkSubGlobalx1M(b *testing.B)  { benchmarkSubGlobal(b, 1<<20) }
+func BenchmarkSubGlobalx32M(b *testing.B) { benchmarkSubGlobal(b, 32<<20) }
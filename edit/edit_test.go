@@ -4,6 +4,8 @@ package edit
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/eaburns/T/edit/edittest"
 )
@@ -81,6 +84,23 @@ func TestEd(t *testing.T) {
 		{str: "#0k a", edit: Set(Rune(0), 'a')},
 		{str: "#0k	 a", edit: Set(Rune(0), 'a')},
 		{str: "#0k	 α", edit: Set(Rune(0), 'α')},
+		// Newlines are skipped before the mark name,
+		// and the name need not be valid UTF-8.
+		{str: "k\nd", edit: Set(Dot, 'd')},
+		{str: "k\xff", edit: Set(Dot, '\uFFFD')},
+
+		{str: "h", edit: Yank(Dot, '.')},
+		{str: " h ", edit: Yank(Dot, '.')},
+		{str: "#0ha", edit: Yank(Rune(0), 'a')},
+		{str: "#0h a", edit: Yank(Rune(0), 'a')},
+		{str: "#0h	 α", edit: Yank(Rune(0), 'α')},
+		{str: "l", edit: Put(Dot, '.')},
+		{str: " l ", edit: Put(Dot, '.')},
+		{str: "#0la", edit: Put(Rune(0), 'a')},
+		{str: "#0l a", edit: Put(Rune(0), 'a')},
+		{str: "#0l	 α", edit: Put(Rune(0), 'α')},
+		{str: "h\nd", edit: Yank(Dot, 'd')},
+		{str: "l \xff", edit: Put(Dot, '\uFFFD')},
 
 		{str: "c/αβξ", edit: Change(Dot, "αβξ")},
 		{str: "c   /αβξ", edit: Change(Dot, "αβξ")},
@@ -99,6 +119,12 @@ func TestEd(t *testing.T) {
 		{str: "c\nαβξ\n\n.", edit: Change(Dot, "αβξ\n\n")},
 		{str: "c\nαβξ\nabc\n.", edit: Change(Dot, "αβξ\nabc\n")},
 		{str: "c \n", edit: Change(Dot, "")},
+		// Lines of text may be terminated by the end of input,
+		// and any rune, even a letter, can be the delimiter.
+		{str: "c\nαβξ", edit: Change(Dot, "αβξ")},
+		{str: "c\nαβξ\n", edit: Change(Dot, "αβξ\n")},
+		{str: "cαβξ", edit: Change(Dot, "βξ")},
+		{str: "c1a1", edit: Change(Dot, "a")},
 		{str: `c/\n`, edit: Change(Dot, "\n")},
 		{str: `c/\\n`, edit: Change(Dot, `\n`)},
 		{str: `c/\/`, edit: Change(Dot, `/`)},
@@ -209,8 +235,12 @@ func TestEd(t *testing.T) {
 		{str: "s/\n/b", left: "\n/b", edit: Sub(Dot, "", "")},
 		{str: "s" + strconv.FormatInt(math.MaxInt64, 10) + "0" + "/a/b/g", error: "value out of range"},
 		{str: "s/*", error: "missing"},
+		{str: "sa/b/", edit: Sub(Dot, "/b/", "")},
+		{str: "sa/ab/", edit: Sub(Dot, "/", "b/")},
+		{str: "s2a/b/", edit: Substitute{Address: Dot, Regexp: "/b/", From: 2}},
 
 		{str: "x/*", error: "missing"},
+		{str: "x abc/d", edit: Loop(Dot, "bc/d", Set(Dot, '.'))},
 		{str: ",x\n", left: "\n", edit: Loop(All, ".*\n", Set(Dot, '.'))},
 		{str: ",x/abc/.d", edit: Loop(All, "abc", Delete(Dot))},
 		{str: ",x//.d", edit: Loop(All, ".*\n", Delete(Dot))},
@@ -226,6 +256,32 @@ func TestEd(t *testing.T) {
 		{str: "x//", edit: Loop(Dot, "", Set(Dot, '.'))},
 		{str: "x//\nd", left: "\nd", edit: Loop(Dot, "", Set(Dot, '.'))},
 
+		{str: "y/*", error: "missing"},
+		{str: ",y\n", left: "\n", edit: LoopComplement(All, ".*\n", Set(Dot, '.'))},
+		{str: ",y/,/.d", edit: LoopComplement(All, ",", Delete(Dot))},
+		{str: ",y/,/c/x", edit: LoopComplement(All, ",", Change(Dot, "x"))},
+		{str: `,x/.*\n/y/,/d`, edit: Loop(All, ".*\n", LoopComplement(Dot, ",", Delete(Dot)))},
+		{str: "y /,/d", edit: LoopComplement(Dot, ",", Delete(Dot))},
+		{str: "y", edit: LoopComplement(Dot, "", Set(Dot, '.'))},
+		{str: "y//", edit: LoopComplement(Dot, "", Set(Dot, '.'))},
+		{str: "y//\nd", left: "\nd", edit: LoopComplement(Dot, "", Set(Dot, '.'))},
+
+		{str: "g/*", error: "missing"},
+		{str: "g1/d", edit: Guard(Dot, "/d", Set(Dot, '.'))},
+		{str: "g/abc/d", edit: Guard(Dot, "abc", Delete(Dot))},
+		{str: "g /abc/d", edit: Guard(Dot, "abc", Delete(Dot))},
+		{str: ",g/abc/s/b/B", edit: Guard(All, "abc", Sub(Dot, "b", "B"))},
+		{str: `,x/.*\n/g/TODO/d`, edit: Loop(All, ".*\n", Guard(Dot, "TODO", Delete(Dot)))},
+		{str: "g", edit: Guard(Dot, "", Set(Dot, '.'))},
+		{str: "g//", edit: Guard(Dot, "", Set(Dot, '.'))},
+		{str: "g//\nd", left: "\nd", edit: Guard(Dot, "", Set(Dot, '.'))},
+		{str: "v/*", error: "missing"},
+		{str: "v/abc/d", edit: GuardNot(Dot, "abc", Delete(Dot))},
+		{str: ",v/abc/s/b/B", edit: GuardNot(All, "abc", Sub(Dot, "b", "B"))},
+		{str: `,x/.*\n/v/TODO/d`, edit: Loop(All, ".*\n", GuardNot(Dot, "TODO", Delete(Dot)))},
+		{str: "v", edit: GuardNot(Dot, "", Set(Dot, '.'))},
+		{str: "v//\nd", left: "\nd", edit: GuardNot(Dot, "", Set(Dot, '.'))},
+
 		{str: "|cmd", edit: Pipe(Dot, "cmd")},
 		{str: "|	   cmd", edit: Pipe(Dot, "cmd")},
 		{str: "|cmd\nleft", left: "\nleft", edit: Pipe(Dot, "cmd")},
@@ -282,6 +338,23 @@ func TestEd(t *testing.T) {
 		{str: "r100", edit: Redo(100)},
 		{str: " r100", edit: Redo(100)},
 		{str: "r" + strconv.FormatInt(math.MaxInt64, 10) + "0", error: "value out of range"},
+		{str: "U", edit: UndoLocal(1)},
+		{str: " U", edit: UndoLocal(1)},
+		{str: "U1", edit: UndoLocal(1)},
+		{str: "U100", edit: UndoLocal(100)},
+		{str: "R", edit: RedoLocal(1)},
+		{str: " R", edit: RedoLocal(1)},
+		{str: "R1", edit: RedoLocal(1)},
+		{str: "R100", edit: RedoLocal(100)},
+		{str: "j0", edit: Jump(0)},
+		{str: " j 12", edit: Jump(12)},
+		{str: "j12\nj0", left: "\nj0", edit: Jump(12)},
+		{str: "j-10s", edit: JumpTime(-10 * time.Second)},
+		{str: "j+1h30m", edit: JumpTime(90 * time.Minute)},
+		{str: "j", error: "invalid syntax"},
+		{str: "j12x", error: "invalid syntax"},
+		{str: "j-10", error: "missing unit"},
+		{str: "j+", error: "invalid duration"},
 
 		{str: "{bad edit}", error: "unknown"},
 		{str: "{}", edit: Block(Dot)},
@@ -353,6 +426,60 @@ func TestEd(t *testing.T) {
 	}
 }
 
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		str      string
+		offs     int64
+		token    string
+		expected string
+	}{
+		{str: "z", offs: 0, token: "z", expected: "command"},
+		{str: "#0 z", offs: 3, token: "z", expected: "command"},
+		{str: "αβ", offs: 0, token: "α", expected: "command"},
+		{str: "/α/+/β/ ☺", offs: 8, token: "☺", expected: "command"},
+		{str: "/*", offs: 1, token: "*", expected: "regular expression"},
+		{str: "#1,/α*/+/**/", offs: 9, token: "**", expected: "regular expression"},
+		{str: "s/*/x/", offs: 2, token: "*", expected: "regular expression"},
+		{str: `,x/.*\n/y/*/d`, offs: 10, token: "*", expected: "regular expression"},
+		{str: `,x/.*\n/g/*/d`, offs: 10, token: "*", expected: "regular expression"},
+		{str: "j", offs: 1, token: "", expected: "state number or duration"},
+		{str: "j 12x", offs: 2, token: "12x", expected: "state number or duration"},
+		{str: "j+", offs: 1, token: "+", expected: "duration"},
+		{str: "j -10", offs: 2, token: "-10", expected: "duration"},
+		{str: "{\n.d\n  z\n}", offs: 7, token: "z", expected: "command"},
+		{
+			str:      "#" + strconv.FormatInt(math.MaxInt64, 10) + "0",
+			offs:     1,
+			token:    strconv.FormatInt(math.MaxInt64, 10) + "0",
+			expected: "number",
+		},
+		{
+			str:      "1," + strconv.FormatInt(math.MaxInt64, 10) + "0",
+			offs:     2,
+			token:    strconv.FormatInt(math.MaxInt64, 10) + "0",
+			expected: "number",
+		},
+		{
+			str:      "u " + strconv.FormatInt(math.MaxInt64, 10) + "0",
+			offs:     2,
+			token:    strconv.FormatInt(math.MaxInt64, 10) + "0",
+			expected: "number",
+		},
+	}
+	for _, test := range tests {
+		_, err := Ed(strings.NewReader(test.str))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Ed(%q)=_,%v, want *ParseError", test.str, err)
+			continue
+		}
+		if perr.Offset != test.offs || perr.Token != test.token || perr.Expected != test.expected {
+			t.Errorf("Ed(%q)=_,%#v, want Offset=%d, Token=%q, Expected=%q",
+				test.str, perr, test.offs, test.token, test.expected)
+		}
+	}
+}
+
 func TestEditString(t *testing.T) {
 	tests := []struct {
 		edit Edit
@@ -417,6 +544,14 @@ func TestEditString(t *testing.T) {
 		{PipeFrom(Regexp("a*"), "cat"), "/a*/<cat\n"},
 		{PipeFrom(Regexp("/*"), "cat"), "/\\/*/<cat\n"},
 
+		{Yank(All, 'a'), `0,$ha`},
+		{Yank(Dot, ' '), `.h.`},
+		{Yank(Regexp("/*"), 'α'), `/\/*/hα`},
+
+		{Put(All, 'a'), `0,$la`},
+		{Put(Dot, ' '), `.l.`},
+		{Put(Regexp("/*"), 'α'), `/\/*/lα`},
+
 		{Print(All), `0,$p`},
 		{Print(Dot), `.p`},
 		{Print(Regexp("a*")), `/a*/p`},
@@ -441,6 +576,19 @@ func TestEditString(t *testing.T) {
 		{Redo(2), "r2"},
 		{Redo(0), "r1"},
 		{Redo(-4), "r1"},
+		{UndoLocal(1), "U1"},
+		{UndoLocal(2), "U2"},
+		{UndoLocal(0), "U1"},
+		{UndoLocal(-4), "U1"},
+		{RedoLocal(1), "R1"},
+		{RedoLocal(2), "R2"},
+		{RedoLocal(0), "R1"},
+		{RedoLocal(-4), "R1"},
+		{Jump(0), "j0"},
+		{Jump(12), "j12"},
+		{JumpTime(-10 * time.Second), "j-10s"},
+		{JumpTime(90 * time.Minute), "j+1h30m0s"},
+		{JumpTime(0), "j+0s"},
 
 		{Sub(All, "a*", "b"), `0,$s/a*/b/`},
 		{Sub(All, "/*", "b"), `0,$s/\/*/b/`},
@@ -466,6 +614,21 @@ func TestEditString(t *testing.T) {
 			Loop(All, "[a-zA-Z]*", Loop(Dot, "[a-z]*", Loop(Dot, "[abc]", Delete(Dot)))),
 			`0,$x/[a-zA-Z]*/.x/[a-z]*/.x/[abc]/.d`,
 		},
+
+		{LoopComplement(All, `,`, Delete(Dot)), `0,$y/,/.d`},
+		{LoopComplement(All, `/`, Change(Dot, "x")), `0,$y/\//.c/x/`},
+		{
+			Loop(All, ".*\n", LoopComplement(Dot, ",", Delete(Dot))),
+			`0,$x/.*\n/.y/,/.d`,
+		},
+
+		{Guard(All, `\w*`, Delete(Dot)), `0,$g/\\w*/.d`},
+		{Guard(All, `/`, Delete(Dot)), `0,$g/\//.d`},
+		{GuardNot(All, `\w*`, Delete(Dot)), `0,$v/\\w*/.d`},
+		{
+			Loop(All, ".*\n", Guard(Dot, "TODO", Delete(Dot))),
+			`0,$x/.*\n/.g/TODO/.d`,
+		},
 	}
 	for _, test := range tests {
 		if s := test.edit.String(); s != test.str {
@@ -975,6 +1138,110 @@ func TestEditSetFromString(t *testing.T) {
 	}
 }
 
+var registerTests = []editTest{
+	{
+		name:  "yank out of range",
+		do:    []Edit{Yank(Rune(1), 'a')},
+		error: "out of range",
+	},
+	{
+		name:  "put out of range",
+		do:    []Edit{Put(Rune(1), 'a')},
+		error: "out of range",
+	},
+	{
+		name:  "yank sets dot",
+		given: "{..}abc123xyz",
+		do:    []Edit{Yank(Regexp("123"), 'a')},
+		want:  "abc{.}123{.}xyz",
+	},
+	{
+		name:  "put unset register deletes",
+		given: "{..}abc123xyz",
+		do:    []Edit{Put(Regexp("123"), 'a')},
+		want:  "abc{..}xyz",
+	},
+	{
+		name:  "yank and put",
+		given: "{..}abc123xyz",
+		do:    []Edit{Yank(Regexp("123"), 'a'), Put(Rune(0), 'a')},
+		want:  "{.}123{.}abc123xyz",
+	},
+	{
+		name:  "put changes address",
+		given: "{..}abc123xyz",
+		do:    []Edit{Yank(Regexp("123"), 'a'), Put(Regexp("xyz"), 'a')},
+		want:  "abc123{.}123{.}",
+	},
+	{
+		name:  "put twice",
+		given: "{..}abc",
+		do:    []Edit{Yank(Regexp("b"), 'a'), Put(Rune(0), 'a'), Put(End, 'a')},
+		want:  "babc{.}b{.}",
+	},
+	{
+		name:  "multi-byte",
+		given: "{..}αβξ\n☺☹\n",
+		do:    []Edit{Yank(Line(2), 'α'), Put(Line(1), 'α')},
+		want:  "{.}☺☹\n{.}☺☹\n",
+	},
+	{
+		name:  "named registers",
+		given: "{..}abc",
+		do: []Edit{
+			Yank(Regexp("a"), 'a'),
+			Yank(Regexp("b"), 'b'),
+			Put(Regexp("c"), 'a'),
+			Put(Rune(0), 'b'),
+		},
+		want: "{.}b{.}aba",
+	},
+	{
+		name:  "space register is dot register",
+		given: "{..}abc",
+		do:    []Edit{Yank(Regexp("b"), ' '), Put(End, '.')},
+		want:  "abc{.}b{.}",
+	},
+	{
+		name:  "yank empty",
+		given: "{..}abc",
+		do:    []Edit{Yank(Regexp("b"), 'a'), Yank(Rune(1), 'a'), Put(Regexp("c"), 'a')},
+		want:  "ab{..}",
+	},
+	{
+		name:  "loop",
+		given: "{..}a1b2c3",
+		do:    []Edit{Yank(Regexp("a"), 'a'), Loop(All, "[0-9]", Put(Dot, 'a'))},
+		want:  "aabac{.}a{.}",
+	},
+}
+
+func TestEditRegister(t *testing.T) {
+	for _, test := range registerTests {
+		// The unindexed Editor of run is not a Registerer.
+		test.runEditor(t, func(buf *Buffer) Editor { return buf })
+		test.runEditor(t, func(buf *Buffer) Editor { return Bytes(buf) })
+	}
+}
+
+func TestEditRegister_NotRegisterer(t *testing.T) {
+	buf := newTestBuffer("abc{..}")
+	defer buf.Close()
+	for _, e := range []Edit{Yank(All, 'a'), Put(All, 'a')} {
+		if err := e.Do(unindexed{buf}, ioutil.Discard); err == nil {
+			t.Errorf("%v.Do(unindexed)=nil, want error", e)
+		}
+	}
+}
+
+func TestEditRegisterFromString(t *testing.T) {
+	for _, test := range registerTests {
+		if test, ok := test.fromString(t); ok {
+			test.runEditor(t, func(buf *Buffer) Editor { return buf })
+		}
+	}
+}
+
 var printTests = []editTest{
 	{
 		name:  "out of range",
@@ -1226,6 +1493,12 @@ var substituteTests = []editTest{
 		do:    []Edit{SubGlobal(All, "a", "x")},
 		want:  "{.}xbxcx{.}",
 	},
+	{
+		name:  "global marks between matches",
+		given: "{..}a foo {m}b{m} foo c",
+		do:    []Edit{SubGlobal(All, "foo", "bar")},
+		want:  "{.}a bar {m}b{m} bar c{.}",
+	},
 	{
 		name:  "restricted to address",
 		given: "a{.}a{.}a",
@@ -1557,6 +1830,176 @@ func TestEditLoopFromString(t *testing.T) {
 	}
 }
 
+var loopComplementTests = []editTest{
+	{
+		name:  "bad regexp",
+		do:    []Edit{LoopComplement(All, "*", Delete(Dot))},
+		error: "missing",
+	},
+	{
+		name:  "empty buffer",
+		given: "{..}",
+		do:    []Edit{LoopComplement(All, ",", Append(Dot, "abc"))},
+		want:  "{.}abc{.}",
+	},
+	{
+		name:  "no matches",
+		given: "{..}abc",
+		do:    []Edit{LoopComplement(All, ",", Change(Dot, "xyz"))},
+		want:  "{.}xyz{.}",
+	},
+	{
+		name:  "fields",
+		given: "{..}abc,def,ghi",
+		do:    []Edit{LoopComplement(All, ",", Change(Dot, "_"))},
+		want:  "_,_,{.}_{.}",
+	},
+	{
+		name:  "empty fields",
+		given: "{..},abc,,def,",
+		do:    []Edit{LoopComplement(All, ",", Change(Dot, "_"))},
+		want:  "_,_,_,_,{.}_{.}",
+	},
+	{
+		name:  "loop where",
+		given: "{..}abc<abc>abc<abcXYZabc>xyz",
+		do:    []Edit{LoopComplement(All, `<[^>]*>`, Where(Dot))},
+		want:  "abc<abc>abc<abcXYZabc>{.}xyz{.}",
+		print: "#0,#3\n#8,#11\n#22,#25\n",
+	},
+	{
+		name:  "loop print",
+		given: "{..}abc<abc>abc<abcXYZabc>xyz",
+		do:    []Edit{LoopComplement(All, `<[^>]*>`, Print(Dot))},
+		want:  "abc<abc>abc<abcXYZabc>{.}xyz{.}",
+		print: "abcabcxyz",
+	},
+	{
+		name:  "loop subst",
+		given: "{..}abc<abc>abc<abcXYZabc>abc",
+		do:    []Edit{LoopComplement(All, `<[^>]*>`, SubGlobal(Dot, "b", "_"))},
+		want:  "a_c<abc>a_c<abcXYZabc>{.}a_c{.}",
+	},
+	{
+		name:  "loop x loop",
+		given: "{..}a,b,c\nd,e\n",
+		do:    []Edit{Loop(All, "[^\n]+", LoopComplement(Dot, ",", Change(Dot, "_")))},
+		want:  "_,_,_\n{.}_,_{.}\n",
+	},
+	{
+		name:  "loop address not all",
+		given: "{..}abc<123>___1,2,3___<123>abc",
+		do:    []Edit{LoopComplement(Regexp("___").Then(Regexp("___")), `[_,]`, Delete(Dot))},
+		want:  "abc<123>___,,___{..}<123>abc",
+	},
+	{
+		name:  "empty matches",
+		given: "{..}abc",
+		do:    []Edit{LoopComplement(All, `x*`, Change(Dot, "."))},
+		want:  "..{.}.{.}",
+	},
+}
+
+func TestEditLoopComplement(t *testing.T) {
+	for _, test := range loopComplementTests {
+		test.run(t)
+	}
+}
+
+func TestEditLoopComplementFromString(t *testing.T) {
+	for _, test := range loopComplementTests {
+		test.runFromString(t)
+	}
+}
+
+var guardTests = []editTest{
+	{
+		name:  "bad regexp",
+		do:    []Edit{Guard(All, "*", Delete(Dot))},
+		error: "missing",
+	},
+	{
+		name:  "out of range",
+		do:    []Edit{Guard(Rune(1), "abc", Delete(Dot))},
+		error: "out of range",
+	},
+	{
+		name:  "match",
+		given: "{..}abc TODO xyz",
+		do:    []Edit{Guard(All, "TODO", Change(Dot, "done"))},
+		want:  "{.}done{.}",
+	},
+	{
+		name:  "no match",
+		given: "a{..}bc xyz",
+		do:    []Edit{Guard(All, "TODO", Change(Dot, "done"))},
+		want:  "a{..}bc xyz",
+	},
+	{
+		name:  "not match",
+		given: "{..}abc TODO xyz",
+		do:    []Edit{GuardNot(All, "TODO", Change(Dot, "done"))},
+		want:  "{..}abc TODO xyz",
+	},
+	{
+		name:  "not no match",
+		given: "a{..}bc xyz",
+		do:    []Edit{GuardNot(All, "TODO", Change(Dot, "done"))},
+		want:  "{.}done{.}",
+	},
+	{
+		name:  "match is within address",
+		given: "{..}abc TODO xyz",
+		do:    []Edit{Guard(Regexp("abc"), "^abc$", Change(Dot, "xyz"))},
+		want:  "{.}xyz{.} TODO xyz",
+	},
+	{
+		name:  "print",
+		given: "{..}abc TODO xyz",
+		do:    []Edit{Guard(All, "TODO", Print(Dot))},
+		want:  "{.}abc TODO xyz{.}",
+		print: "abc TODO xyz",
+	},
+	{
+		name:  "loop guard",
+		given: "{..}abc\nTODO: 1\nxyz\nTODO: 2\n123\n",
+		do:    []Edit{Loop(All, ".*\n", Guard(Dot, "TODO", Delete(Dot)))},
+		want:  "abc\nxyz\n{.}123\n{.}",
+	},
+	{
+		name:  "loop guard not",
+		given: "{..}abc\nTODO: 1\nxyz\nTODO: 2\n123\n",
+		do:    []Edit{Loop(All, ".*\n", GuardNot(Dot, "TODO", Delete(Dot)))},
+		want:  "TODO: 1\nTODO: 2\n{..}",
+	},
+	{
+		name:  "loop guard guard",
+		given: "{..}abc\nTODO: 1\nxyz\nTODO: 2\n123\n",
+		do:    []Edit{Loop(All, ".*\n", Guard(Dot, "TODO", GuardNot(Dot, "1", Delete(Dot))))},
+		want:  "abc\nTODO: 1\nxyz\n{.}123\n{.}",
+	},
+	{
+		name:  "block guard",
+		given: "{..}abc\nxyz\n",
+		do: []Edit{Block(All,
+			Guard(Line(1), "a", Change(Dot, "ABC\n")),
+			Guard(Line(2), "a", Change(Dot, "XYZ\n")))},
+		want: "{.}ABC\nxyz\n{.}",
+	},
+}
+
+func TestEditGuard(t *testing.T) {
+	for _, test := range guardTests {
+		test.run(t)
+	}
+}
+
+func TestEditGuardFromString(t *testing.T) {
+	for _, test := range guardTests {
+		test.runFromString(t)
+	}
+}
+
 var pipeFromTests = []editTest{
 	{
 		name:  "out of range",
@@ -1724,6 +2167,104 @@ func TestPipeDefaultShell(t *testing.T) {
 	}
 }
 
+// A testReleaser is a Releaser whose Acquire returns err.
+type testReleaser struct {
+	*Buffer
+	released bool
+	err      error
+}
+
+func (ed *testReleaser) Release() bool {
+	ed.released = true
+	return true
+}
+
+func (ed *testReleaser) Acquire() error {
+	ed.released = false
+	return ed.err
+}
+
+func (ed *testReleaser) Change(s Span, r io.Reader) (int64, error) {
+	if ed.released {
+		panic("change while released")
+	}
+	return ed.Buffer.Change(s, r)
+}
+
+func TestPipeRelease(t *testing.T) {
+	tests := append(append(pipeFromTests, pipeToTests...), pipeTests...)
+	for _, test := range tests {
+		test.runEditor(t, func(buf *Buffer) Editor { return &testReleaser{Buffer: buf} })
+		test.runEditor(t, func(buf *Buffer) Editor { return Bytes(&testReleaser{Buffer: buf}) })
+	}
+}
+
+func TestPipeRelease_Conflict(t *testing.T) {
+	tests := []editTest{
+		{
+			name:  "pipe",
+			given: "{..}abc",
+			do:    []Edit{Pipe(All, "echo -n xyz")},
+			want:  "{.}abc{.}",
+			error: ErrConflict.Error(),
+		},
+		{
+			name:  "pipe from",
+			given: "{..}abc",
+			do:    []Edit{PipeFrom(All, "echo -n xyz")},
+			want:  "{.}abc{.}",
+			error: ErrConflict.Error(),
+		},
+		{
+			name:  "pipe to",
+			given: "{..}abc",
+			do:    []Edit{PipeTo(All, "cat")},
+			want:  "{.}abc{.}",
+			print: "abc",
+		},
+	}
+	for _, test := range tests {
+		test.runEditor(t, func(buf *Buffer) Editor { return &testReleaser{Buffer: buf, err: ErrConflict} })
+	}
+}
+
+type testCanceler struct {
+	*Buffer
+	ctx context.Context
+}
+
+func (ed testCanceler) Context() context.Context { return ed.ctx }
+
+func TestPipeCancel(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	tests := []struct {
+		ctx  context.Context
+		edit Edit
+		want error
+	}{
+		{ctx: canceled, edit: Pipe(All, "sleep 10"), want: context.Canceled},
+		{ctx: canceled, edit: PipeTo(All, "sleep 10"), want: context.Canceled},
+		{ctx: timeout, edit: Pipe(All, "sleep 10"), want: context.DeadlineExceeded},
+		{ctx: timeout, edit: PipeFrom(All, "sleep 10"), want: context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		buf := newTestBuffer("{..}abc")
+		for _, ed := range []Editor{testCanceler{buf, test.ctx}, Bytes(testCanceler{buf, test.ctx})} {
+			if err := test.edit.Do(ed, ioutil.Discard); err != test.want {
+				t.Errorf("%v.Do(·)=%v, want %v", test.edit, err, test.want)
+			}
+		}
+		if !hasState(buf, "{.}abc{.}") {
+			t.Errorf("%v: got %q, want %q", test.edit, stateString(buf), "{.}abc{.}")
+		}
+		buf.Close()
+	}
+}
+
 var undoTests = []editTest{
 	{
 		name:  "empty undo 1",
@@ -2049,6 +2590,143 @@ var blockTests = []editTest{
 	},
 }
 
+// On an Editor that is not a LocalUndoer,
+// UndoLocal and RedoLocal are the same as Undo and Redo.
+func TestEditUndoRedoLocal(t *testing.T) {
+	var tests []editTest
+	for _, test := range append(undoTests, redoTests...) {
+		var do []Edit
+		for _, e := range test.do {
+			switch e := e.(type) {
+			case undo:
+				do = append(do, UndoLocal(int(e)))
+			case redo:
+				do = append(do, RedoLocal(int(e)))
+			default:
+				do = append(do, e)
+			}
+		}
+		test.do = do
+		tests = append(tests, test)
+	}
+	for _, test := range tests {
+		test.run(t)
+		test.runFromString(t)
+	}
+}
+
+var jumpTests = []editTest{
+	{
+		name:  "jump to current",
+		given: "abc{..}",
+		do:    []Edit{Jump(1)},
+		want:  "abc{..}",
+	},
+	{
+		name:  "jump to initial",
+		given: "abc{..}",
+		do:    []Edit{Jump(0)},
+		want:  "{..}",
+	},
+	{
+		name:  "jump to initial and back",
+		given: "abc{..}",
+		do:    []Edit{Jump(0), Jump(1)},
+		want:  "{.}abc{.}",
+	},
+	{
+		name:  "jump to other branch",
+		given: "abc{..}",
+		do:    []Edit{Append(End, "1"), Undo(1), Append(End, "2"), Jump(2)},
+		want:  "abc{.}1{.}",
+	},
+	{
+		name:  "jump to other branch and back",
+		given: "abc{..}",
+		do:    []Edit{Append(End, "1"), Undo(1), Append(End, "2"), Jump(2), Jump(3)},
+		want:  "abc{.}2{.}",
+	},
+	{
+		name:  "jump to common ancestor",
+		given: "abc{..}",
+		do:    []Edit{Append(End, "1"), Undo(1), Append(End, "2"), Jump(1)},
+		want:  "abc{..}",
+	},
+	{
+		name:  "jump to nested branch",
+		given: "abc{..}",
+		do: []Edit{
+			Append(End, "1"), Append(End, "2"), Undo(2),
+			Append(End, "3"), Append(End, "4"), Undo(1),
+			Append(End, "5"),
+			Jump(3),
+		},
+		want: "abc1{.}2{.}",
+	},
+	{
+		name:  "redo visited branch",
+		given: "abc{..}",
+		do:    []Edit{Append(End, "1"), Undo(1), Append(End, "2"), Jump(2), Undo(1), Redo(1)},
+		want:  "abc{.}1{.}",
+	},
+	{
+		name:  "redo most recent branch",
+		given: "abc{..}",
+		do:    []Edit{Append(End, "1"), Undo(1), Append(End, "2"), Undo(1), Redo(1)},
+		want:  "abc{.}2{.}",
+	},
+	{
+		name:  "bad state",
+		given: "abc{..}",
+		do:    []Edit{Jump(2)},
+		want:  "abc{..}",
+		error: "invalid argument",
+	},
+	{
+		name:  "negative state",
+		given: "abc{..}",
+		do:    []Edit{Jump(-1)},
+		want:  "abc{..}",
+		error: "invalid argument",
+	},
+	{
+		name:  "jump time to current",
+		given: "abc{..}",
+		do:    []Edit{JumpTime(0)},
+		want:  "abc{..}",
+	},
+	{
+		name:  "jump time to initial",
+		given: "abc{..}",
+		do:    []Edit{JumpTime(-time.Hour)},
+		want:  "{..}",
+	},
+	{
+		name:  "jump time to latest",
+		given: "abc{..}",
+		do:    []Edit{Append(End, "1"), Undo(1), Append(End, "2"), Undo(1), JumpTime(time.Hour)},
+		want:  "abc{.}2{.}",
+	},
+}
+
+func TestEditJump(t *testing.T) {
+	for _, test := range jumpTests {
+		// The unindexed Editor of run is not an UndoTree.
+		test.runEditor(t, func(buf *Buffer) Editor { return buf })
+		test.runEditor(t, func(buf *Buffer) Editor { return Bytes(buf) })
+	}
+}
+
+func TestEditJump_NotUndoTree(t *testing.T) {
+	buf := newTestBuffer("abc{..}")
+	defer buf.Close()
+	for _, e := range []Edit{Jump(0), JumpTime(0)} {
+		if err := e.Do(unindexed{buf}, ioutil.Discard); err == nil {
+			t.Errorf("%v.Do(unindexed)=nil, want error", e)
+		}
+	}
+}
+
 func TestEditBlock(t *testing.T) {
 	for _, test := range blockTests {
 		test.run(t)
@@ -2217,13 +2895,27 @@ type editTest struct {
 	do []Edit
 }
 
+// Unindexed is an Editor that hides the LineIndexer methods of its Buffer.
+type unindexed struct{ Editor }
+
 func (test editTest) run(t *testing.T) {
+	test.runEditor(t, func(buf *Buffer) Editor { return buf })
+
+	// Run again without the line index.
+	// Line addresses and = fall back to reading the text.
+	unindexedTest := test
+	unindexedTest.name += " (unindexed)"
+	unindexedTest.runEditor(t, func(buf *Buffer) Editor { return unindexed{buf} })
+}
+
+func (test editTest) runEditor(t *testing.T, editor func(*Buffer) Editor) {
 	buf := newTestBuffer(test.given)
 	defer buf.Close()
 
+	ed := editor(buf)
 	print := bytes.NewBuffer(nil)
 	for i, e := range test.do {
-		err := e.Do(buf, print)
+		err := e.Do(ed, print)
 		if !matchesError(test.error, err) {
 			t.Errorf("%s: Do(do[%d]=%q)=%v, want %q", test.name, i, e, err, test.error)
 		}
@@ -2241,6 +2933,15 @@ func (test editTest) run(t *testing.T) {
 
 // RunFromString replaces each edit with the parsed of its string and calls run.
 func (test editTest) runFromString(t *testing.T) {
+	if test, ok := test.fromString(t); ok {
+		test.run(t)
+	}
+}
+
+// FromString returns the test with each edit replaced by the parse of its string.
+// If an edit fails to parse, false is returned.
+func (test editTest) fromString(t *testing.T) (editTest, bool) {
+	do := make([]Edit, len(test.do))
 	for i, e := range test.do {
 		rs := strings.NewReader(e.String())
 		E, err := Ed(rs)
@@ -2252,7 +2953,7 @@ func (test editTest) runFromString(t *testing.T) {
 			if !matchesError(test.error, err) {
 				t.Errorf("%s: Ed(do[%d]=%q)=%v, want nil", test.name, i, e, err)
 			}
-			return
+			return test, false
 		}
 		if rs.Len() > 0 {
 			// Nothing should be left over after the parse…
@@ -2265,9 +2966,10 @@ func (test editTest) runFromString(t *testing.T) {
 				t.Errorf("%s: Ed(do[%d]=%q) left over %q, want \"\"", test.name, i, e, string(left))
 			}
 		}
-		test.do[i] = E
+		do[i] = E
 	}
-	test.run(t)
+	test.do = do
+	return test, true
 }
 
 func newTestBuffer(str string) *Buffer {
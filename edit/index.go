@@ -0,0 +1,590 @@
+// Copyright © 2016, The T Authors.
+
+package edit
+
+import (
+	"io"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/eaburns/T/edit/runes"
+)
+
+const (
+	// IndexChunkRunes is the maximum number of indexed runes
+	// in a chunk of an offset index.
+	indexChunkRunes = 1 << 10
+	// CountChunkRunes is the maximum number of runes
+	// in a chunk of a counting index.
+	countChunkRunes = 1 << 12
+)
+
+// A runeIndex is an index of the weights of the runes
+// in a sequence of runes.
+// The index can compute the total weight of the runes before an offset.
+//
+// The index is split into chunks,
+// each covering a string of the runes.
+// An index is either an offset index or a counting index.
+//
+// In an offset index, the indexed runes have weight 1,
+// and all other runes have weight 0.
+// Each chunk stores the offsets of its indexed runes,
+// relative to the start of the chunk,
+// so a change only needs to update the chunks that it touches.
+//
+// In a counting index, each chunk stores only its total weight,
+// and queries within a chunk scan the runes of the chunk in the text.
+// This keeps the size of the index proportional to the number of chunks,
+// regardless of the number of runes with non-zero weight.
+//
+// When a chunk grows larger than the maximum size,
+// it is split into chunks of half the maximum size.
+// When a chunk shrinks to less than a quarter of the maximum size,
+// it is merged with a neighboring chunk.
+//
+// The chunks are kept in a treap,
+// each node of which records the total size and weight of its subtree.
+// This allows both changes and queries in time logarithmic
+// in the number of chunks.
+type runeIndex struct {
+	// Text is the text of a counting index, and weight is the weight of its runes.
+	// Both are nil for an offset index.
+	text   *runes.Buffer
+	weight func(rune) int64
+	root   *indexNode
+	// Rand is the state of the pseudo-random number generator
+	// of the priorities of the nodes.
+	rand uint32
+}
+
+type indexChunk struct {
+	// Size is the number of runes covered by the chunk.
+	size int64
+	// Offs are the offsets of the indexed runes in the chunk,
+	// relative to the start of the chunk, in ascending order.
+	// Offs is nil in a counting index.
+	offs []int64
+	// Sum is the total weight of the runes in the chunk.
+	sum int64
+}
+
+// An indexNode is a node of the treap of a runeIndex.
+// An in-order traversal of the treap visits the chunks in order,
+// and the priority of each node is at least that of its children.
+type indexNode struct {
+	left, right *indexNode
+	prio        uint32
+	chunk       indexChunk
+	// Size and sum are the total size and sum
+	// of the chunks of the subtree rooted at the node.
+	size, sum int64
+}
+
+// NewOffsetIndex returns a new, empty offset index.
+func newOffsetIndex() *runeIndex { return &runeIndex{rand: 1} }
+
+// NewCountIndex returns a new, empty counting index
+// of the runes of the text, with the given weight.
+func newCountIndex(text *runes.Buffer, weight func(rune) int64) *runeIndex {
+	return &runeIndex{text: text, weight: weight, rand: 1}
+}
+
+// Update updates the index to account for the runes of s
+// changing to n runes, indexed by the given chunks.
+// The offsets of the chunks are relative to their own start,
+// and the sizes of the chunks sum to n.
+// For a counting index, removed is the total weight of the runes of s;
+// it is ignored by an offset index.
+//
+// Update must be called after the change is made to the text,
+// because a counting index may read the unchanged runes
+// of the chunks at either end of the change.
+func (ix *runeIndex) update(s Span, n, removed int64, ins []indexChunk) error {
+	// Split the chunks into those before s, those covering s, and those after s.
+	// The inserted chunks are merged with the partial chunks covering s,
+	// so if there are no chunks covering s,
+	// one of the chunks adjacent to it is used instead.
+	left, rest := split(ix.root, s[0])
+	mid, right := split(rest, s[1]-left.totalSize())
+	if right != nil && (mid == nil || left.totalSize()+mid.totalSize() < s[1]) {
+		var first *indexNode
+		first, right = split(right, leftmost(right).chunk.size)
+		mid = merge(mid, first)
+	}
+	if mid == nil && left != nil {
+		left, mid = split(left, left.size-rightmost(left).chunk.size)
+	}
+
+	var cs []indexChunk
+	switch {
+	case mid == nil:
+		cs = append(cs, ins...)
+	case ix.text != nil:
+		var err error
+		if cs, err = ix.recount(mid, left.totalSize(), s, n, removed, ins); err != nil {
+			return err
+		}
+	default:
+		first, last := leftmost(mid).chunk, rightmost(mid).chunk
+		start, lastStart := left.totalSize(), left.totalSize()+mid.size-last.size
+		cs = append(cs, first.slice(0, s[0]-start))
+		cs = append(cs, ins...)
+		cs = append(cs, last.slice(s[1]-lastStart, last.size))
+	}
+	cs = ix.normalize(cs)
+
+	// Merge a small chunk at either end with its neighbor.
+	if left != nil && len(cs) > 0 && ix.small(cs[0]) {
+		var prev *indexNode
+		left, prev = split(left, left.size-rightmost(left).chunk.size)
+		cs = ix.normalize(append([]indexChunk{prev.chunk}, cs...))
+	}
+	if right != nil && len(cs) > 0 && ix.small(cs[len(cs)-1]) {
+		var next *indexNode
+		next, right = split(right, leftmost(right).chunk.size)
+		cs = ix.normalize(append(cs, next.chunk))
+	}
+
+	root := left
+	for _, c := range cs {
+		root = merge(root, ix.newNode(c))
+	}
+	ix.root = merge(root, right)
+	return nil
+}
+
+// Recount returns the chunks of a counting index
+// that replace the chunks of mid, which begin at the offset start,
+// when the runes of s change to n runes with the inserted chunks,
+// and the removed runes had the given total weight.
+//
+// If the changed chunks fit in a single chunk,
+// its weight is computed without reading the text.
+// Otherwise, the unchanged runes before and after the change are read
+// and split into chunks of at most half of the maximum size,
+// so that further changes to them need not read them again
+// until they have grown by that much.
+func (ix *runeIndex) recount(mid *indexNode, start int64, s Span, n, removed int64, ins []indexChunk) ([]indexChunk, error) {
+	size := mid.size - s.Size() + n
+	if size <= countChunkRunes {
+		sum := mid.sum - removed
+		for _, c := range ins {
+			sum += c.sum
+		}
+		return []indexChunk{{size: size, sum: sum}}, nil
+	}
+	head, err := ix.count(start, s[0]-start)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := ix.count(s[0]+n, start+size-(s[0]+n))
+	if err != nil {
+		return nil, err
+	}
+	return append(append(head, ins...), tail...), nil
+}
+
+// Count returns the chunks of the n runes of the text
+// of a counting index, beginning at the offset,
+// each with at most countChunkRunes/2 runes.
+func (ix *runeIndex) count(at, n int64) ([]indexChunk, error) {
+	var c counter
+	err := ix.scan(at, n, func(r rune) bool {
+		c.add(ix.weight(r))
+		return true
+	})
+	return c.chunks, err
+}
+
+// Slice returns the part of a chunk of an offset index
+// between the offsets lo and hi, relative to the start of the chunk.
+func (c indexChunk) slice(lo, hi int64) indexChunk {
+	j := searchOffs(c.offs, lo)
+	k := searchOffs(c.offs, hi)
+	s := indexChunk{size: hi - lo, offs: make([]int64, k-j), sum: int64(k - j)}
+	for i, o := range c.offs[j:k] {
+		s.offs[i] = o - lo
+	}
+	return s
+}
+
+// Sum returns the total weight of the n runes of the text
+// of a counting index, beginning at the offset.
+func (ix *runeIndex) sum(at, n int64) (int64, error) {
+	var sum int64
+	err := ix.scan(at, n, func(r rune) bool {
+		sum += ix.weight(r)
+		return true
+	})
+	return sum, err
+}
+
+// Scan calls f with each of the n runes of the text
+// of a counting index, beginning at the offset,
+// until f returns false.
+func (ix *runeIndex) scan(at, n int64, f func(rune) bool) error {
+	var p [1 << 10]rune
+	r := runes.LimitReader(ix.text.Reader(at), n)
+	for {
+		m, err := r.Read(p[:])
+		for _, c := range p[:m] {
+			if !f(c) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Measure returns the size of a chunk
+// compared against the maximum chunk size of the index.
+func (ix *runeIndex) measure(c indexChunk) int64 {
+	if ix.text != nil {
+		return c.size
+	}
+	return int64(len(c.offs))
+}
+
+// Max returns the maximum chunk size of the index.
+func (ix *runeIndex) max() int64 {
+	if ix.text != nil {
+		return countChunkRunes
+	}
+	return indexChunkRunes
+}
+
+// Small returns whether the chunk should be merged with a neighbor.
+func (ix *runeIndex) small(c indexChunk) bool { return ix.measure(c) < ix.max()/4 }
+
+// Normalize returns the chunks with empty chunks removed,
+// small chunks merged with their neighbors,
+// and large chunks split.
+//
+// The chunks of a counting index are never large:
+// they are at most half of the maximum size when inserted,
+// and they are only merged if the result is at most the maximum size.
+func (ix *runeIndex) normalize(cs []indexChunk) []indexChunk {
+	var merged []indexChunk
+	for _, c := range cs {
+		if c.size == 0 {
+			continue
+		}
+		if i := len(merged) - 1; i >= 0 &&
+			(ix.small(merged[i]) || ix.small(c)) &&
+			ix.measure(merged[i])+ix.measure(c) <= ix.max() {
+			merged[i] = join(merged[i], c)
+			continue
+		}
+		merged = append(merged, c)
+	}
+	var chunks []indexChunk
+	for _, c := range merged {
+		if ix.measure(c) > ix.max() {
+			chunks = append(chunks, splitChunk(c)...)
+		} else {
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks
+}
+
+// Join returns the concatenation of two chunks.
+func join(a, b indexChunk) indexChunk {
+	c := indexChunk{size: a.size + b.size, sum: a.sum + b.sum}
+	if a.offs == nil && b.offs == nil {
+		return c
+	}
+	c.offs = make([]int64, 0, len(a.offs)+len(b.offs))
+	c.offs = append(c.offs, a.offs...)
+	for _, o := range b.offs {
+		c.offs = append(c.offs, a.size+o)
+	}
+	return c
+}
+
+// SplitChunk splits a chunk of an offset index into chunks
+// with at most indexChunkRunes/2 indexed runes each.
+func splitChunk(c indexChunk) []indexChunk {
+	const n = indexChunkRunes / 2
+	var chunks []indexChunk
+	var lo int64
+	for len(c.offs) > n {
+		hi := c.offs[n-1] + 1
+		chunks = append(chunks, c.slice(lo, hi))
+		lo = hi
+		c.offs = c.offs[n:]
+	}
+	// Slice only uses the offsets in [lo, hi), all of which remain.
+	return append(chunks, c.slice(lo, c.size))
+}
+
+func (ix *runeIndex) newNode(c indexChunk) *indexNode {
+	// Xorshift; see Marsaglia, "Xorshift RNGs".
+	ix.rand ^= ix.rand << 13
+	ix.rand ^= ix.rand >> 17
+	ix.rand ^= ix.rand << 5
+	n := &indexNode{prio: ix.rand, chunk: c}
+	return n.fix()
+}
+
+// Fix recomputes the size and sum of the node from its children,
+// and returns the node.
+func (n *indexNode) fix() *indexNode {
+	n.size = n.left.totalSize() + n.chunk.size + n.right.totalSize()
+	n.sum = n.left.totalSum() + n.chunk.sum + n.right.totalSum()
+	return n
+}
+
+// TotalSize returns the size of the subtree, which may be nil.
+func (n *indexNode) totalSize() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// TotalSum returns the sum of the subtree, which may be nil.
+func (n *indexNode) totalSum() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.sum
+}
+
+func leftmost(n *indexNode) *indexNode {
+	for n.left != nil {
+		n = n.left
+	}
+	return n
+}
+
+func rightmost(n *indexNode) *indexNode {
+	for n.right != nil {
+		n = n.right
+	}
+	return n
+}
+
+// Split splits a treap into a treap of the chunks
+// that end at or before the offset at,
+// and a treap of the remaining chunks.
+func split(n *indexNode, at int64) (*indexNode, *indexNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if end := n.left.totalSize() + n.chunk.size; at >= end {
+		l, r := split(n.right, at-end)
+		n.right = l
+		return n.fix(), r
+	}
+	l, r := split(n.left, at)
+	n.left = r
+	return l, n.fix()
+}
+
+// Merge returns the treap of the chunks of a followed by those of b.
+func merge(a, b *indexNode) *indexNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.prio >= b.prio:
+		a.right = merge(a.right, b)
+		return a.fix()
+	default:
+		b.left = merge(a, b.left)
+		return b.fix()
+	}
+}
+
+// Find returns the first chunk for which f returns true,
+// given the total size and sum of the chunks up to and including it,
+// along with the total size and sum of the chunks before it.
+// F must be monotonic: false for some prefix of the chunks,
+// and true for the remainder.
+// If f is false for all chunks, find returns nil
+// and the total size and sum of the index.
+func (ix *runeIndex) find(f func(size, sum int64) bool) (*indexChunk, int64, int64) {
+	var found *indexChunk
+	var foundSize, foundSum, size, sum int64
+	for n := ix.root; n != nil; {
+		s := size + n.left.totalSize()
+		w := sum + n.left.totalSum()
+		if f(s+n.chunk.size, w+n.chunk.sum) {
+			found, foundSize, foundSum = &n.chunk, s, w
+			n = n.left
+			continue
+		}
+		size, sum = s+n.chunk.size, w+n.chunk.sum
+		n = n.right
+	}
+	if found == nil {
+		return nil, size, sum
+	}
+	return found, foundSize, foundSum
+}
+
+// SumBefore returns the total weight of the runes before the offset.
+//
+// Errors reading the text of a counting index
+// are treated as the end of the chunk being read.
+func (ix *runeIndex) sumBefore(at int64) int64 {
+	c, start, sum := ix.find(func(size, _ int64) bool { return size > at })
+	switch {
+	case c == nil:
+		return sum
+	case ix.text != nil:
+		s, _ := ix.sum(start, at-start)
+		return sum + s
+	default:
+		return sum + int64(searchOffs(c.offs, at-start))
+	}
+}
+
+// Nth returns the offset of the ith indexed rune, counting from 0,
+// or -1 if there are not that many indexed runes.
+// Nth must only be called on an offset index.
+func (ix *runeIndex) nth(i int64) int64 {
+	if i < 0 {
+		return -1
+	}
+	c, start, sum := ix.find(func(_, sum int64) bool { return sum > i })
+	if c == nil {
+		return -1
+	}
+	return start + c.offs[i-sum]
+}
+
+// OffsetAt returns the offset of the rune
+// for which the offset plus the weight of the preceding runes
+// is at most x, and the offset plus the weight of it and the preceding runes
+// is greater than x.
+// If there is no such rune, the size of the index is returned.
+// OffsetAt must only be called on a counting index.
+//
+// If the weight of each rune is the number of bytes
+// in its UTF-8 encoding in excess of 1,
+// then OffsetAt returns the offset of the rune
+// whose UTF-8 encoding contains byte x.
+//
+// Errors reading the text are treated as the end of the chunk being read.
+func (ix *runeIndex) offsetAt(x int64) int64 {
+	c, start, sum := ix.find(func(size, sum int64) bool { return size+sum > x })
+	if c == nil {
+		return start
+	}
+	// At is the value of the current offset, pos,
+	// plus the weight of the preceding runes.
+	pos, at := start, start+sum
+	ix.scan(start, c.size, func(r rune) bool {
+		w := 1 + ix.weight(r)
+		if x < at+w {
+			return false
+		}
+		at += w
+		pos++
+		return true
+	})
+	return pos
+}
+
+// SearchOffs returns the index of the first offset at or after o.
+func searchOffs(offs []int64, o int64) int {
+	return sort.Search(len(offs), func(i int) bool { return offs[i] >= o })
+}
+
+// RuneBytes returns the number of bytes in the UTF-8 encoding of r.
+// Runes that cannot be encoded are encoded as utf8.RuneError.
+func runeBytes(r rune) int {
+	if n := utf8.RuneLen(r); n > 0 {
+		return n
+	}
+	return utf8.RuneLen(utf8.RuneError)
+}
+
+// ExtraBytes returns the number of bytes in the UTF-8 encoding of r
+// in excess of 1.
+func extraBytes(r rune) int64 { return int64(runeBytes(r) - 1) }
+
+// An indexReader is a runes.Reader that indexes the runes that it reads:
+// the offsets of the newlines, in chunks for an offset index,
+// and the extra UTF-8 bytes of the runes, in chunks for a counting index.
+type indexReader struct {
+	runes.Reader
+	// Size is the number of runes that will be read.
+	size     int64
+	n        int64
+	newlines chunker
+	bytes    counter
+}
+
+// A chunker accumulates the chunks of an offset index,
+// each with at most indexChunkRunes/2 indexed runes.
+type chunker struct {
+	chunks []indexChunk
+	// Start is the offset of the start of the last chunk.
+	start int64
+}
+
+// Add adds an indexed rune at the given offset.
+func (c *chunker) add(offs int64) {
+	if len(c.chunks) == 0 {
+		c.chunks = append(c.chunks, indexChunk{})
+	}
+	last := &c.chunks[len(c.chunks)-1]
+	if len(last.offs) == indexChunkRunes/2 {
+		end := c.start + last.offs[len(last.offs)-1] + 1
+		last.size = end - c.start
+		c.chunks = append(c.chunks, indexChunk{})
+		last = &c.chunks[len(c.chunks)-1]
+		c.start = end
+	}
+	last.offs = append(last.offs, offs-c.start)
+	last.sum++
+}
+
+// Done returns the chunks, covering n runes.
+func (c *chunker) done(n int64) []indexChunk {
+	if len(c.chunks) == 0 {
+		return []indexChunk{{size: n}}
+	}
+	c.chunks[len(c.chunks)-1].size = n - c.start
+	return c.chunks
+}
+
+// A counter accumulates the chunks of a counting index,
+// each with at most countChunkRunes/2 runes.
+type counter struct{ chunks []indexChunk }
+
+// Add adds a rune with the given weight.
+func (c *counter) add(weight int64) {
+	if len(c.chunks) == 0 || c.chunks[len(c.chunks)-1].size == countChunkRunes/2 {
+		c.chunks = append(c.chunks, indexChunk{})
+	}
+	last := &c.chunks[len(c.chunks)-1]
+	last.size++
+	last.sum += weight
+}
+
+// Len returns the number of unread runes.
+// It allows runes.Copy to copy directly into a runes.Buffer.
+func (r *indexReader) Len() int64 { return r.size - r.n }
+
+func (r *indexReader) Read(p []rune) (int, error) {
+	n, err := r.Reader.Read(p)
+	for i, c := range p[:n] {
+		if c == '\n' {
+			r.newlines.add(r.n + int64(i))
+		}
+		r.bytes.add(extraBytes(c))
+	}
+	r.n += int64(n)
+	return n, err
+}
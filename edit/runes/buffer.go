@@ -274,10 +274,8 @@ func (b *Buffer) makeSpace(n, at int64) ([]rune, error) {
 		}
 	case at == b.Size():
 		// Try to extend the last block if we are inserting on the end.
-		for _, blk := range b.blocks[:len(b.blocks)-1] {
-			blkStart += int64(blk.n)
-		}
 		i = len(b.blocks) - 1
+		blkStart = b.Size() - int64(b.blocks[i].n)
 	default:
 		i, blkStart = b.blockAt(at)
 	}
@@ -376,6 +374,19 @@ func (b *Buffer) blockAt(at int64) (int, int64) {
 	if at < 0 || at >= b.Size() {
 		panic("invalid offset: " + strconv.FormatInt(at, 10))
 	}
+	if i, q0 := b.cached, b.cached0; i >= 0 && q0 >= 0 {
+		// Search outward from the cached block,
+		// since most accesses are near the previous one.
+		for at < q0 {
+			i--
+			q0 -= int64(b.blocks[i].n)
+		}
+		for at >= q0+int64(b.blocks[i].n) {
+			q0 += int64(b.blocks[i].n)
+			i++
+		}
+		return i, q0
+	}
 	var q0 int64
 	for i, blk := range b.blocks {
 		if q0 <= at && at < q0+int64(blk.n) {
@@ -401,8 +412,8 @@ func (b *Buffer) insertAt(at int64) (int, error) {
 		// Adding immediately before blk, no need to split.
 		nblk := b.allocBlock()
 		b.blocks = append(b.blocks[:i], append([]block{nblk}, b.blocks[i:]...)...)
-		if b.cached == i {
-			b.cached = i + 1
+		if b.cached >= i {
+			b.cached++
 		}
 		return i, nil
 	}
@@ -431,6 +442,7 @@ func (b *Buffer) insertAt(at int64) (int, error) {
 	b.blocks[i+2].n = blk.n - o
 	copy(b.cache, b.cache[o:])
 	b.cached = i + 2
+	b.cached0 = at
 	b.dirty = true
 
 	return i + 1, nil
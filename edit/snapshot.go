@@ -0,0 +1,280 @@
+// Copyright © 2016, The T Authors.
+
+package edit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/eaburns/T/edit/runes"
+)
+
+// SnapshotMagic begins each Buffer snapshot.
+const snapshotMagic = "T buffer snapshot 1\n"
+
+var (
+	errPending     = errors.New("pending changes")
+	errBadSnapshot = errors.New("bad snapshot")
+)
+
+// Snapshot writes a snapshot of the Buffer to the Writer,
+// from which ReadSnapshot creates an equivalent Buffer.
+// The snapshot contains the text, marks, and registers of the Buffer,
+// and, if history is true, its undo tree.
+// Otherwise, the undo tree of the restored Buffer
+// has only the state of the snapshot.
+// Open undo groups are not recorded.
+//
+// It is an error to Snapshot a Buffer with pending changes.
+func (buf *Buffer) Snapshot(w io.Writer, history bool) error {
+	if !logFirst(buf.pending).end() {
+		return errPending
+	}
+	bw := bufio.NewWriter(w)
+	sw := &snapshotWriter{w: bw}
+	sw.write([]byte(snapshotMagic))
+	sw.int(int64(buf.seq))
+	sw.int(int64(len(buf.marks)))
+	for m, s := range buf.marks {
+		sw.int(int64(m))
+		sw.int(s[0])
+		sw.int(s[1])
+	}
+	sw.int(int64(len(buf.registers)))
+	for r, text := range buf.registers {
+		sw.int(int64(r))
+		sw.int(int64(len(text)))
+		sw.write(text)
+	}
+	sw.runes(buf.runes)
+	if !history {
+		sw.int(0)
+		if sw.err != nil {
+			return sw.err
+		}
+		return bw.Flush()
+	}
+	t := buf.tree
+	sw.int(1)
+	sw.int(int64(t.n))
+	sw.int(int64(t.cur))
+	sw.int(int64(t.child))
+	sw.int(t.time.UnixNano())
+	for _, l := range []*log{t.nodes, t.undo, t.redo} {
+		sw.int(l.last)
+		sw.runes(l.buf)
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	return bw.Flush()
+}
+
+// ReadSnapshot returns a new Buffer
+// created from a snapshot written by Snapshot.
+func ReadSnapshot(r io.Reader) (*Buffer, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(snapshotMagic))
+	if sr.read(magic); sr.err == nil && string(magic) != snapshotMagic {
+		return nil, errBadSnapshot
+	}
+	buf := NewBuffer()
+	if err := sr.buffer(buf); err != nil {
+		buf.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Buffer reads the remainder of a snapshot into an empty Buffer.
+func (sr *snapshotReader) buffer(buf *Buffer) error {
+	buf.seq = int32(sr.int())
+	marks := make(map[rune]Span)
+	for n := sr.int(); n > 0 && sr.err == nil; n-- {
+		m := rune(sr.int())
+		marks[m] = Span{sr.int(), sr.int()}
+	}
+	for n := sr.int(); n > 0 && sr.err == nil; n-- {
+		r := rune(sr.int())
+		buf.registers[r] = sr.bytes(sr.size())
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+	size := sr.size()
+	if sr.err != nil {
+		return sr.err
+	}
+	if err := buf.change(Span{}, size, sr.runes(size)); err != nil {
+		return err
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+	for m, s := range marks {
+		if err := buf.SetMark(m, s); err != nil {
+			return errBadSnapshot
+		}
+	}
+
+	if sr.int() == 0 {
+		return sr.err
+	}
+	t := buf.tree
+	t.n = int(sr.int())
+	t.cur = int(sr.int())
+	t.child = int(sr.int())
+	t.time = time.Unix(0, sr.int())
+	if sr.err == nil && (t.n < 1 || t.cur < 0 || t.cur >= t.n || t.child < -1 || t.child >= t.n) {
+		return errBadSnapshot
+	}
+	for _, l := range []*log{t.nodes, t.undo, t.redo} {
+		l.last = sr.int()
+		size := sr.size()
+		if sr.err != nil {
+			return sr.err
+		}
+		if _, err := runes.Copy(l.buf.Writer(0), sr.runes(size)); err != nil {
+			return err
+		}
+		if sr.err != nil {
+			return sr.err
+		}
+		if l.last < 0 || (size > 0 && l.last+headerRunes > size) {
+			return errBadSnapshot
+		}
+	}
+	if nodes := t.nodes.buf.Size(); nodes != nodeOffs(t.n) {
+		return errBadSnapshot
+	}
+	return nil
+}
+
+// A snapshotWriter writes the fields of a snapshot,
+// recording the first error.
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(p)
+	}
+}
+
+func (sw *snapshotWriter) int(x int64) {
+	var b [binary.MaxVarintLen64]byte
+	sw.write(b[:binary.PutVarint(b[:], x)])
+}
+
+// Runes writes the size of the runes.Buffer,
+// followed by its runes, each as a varint.
+func (sw *snapshotWriter) runes(rs *runes.Buffer) {
+	sw.int(rs.Size())
+	for offs := int64(0); offs < rs.Size() && sw.err == nil; {
+		n := rs.Size() - offs
+		if n > runes.MinRead {
+			n = runes.MinRead
+		}
+		p, err := rs.Read(int(n), offs)
+		if err != nil {
+			sw.err = err
+			return
+		}
+		for _, r := range p {
+			sw.int(int64(r))
+		}
+		offs += n
+	}
+}
+
+// A snapshotReader reads the fields of a snapshot,
+// recording the first error.
+// After an error, the fields read are zero.
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (sr *snapshotReader) read(p []byte) {
+	if sr.err == nil {
+		_, sr.err = io.ReadFull(sr.r, p)
+	}
+}
+
+func (sr *snapshotReader) int() int64 {
+	if sr.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(sr.r)
+	if err != nil {
+		sr.err = err
+		return 0
+	}
+	return x
+}
+
+// Bytes reads n bytes.
+func (sr *snapshotReader) bytes(n int64) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, sr.r, n); err != nil {
+		sr.err = err
+		return nil
+	}
+	return b.Bytes()
+}
+
+// Size reads a non-negative int.
+func (sr *snapshotReader) size() int64 {
+	x := sr.int()
+	if x < 0 && sr.err == nil {
+		sr.err = errBadSnapshot
+	}
+	if x < 0 {
+		return 0
+	}
+	return x
+}
+
+// Runes returns a runes.Reader that reads n runes of the snapshot.
+func (sr *snapshotReader) runes(n int64) runes.Reader {
+	return &snapshotRunes{sr: sr, n: n}
+}
+
+type snapshotRunes struct {
+	sr *snapshotReader
+	n  int64
+}
+
+func (r *snapshotRunes) Len() int64 { return r.n }
+
+func (r *snapshotRunes) Read(p []rune) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = rune(r.sr.int())
+		if err := r.sr.err; err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return i, err
+		}
+		r.n--
+	}
+	return len(p), nil
+}
@@ -3,8 +3,10 @@
 package edit
 
 import (
+	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 var (
@@ -14,6 +16,12 @@ var (
 	// ErrOutOfSequence indicates that a change modifies text
 	// overlapping or preceeding the previous, staged change.
 	ErrOutOfSequence = errors.New("out of sequence")
+
+	// ErrConflict indicates that a change cannot be undone or redone,
+	// because the text that it changed was since changed by another Editor,
+	// or that the text that a command was run on
+	// was changed by another Editor while the command ran.
+	ErrConflict = errors.New("conflicting change")
 )
 
 // A Text provides a read-only view of a sequence of text.
@@ -46,6 +54,43 @@ type Text interface {
 	Reader(Span) io.Reader
 }
 
+// A LineIndexer is a Text that maintains an index of its newlines.
+//
+// Line addresses and the = Edit use the index of a LineIndexer
+// instead of reading the Text to find newlines.
+type LineIndexer interface {
+	Text
+
+	// NewlinesBefore returns the number of newlines
+	// before the given offset into the Text.
+	NewlinesBefore(int64) int64
+
+	// Newline returns the offset of the ith newline of the Text,
+	// counting from 0.
+	// If the Text has i or fewer newlines, Newline returns -1.
+	Newline(i int64) int64
+}
+
+// A ByteIndexer is a Text that maintains an index
+// of the size of the UTF-8 encoding of its runes.
+//
+// Byte addresses and the Bytes Editor use the index of a ByteIndexer
+// instead of reading the Text to convert between offsets.
+type ByteIndexer interface {
+	Text
+
+	// ByteOffset returns the offset, in bytes,
+	// into the UTF-8 encoding of the Text
+	// corresponding to the given offset into the Text.
+	ByteOffset(int64) int64
+
+	// FromByteOffset returns the offset into the Text
+	// of the rune whose UTF-8 encoding contains the given byte offset.
+	// If the byte offset is at or beyond the end of the encoding,
+	// the Size of the Text is returned.
+	FromByteOffset(int64) int64
+}
+
 // An Editor provides a read-write view of a sequence of text.
 //
 // An Editor changes the Text using a two-step procedure.
@@ -60,10 +105,15 @@ type Text interface {
 // The Apply method applies the changes to the Text
 // in the order that they were added to the staging log.
 //
-// An Editor also has an Undo stack and a Redo stack.
-// The stacks hold batches of changes,
+// An Editor also records the states of its text in an undo tree,
 // providing support for unlimited undoing and redoing
-// of changes made by calls to Apply, Undo, and Redo.
+// of the batches of changes made by calls to Apply.
+// Each call to Apply creates a new state of the tree,
+// a child of the current state.
+// Undo changes the text to the parent of the current state,
+// and Redo changes it to the most recently visited child.
+// Applying changes after an Undo creates a new branch of the tree;
+// the undone states remain reachable.
 type Editor interface {
 	Text
 
@@ -90,18 +140,21 @@ type Editor interface {
 
 	// Apply applies all changes since the previous call to Apply,
 	// updates all marks to reflect the changes,
-	// logs the applied changes to the Undo stack,
-	// and clears the Redo stack.
+	// and records the resulting text as a new state of the undo tree,
+	// a child of the current state.
 	Apply() error
 
-	// Undo undoes the changes at the top of the Undo stack.
-	// It updates all marks to reflect the changes,
-	// and logs the undone changes to the Redo stack.
+	// Undo undoes the changes of the current state of the undo tree,
+	// changing the text to the parent state.
+	// It updates all marks to reflect the changes.
+	// If the current state is the initial state, Undo does nothing.
 	Undo() error
 
-	// Redo redoes the changes at the top of the Redo stack.
-	// It updates all marks to reflect the changes,
-	// and logs the redone changes to the Undo stack.
+	// Redo redoes the changes of the most recently visited child
+	// of the current state of the undo tree,
+	// changing the text to the child state.
+	// It updates all marks to reflect the changes.
+	// If the current state has no children, Redo does nothing.
 	Redo() error
 }
 
@@ -138,3 +191,113 @@ func (s Span) Update(t Span, n int64) Span {
 
 // Contains returns whether a location is within the Span.
 func (s Span) Contains(l int64) bool { return s[0] <= l && l < s[1] }
+
+// A LocalUndoer is an Editor of a text that can also be changed by other Editors.
+// In addition to the undo tree of the changes made by all Editors,
+// a LocalUndoer has local Undo and Redo stacks
+// of the batches of changes made through it.
+// Each call to Apply through the LocalUndoer
+// pushes its batch onto the local Undo stack
+// and clears the local Redo stack.
+// The stacks may be bounded, dropping their oldest batches.
+//
+// Local undoing and redoing does not move within the undo tree.
+// Instead, the reverting changes are applied as a new state of the tree,
+// so they can themselves be undone with Undo.
+// Conversely, changes made by Undo, Redo, or SetState
+// are treated as changes made by another Editor.
+type LocalUndoer interface {
+	Editor
+
+	// UndoLocal undoes the changes at the top of the local Undo stack,
+	// which were made through this Editor.
+	// The changes are adjusted to account for any later changes
+	// made by other Editors.
+	// It updates all marks to reflect the changes,
+	// and logs the undone changes to the local Redo stack.
+	//
+	// If the text changed by the changes was since changed by another Editor,
+	// no changes are made and ErrConflict is returned.
+	UndoLocal() error
+
+	// RedoLocal redoes the changes at the top of the local Redo stack.
+	// The changes are adjusted to account for any later changes
+	// made by other Editors.
+	// It updates all marks to reflect the changes,
+	// and logs the redone changes to the local Undo stack.
+	//
+	// If the text changed by the changes was since changed by another Editor,
+	// no changes are made and ErrConflict is returned.
+	RedoLocal() error
+}
+
+// An UndoTree is an Editor whose undo tree states
+// can be visited directly.
+//
+// The states are numbered in the order that they were created.
+// State 0 is the initial state.
+type UndoTree interface {
+	Editor
+
+	// State returns the number of the current state.
+	State() int
+
+	// StateTime returns the time at which a state was created.
+	// If there is no such state, ErrInvalidArgument is returned.
+	StateTime(int) (time.Time, error)
+
+	// StateAt returns the most recently created state
+	// that was created at or before the given time.
+	StateAt(time.Time) (int, error)
+
+	// SetState changes the text to a state.
+	// It updates all marks to reflect the changes,
+	// and sets dot to the address covering the last change.
+	// If there is no such state, ErrInvalidArgument is returned.
+	SetState(int) error
+}
+
+// A Canceler is an Editor whose edits can be canceled.
+type Canceler interface {
+	Editor
+
+	// Context returns the Context of the Editor's edits.
+	// Commands run by the edits, such as those of Pipe,
+	// are killed when the Context is done.
+	Context() context.Context
+}
+
+// A Releaser is an Editor of a text that can also be changed by other Editors,
+// and that can be released for use by others
+// while an edit waits for a command, such as that of Pipe.
+type Releaser interface {
+	Editor
+
+	// Release releases the Editor and returns true,
+	// or returns false if the Editor cannot be released,
+	// for example, because it has staged, unapplied changes.
+	// A released Editor must not be used until it is reacquired.
+	Release() bool
+
+	// Acquire reacquires a released Editor.
+	// It sets dot to the Span of dot at the time of the Release,
+	// adjusted to account for changes made by other Editors.
+	//
+	// If a change made while the Editor was released overlapped dot,
+	// dot is not set and ErrConflict is returned.
+	Acquire() error
+}
+
+// A Registerer is an Editor with registers,
+// named texts into which text of the Editor can be copied,
+// and from which it can be changed.
+type Registerer interface {
+	Editor
+
+	// Register returns the UTF-8 encoded text of a register.
+	// If the register was never set, Register returns nil.
+	Register(rune) []byte
+
+	// SetRegister sets the UTF-8 encoded text of a register.
+	SetRegister(rune, []byte)
+}
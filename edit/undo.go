@@ -0,0 +1,461 @@
+// Copyright © 2016, The T Authors.
+
+package edit
+
+import (
+	"time"
+
+	"github.com/eaburns/T/edit/runes"
+)
+
+// An undoTree records every state of a Buffer.
+//
+// The states form a tree.
+// State 0 is the root, the initial, empty state of the Buffer.
+// Each Apply creates a new state,
+// a child of the current state, numbered in the order created.
+// Undo moves to the parent of the current state,
+// and Redo moves to its most recently visited child.
+// A change after an Undo creates a new branch;
+// the previous branch remains reachable.
+//
+// Changes applied within an undo group
+// are merged into a single state.
+// The frames of the merged changes
+// have consecutive seqs, from the state's seq to its last seq.
+//
+// The tree is stored in logs.
+// Each state, other than the root, has an entry in the nodes log.
+// The header of the entry contains the state's seq,
+// and its span contains the offsets of the state's frames
+// in the undo and redo logs.
+// The data of the entry is a fixed-size record,
+// containing the state's parent, most recent child, time, and last seq.
+// The undo frame changes the state's text to that of its parent,
+// and the redo frame changes its parent's text to that of the state.
+type undoTree struct {
+	nodes, undo, redo *log
+	// N is the number of states, including the root.
+	n int
+	// Cur is the current state.
+	cur int
+	// Child is the most recently visited child of the root,
+	// or -1 if the root has no children.
+	child int
+	// Time is the time of the root state.
+	time time.Time
+
+	// Group is the nesting depth of undo groups.
+	group int
+	// Open is whether Apply merges changes into the current state.
+	// It is only true within an undo group.
+	open bool
+	// Applied is the state created by the most recent Apply,
+	// or -1 if the current state was since changed
+	// by Undo, Redo, or SetState.
+	applied int
+}
+
+// A node is a state of an undoTree.
+type node struct {
+	// Seq is the seq of the first frames of the state,
+	// and last is the seq of the last frames of the state.
+	seq, last int32
+	// Undo and redo are the log offsets of the state's frames.
+	undo, redo int64
+	// Parent is the parent state.
+	parent int
+	// Child is the most recently visited child state,
+	// or -1 if the state has no children.
+	child int
+	// Time is the time at which the state was created.
+	time time.Time
+}
+
+// NodeRunes is the number of runes in the data of a nodes log entry.
+const nodeRunes = 7
+
+// NodeOffs returns the offset into the nodes log
+// of the header of the entry for a state.
+func nodeOffs(i int) int64 { return int64(i-1) * (headerRunes + nodeRunes) }
+
+func newUndoTree(now time.Time) *undoTree {
+	return &undoTree{
+		nodes:   newLog(),
+		undo:    newLog(),
+		redo:    newLog(),
+		n:       1,
+		child:   -1,
+		time:    now,
+		applied: -1,
+	}
+}
+
+func (t *undoTree) close() error {
+	errs := []error{t.nodes.close(), t.undo.close(), t.redo.close()}
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Node returns the state with the given number.
+// The root state has no frames; its seqs are -1.
+func (t *undoTree) node(i int) (node, error) {
+	if i == 0 {
+		return node{seq: -1, last: -1, parent: -1, child: t.child, time: t.time}, nil
+	}
+	e := logAt(t.nodes, nodeOffs(i))
+	if e.err != nil {
+		return node{}, e.err
+	}
+	data, err := t.nodes.buf.Read(nodeRunes, e.offs+headerRunes)
+	if err != nil {
+		return node{}, err
+	}
+	return node{
+		seq:    e.seq,
+		undo:   e.span[0],
+		redo:   e.span[1],
+		parent: int(data[0])<<32 | int(uint32(data[1])),
+		child:  int(data[2])<<32 | int(uint32(data[3])),
+		time:   time.Unix(0, int64(data[4])<<32|int64(uint32(data[5]))),
+		last:   data[6],
+	}, nil
+}
+
+func (nd *node) marshal() []rune {
+	parent, child, nsec := int64(nd.parent), int64(nd.child), nd.time.UnixNano()
+	return []rune{
+		int32(parent >> 32), int32(parent & 0xFFFFFFFF),
+		int32(child >> 32), int32(child & 0xFFFFFFFF),
+		int32(nsec >> 32), int32(nsec & 0xFFFFFFFF),
+		nd.last,
+	}
+}
+
+// Add adds a new state as a child of the current state,
+// and makes it the current state.
+// The frames of the new state must be at the given offsets,
+// and have the given seq.
+func (t *undoTree) add(seq int32, undo, redo int64, now time.Time) error {
+	nd := node{seq: seq, last: seq, undo: undo, redo: redo, parent: t.cur, child: -1, time: now}
+	src := runes.SliceReader(nd.marshal())
+	if _, err := t.nodes.append(seq, Span{undo, redo}, src); err != nil {
+		return err
+	}
+	if err := t.setChild(t.cur, t.n); err != nil {
+		return err
+	}
+	t.cur = t.n
+	t.n++
+	return nil
+}
+
+// Extend merges frames with the given seq into the current state.
+// The frames must follow the state's frames in the undo and redo logs.
+func (t *undoTree) extend(seq int32) error {
+	nd, err := t.node(t.cur)
+	if err != nil {
+		return err
+	}
+	nd.last = seq
+	return t.store(t.cur, nd)
+}
+
+// SetChild sets the most recently visited child of a state.
+func (t *undoTree) setChild(i, child int) error {
+	if i == 0 {
+		t.child = child
+		return nil
+	}
+	nd, err := t.node(i)
+	if err != nil {
+		return err
+	}
+	nd.child = child
+	return t.store(i, nd)
+}
+
+// Store stores the data record of a state, other than the root.
+func (t *undoTree) store(i int, nd node) error {
+	offs := nodeOffs(i) + headerRunes
+	if err := t.nodes.buf.Delete(nodeRunes, offs); err != nil {
+		return err
+	}
+	return t.nodes.buf.Insert(nd.marshal(), offs)
+}
+
+// Path returns the states on the path from the current state to state i.
+// Up are the states from which to move to their parent,
+// beginning with the current state.
+// Down are the states to which to move from their parent,
+// ending with state i.
+func (t *undoTree) path(i int) (up, down []int, err error) {
+	ancestors := make(map[int]bool)
+	for j := i; j >= 0; {
+		ancestors[j] = true
+		nd, err := t.node(j)
+		if err != nil {
+			return nil, nil, err
+		}
+		j = nd.parent
+	}
+	j := t.cur
+	for !ancestors[j] {
+		up = append(up, j)
+		nd, err := t.node(j)
+		if err != nil {
+			return nil, nil, err
+		}
+		j = nd.parent
+	}
+	for k := i; k != j; {
+		down = append(down, k)
+		nd, err := t.node(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		k = nd.parent
+	}
+	for l, r := 0, len(down)-1; l < r; l, r = l+1, r-1 {
+		down[l], down[r] = down[r], down[l]
+	}
+	return up, down, nil
+}
+
+// StateAt returns the most recently created state
+// that was created at or before the given time.
+// If the time is before the root state, the root is returned.
+func (t *undoTree) stateAt(tm time.Time) (int, error) {
+	// States are numbered in the order created,
+	// so their times are non-decreasing.
+	lo, hi := 1, t.n
+	for lo < hi {
+		m := lo + (hi-lo)/2
+		nd, err := t.node(m)
+		if err != nil {
+			return 0, err
+		}
+		if nd.time.After(tm) {
+			hi = m
+		} else {
+			lo = m + 1
+		}
+	}
+	return lo - 1, nil
+}
+
+// Frame changes the buffer using the frames
+// with seqs from first to last, in the undo or redo log,
+// beginning at the given offset,
+// and returns the Span covering the changes.
+func (buf *Buffer) frame(l *log, first, last int32, offs int64) (Span, error) {
+	all := Span{-1, 0}
+	e := logAt(l, offs)
+	for ; !e.end() && e.seq >= first && e.seq <= last; e = e.next() {
+		if all[0] < 0 {
+			all[0] = e.span[0]
+		}
+		all[1] = e.span[0] + e.size
+		if err := buf.change(e.span, e.size, e.data()); err != nil {
+			return Span{}, err
+		}
+		if buf.moved != nil {
+			buf.moved(e.span, e.size)
+		}
+	}
+	if e.err != nil {
+		return Span{}, e.err
+	}
+	return all, nil
+}
+
+// Up changes the buffer from the current state to its parent.
+func (buf *Buffer) up() (Span, error) {
+	t := buf.tree
+	nd, err := t.node(t.cur)
+	if err != nil {
+		return Span{}, err
+	}
+	// The undo frames of merged changes
+	// must be applied in the reverse of the order of the changes.
+	type frame struct {
+		seq  int32
+		offs int64
+	}
+	var frames []frame
+	e := logAt(t.undo, nd.undo)
+	for ; !e.end() && e.seq >= nd.seq && e.seq <= nd.last; e = e.next() {
+		if len(frames) == 0 || frames[len(frames)-1].seq != e.seq {
+			frames = append(frames, frame{seq: e.seq, offs: e.offs})
+		}
+	}
+	if e.err != nil {
+		return Span{}, e.err
+	}
+	var dot Span
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		if dot, err = buf.frame(t.undo, f.seq, f.seq, f.offs); err != nil {
+			return Span{}, err
+		}
+	}
+	if err := t.setChild(nd.parent, t.cur); err != nil {
+		return Span{}, err
+	}
+	t.cur = nd.parent
+	return dot, nil
+}
+
+// Down changes the buffer from the current state
+// to the child state i.
+func (buf *Buffer) down(i int) (Span, error) {
+	t := buf.tree
+	nd, err := t.node(i)
+	if err != nil {
+		return Span{}, err
+	}
+	dot, err := buf.frame(t.redo, nd.seq, nd.last, nd.redo)
+	if err != nil {
+		return Span{}, err
+	}
+	if err := t.setChild(t.cur, i); err != nil {
+		return Span{}, err
+	}
+	t.cur = i
+	return dot, nil
+}
+
+// State returns the number of the current state.
+//
+// Every change made by Apply creates a new state,
+// numbered in the order that they were created.
+// State 0 is the initial state of the Buffer.
+func (buf *Buffer) State() int { return buf.tree.cur }
+
+// States returns the number of states.
+func (buf *Buffer) States() int { return buf.tree.n }
+
+// StateTime returns the time at which a state was created.
+// The time of state 0 is the time at which the Buffer was created.
+func (buf *Buffer) StateTime(i int) (time.Time, error) {
+	if i < 0 || i >= buf.tree.n {
+		return time.Time{}, ErrInvalidArgument
+	}
+	nd, err := buf.tree.node(i)
+	return nd.time, err
+}
+
+// StateAt returns the most recently created state
+// that was created at or before the given time.
+// If the time is before any change, 0 is returned.
+func (buf *Buffer) StateAt(t time.Time) (int, error) { return buf.tree.stateAt(t) }
+
+// SetState changes the Buffer to a state,
+// undoing changes up the tree to the nearest common ancestor
+// of the current state and the given state,
+// and redoing changes down the tree to the given state.
+// It updates all marks to reflect the changes,
+// and sets dot to the address covering the last change.
+func (buf *Buffer) SetState(i int) error {
+	if i < 0 || i >= buf.tree.n {
+		return ErrInvalidArgument
+	}
+	up, down, err := buf.tree.path(i)
+	if err != nil {
+		return err
+	}
+	if len(up) == 0 && len(down) == 0 {
+		return nil
+	}
+	return buf.move(func() (dot Span, err error) {
+		for range up {
+			if dot, err = buf.up(); err != nil {
+				return Span{}, err
+			}
+		}
+		for _, j := range down {
+			if dot, err = buf.down(j); err != nil {
+				return Span{}, err
+			}
+		}
+		return dot, nil
+	})
+}
+
+// SetMoveFunc sets a function that is called for each change
+// made to the Buffer by Undo, Redo, and SetState,
+// just after the change is made.
+// It is called with the Span of the change,
+// relative to the text before the change,
+// and the number of runes that replaced the Span.
+func (buf *Buffer) SetMoveFunc(f func(s Span, size int64)) { buf.moved = f }
+
+// Move changes the Buffer to another state of the undo tree
+// by calling f, which returns the address covering the last change.
+// Dot is set to the address,
+// but if f returns an error, all marks are restored.
+func (buf *Buffer) move(f func() (Span, error)) error {
+	marks0 := make(map[rune]Span, len(buf.marks))
+	for r, s := range buf.marks {
+		marks0[r] = s
+	}
+	defer func() { buf.marks = marks0 }()
+
+	buf.tree.open = false
+	buf.tree.applied = -1
+	dot, err := f()
+	if err != nil {
+		return err
+	}
+	buf.marks['.'] = dot
+	marks0 = buf.marks
+	buf.seq++
+	return nil
+}
+
+// BeginGroup begins an undo group.
+// The changes applied until the matching EndGroup
+// are merged into a single state of the undo tree,
+// and they are undone and redone together.
+//
+// Groups may be nested;
+// the changes are merged until the outermost group ends.
+// Undo, Redo, or SetState within a group
+// ends the state into which changes are merged;
+// the next change begins a new state.
+func (buf *Buffer) BeginGroup() {
+	if buf.tree.group == 0 {
+		buf.tree.open = false
+	}
+	buf.tree.group++
+}
+
+// ContinueGroup begins an undo group, like BeginGroup,
+// but if the current state of the undo tree
+// was created by the most recent Apply
+// and not since changed by Undo, Redo, or SetState,
+// changes are merged into the current state.
+//
+// ContinueGroup can be used to coalesce separate changes,
+// such as consecutive keystrokes, into a single state.
+func (buf *Buffer) ContinueGroup() {
+	if buf.tree.group == 0 {
+		buf.tree.open = buf.tree.applied == buf.tree.cur
+	}
+	buf.tree.group++
+}
+
+// EndGroup ends an undo group.
+// If there is no undo group, EndGroup does nothing.
+func (buf *Buffer) EndGroup() {
+	if buf.tree.group == 0 {
+		return
+	}
+	if buf.tree.group--; buf.tree.group == 0 {
+		buf.tree.open = false
+	}
+}
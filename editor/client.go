@@ -10,7 +10,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 
+	"github.com/eaburns/T/auth"
 	"github.com/eaburns/T/edit"
 	"github.com/eaburns/T/websocket"
 )
@@ -21,6 +24,18 @@ var (
 
 	// ErrRange indicates an out-of-range Address.
 	ErrRange = errors.New("bad range")
+
+	// ErrTruncated indicates that changes to a buffer
+	// are no longer in the buffer's history,
+	// or were dropped by a change stream
+	// because they were not received quickly enough.
+	// A client receiving ErrTruncated must resynchronize
+	// its copy of the buffer, for example, by reading it again.
+	ErrTruncated = errors.New("change history truncated")
+
+	// ErrStale indicates that a buffer's file
+	// was modified since the buffer last read or wrote it.
+	ErrStale = errors.New("stale file")
 )
 
 func request(url *url.URL, method string, body io.Reader, resp interface{}) error {
@@ -28,6 +43,16 @@ func request(url *url.URL, method string, body io.Reader, resp interface{}) erro
 	if err != nil {
 		return err
 	}
+	return do(httpReq, resp)
+}
+
+// Do does an HTTP request and decodes the JSON response body into resp,
+// or returns the response error.
+// If resp is nil, the response body is ignored.
+// If the URL has a token, as its user name,
+// it is sent in the Authorization header, as a bearer token.
+func do(httpReq *http.Request, resp interface{}) error {
+	auth.Authorize(httpReq)
 	httpResp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		return err
@@ -66,6 +91,63 @@ func NewBuffer(URL *url.URL) (Buffer, error) {
 	return buf, nil
 }
 
+// NewFileBuffer does a PUT and returns a Buffer from the response body.
+// The buffer is associated with the file at the given path,
+// and its text is read from the file if it exists.
+// The URL is expected to point at an editor server's buffers list.
+func NewFileBuffer(URL *url.URL, file string) (Buffer, error) {
+	var buf Buffer
+	if err := request(withFile(URL, file), http.MethodPut, nil, &buf); err != nil {
+		return Buffer{}, err
+	}
+	return buf, nil
+}
+
+// GetFile does a POST, replacing the text of a buffer
+// with the contents of its file,
+// and returns a Buffer from the response body.
+// If file is non-empty, the buffer is first associated
+// with the file at that path.
+// The URL is expected to point at a buffer's get path.
+func GetFile(URL *url.URL, file string) (Buffer, error) {
+	var buf Buffer
+	if err := request(withFile(URL, file), http.MethodPost, nil, &buf); err != nil {
+		return Buffer{}, err
+	}
+	return buf, nil
+}
+
+// PutFile does a POST, writing the text of a buffer to its file,
+// and returns a Buffer from the response body.
+// If file is non-empty, the buffer is first associated
+// with the file at that path.
+// If the file is stale, it is only written if force is true;
+// otherwise the error is ErrStale.
+// The URL is expected to point at a buffer's put path.
+func PutFile(URL *url.URL, file string, force bool) (Buffer, error) {
+	URL = withFile(URL, file)
+	if force {
+		URL.RawQuery += "&force=true"
+	}
+	var buf Buffer
+	if err := request(URL, http.MethodPost, nil, &buf); err != nil {
+		return Buffer{}, err
+	}
+	return buf, nil
+}
+
+// WithFile returns a copy of the URL
+// with the file parameter set to file, if it is non-empty.
+func withFile(URL *url.URL, file string) *url.URL {
+	urlCopy := *URL
+	if file != "" {
+		vals := make(url.Values)
+		vals["file"] = []string{file}
+		urlCopy.RawQuery += "&" + vals.Encode()
+	}
+	return &urlCopy
+}
+
 // BufferInfo does a GET and returns a Buffer from the response body.
 // The URL is expected to point at a buffer path.
 func BufferInfo(URL *url.URL) (Buffer, error) {
@@ -78,38 +160,154 @@ func BufferInfo(URL *url.URL) (Buffer, error) {
 
 // A ChangeStream reads changes made to a buffer.
 // Methods on ChangeStream are safe for use by concurrent go routines.
+//
+// If the connection to the server is lost,
+// the ChangeStream reconnects,
+// requesting the changes after the last ChangeList that it returned.
 type ChangeStream struct {
+	url *url.URL
+
+	mu sync.Mutex
+	// Conn is the current connection.
+	// It is nil if the stream is closed.
 	conn *websocket.Conn
+	// Seq is the sequence number of the last ChangeList returned,
+	// or the since sequence number if none were returned.
+	// It is -1 if neither is known.
+	seq int
 }
 
 // Close unblocks any calls to Next and closes the stream.
-func (s *ChangeStream) Close() error { return s.conn.Close() }
+func (s *ChangeStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	conn := s.conn
+	s.conn = nil
+	return conn.Close()
+}
 
 // Next returns the next ChangeList from the stream.
 // Calling Next on a closed ChangeStream returns io.EOF.
+//
+// If the connection is lost and the ChangeLists since the last one returned
+// are no longer in the buffer's history, Next returns ErrTruncated.
+// Likewise, if the server closes the stream
+// because its ChangeLists were not received quickly enough,
+// Next returns ErrTruncated.
+// The stream is then reconnected to receive only new changes,
+// and the caller must resynchronize its copy of the buffer.
+// If the stream has not yet returned a ChangeList
+// and was not created with ChangesSince,
+// a lost connection is not resumed, and its error is returned.
 func (s *ChangeStream) Next() (ChangeList, error) {
-	var cl ChangeList
-	return cl, s.conn.Recv(&cl)
+	for {
+		s.mu.Lock()
+		conn, seq := s.conn, s.seq
+		s.mu.Unlock()
+		if conn == nil {
+			return ChangeList{}, io.EOF
+		}
+
+		var cl ChangeList
+		err := conn.Recv(&cl)
+		switch {
+		case err == nil && cl.Sequence <= seq:
+			// A replayed ChangeList that was already returned.
+			continue
+		case err == nil:
+			s.mu.Lock()
+			s.seq = cl.Sequence
+			s.mu.Unlock()
+			return cl, nil
+		case err == websocket.CloseError{Reason: resyncReason}:
+			if err := s.reconnect(conn, -1); err != nil {
+				return ChangeList{}, err
+			}
+			return ChangeList{}, ErrTruncated
+		case seq < 0:
+			return ChangeList{}, err
+		}
+		switch err := s.reconnect(conn, seq); {
+		case err == ErrNotFound:
+			// The buffer was closed.
+			return ChangeList{}, io.EOF
+		case err != nil:
+			return ChangeList{}, err
+		}
+	}
+}
+
+// Reconnect replaces the lost connection
+// with a new connection since the sequence number seq.
+// If the changes since seq are no longer in the history,
+// the new connection receives only new changes,
+// and ErrTruncated is returned.
+func (s *ChangeStream) reconnect(lost *websocket.Conn, seq int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != lost {
+		// The stream was closed.
+		return io.EOF
+	}
+	s.conn = nil
+	lost.Close()
+	conn, err := dialChanges(s.url, seq)
+	var truncErr error
+	if err == ErrTruncated {
+		truncErr = err
+		seq = -1
+		conn, err = dialChanges(s.url, seq)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn, s.seq = conn, seq
+	return truncErr
 }
 
 // Changes returns a ChangeStream that reads changes made to a buffer.
 // The URL is expected to point at the changes file of a buffer.
 // Note that the changes file is a websocket, and must use a ws scheme:
 // 	ws://host:port/buffer/<ID>/changes
-func Changes(URL *url.URL) (*ChangeStream, error) {
-	conn, err := websocket.Dial(URL)
+// The URL's query can set the units and inline parameters of the stream,
+// for example, to inline the text of changes up to 1024 bytes:
+// 	ws://host:port/buffer/<ID>/changes?inline=1024
+func Changes(URL *url.URL) (*ChangeStream, error) { return ChangesSince(URL, -1) }
+
+// ChangesSince returns a ChangeStream that reads changes made to a buffer
+// after the edit with the given sequence number.
+// If since is negative, only changes made after the stream connects are read.
+// If the changes since the sequence number
+// are no longer in the buffer's history, ErrTruncated is returned.
+// The URL is expected to point at the changes file of a buffer.
+func ChangesSince(URL *url.URL, since int) (*ChangeStream, error) {
+	conn, err := dialChanges(URL, since)
 	if err != nil {
-		if isNotFoundError(err) {
-			err = ErrNotFound
-		}
 		return nil, err
 	}
-	return &ChangeStream{conn: conn}, nil
+	return &ChangeStream{url: URL, conn: conn, seq: since}, nil
 }
 
-func isNotFoundError(err error) bool {
-	hsErr, ok := err.(websocket.HandshakeError)
-	return ok && hsErr.StatusCode == http.StatusNotFound
+// DialChanges dials a buffer's change stream.
+// If since is non-negative, it is set as the since URL parameter.
+func dialChanges(URL *url.URL, since int) (*websocket.Conn, error) {
+	urlCopy := *URL
+	if since >= 0 {
+		urlCopy.RawQuery += "&since=" + strconv.Itoa(since)
+	}
+	conn, err := websocket.Dial(&urlCopy)
+	if hsErr, ok := err.(websocket.HandshakeError); ok {
+		switch hsErr.StatusCode {
+		case http.StatusNotFound:
+			err = ErrNotFound
+		case http.StatusGone:
+			err = ErrTruncated
+		}
+	}
+	return conn, err
 }
 
 // NewEditor does a PUT and returns an Editor from the response body.
@@ -136,6 +334,7 @@ func EditorInfo(URL *url.URL) (Editor, error) {
 // If non-nil, the returned io.ReadCloser must be closed by the caller.
 // If the Address is non-nil, it is set as the value of the addr URL parameter.
 // The URL is expected to point at an editor's text path.
+// If the server reports the Address as malformed, the error is a *ParseError.
 func Reader(URL *url.URL, addr edit.Address) (io.ReadCloser, error) {
 	urlCopy := *URL
 	if addr != nil {
@@ -144,7 +343,7 @@ func Reader(URL *url.URL, addr edit.Address) (io.ReadCloser, error) {
 		urlCopy.RawQuery += "&" + vals.Encode()
 	}
 
-	httpResp, err := http.Get(urlCopy.String())
+	httpResp, err := get(&urlCopy)
 	if err != nil {
 		return nil, err
 	}
@@ -155,10 +354,97 @@ func Reader(URL *url.URL, addr edit.Address) (io.ReadCloser, error) {
 	return httpResp.Body, nil
 }
 
+// Get does a GET, sending the token of the URL, if any,
+// and returns the response.
+func get(URL *url.URL) (*http.Response, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.Authorize(httpReq)
+	return http.DefaultClient.Do(httpReq)
+}
+
+// Register does a GET and returns the text of a register
+// from the response body.
+// The URL is expected to point at an editor register path.
+func Register(URL *url.URL) ([]byte, error) {
+	httpResp, err := get(URL)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, responseError(httpResp)
+	}
+	return ioutil.ReadAll(httpResp.Body)
+}
+
+// SetRegister does a PUT, setting the text of a register.
+// The URL is expected to point at an editor register path.
+func SetRegister(URL *url.URL, text []byte) error {
+	return request(URL, http.MethodPut, bytes.NewReader(text), nil)
+}
+
+// GetMarks does a GET and returns the Marks of an editor
+// from the response body.
+// The URL is expected to point at an editor's marks path.
+func GetMarks(URL *url.URL) (Marks, error) {
+	var marks Marks
+	if err := request(URL, http.MethodGet, nil, &marks); err != nil {
+		return nil, err
+	}
+	return marks, nil
+}
+
+// SetMarks does a PUT, atomically setting the marks of an editor.
+// The URL is expected to point at an editor's marks path.
+func SetMarks(URL *url.URL, marks Marks) error {
+	body, err := json.Marshal(marks)
+	if err != nil {
+		return err
+	}
+	return request(URL, http.MethodPut, bytes.NewReader(body), nil)
+}
+
+// BeginGroup does a PUT, beginning an undo group.
+// The changes of the editor's edits until the matching EndGroup
+// are undone and redone as a whole.
+// The URL is expected to point at an editor's group path.
+func BeginGroup(URL *url.URL) error { return request(URL, http.MethodPut, nil, nil) }
+
+// EndGroup does a DELETE, ending an undo group.
+// The URL is expected to point at an editor's group path.
+func EndGroup(URL *url.URL) error { return request(URL, http.MethodDelete, nil, nil) }
+
+// Cancel does a POST, canceling the edits
+// of an editor's in-progress edit request.
+// The URL is expected to point at an editor's cancel path.
+func Cancel(URL *url.URL) error { return request(URL, http.MethodPost, nil, nil) }
+
 // Do POSTs a sequence of edits and returns a list of the EditResults
 // from the response body.
 // The URL is expected to point at an editor path.
+// If the server reports an Edit as malformed, the error is a *ParseError.
 func Do(URL *url.URL, edits ...edit.Edit) ([]EditResult, error) {
+	return doIf(URL, "", edits)
+}
+
+// DoIf POSTs a sequence of edits to perform
+// only if the buffer's sequence number is seq,
+// and returns a list of the EditResults from the response body.
+// The URL is expected to point at an editor path.
+// If the buffer's sequence number is not seq, no edits are performed,
+// and the error is a *ConflictError with the buffer's sequence number.
+// Otherwise, the edits are atomic, even if they contain a pipe edit.
+// If the server reports an Edit as malformed, the error is a *ParseError.
+func DoIf(URL *url.URL, seq int, edits ...edit.Edit) ([]EditResult, error) {
+	return doIf(URL, `"`+strconv.Itoa(seq)+`"`, edits)
+}
+
+// DoIf POSTs a sequence of edits with the given If-Match header,
+// which is not set if it is empty.
+func doIf(URL *url.URL, ifMatch string, edits []edit.Edit) ([]EditResult, error) {
 	var eds []editRequest
 	for _, ed := range edits {
 		eds = append(eds, editRequest{ed})
@@ -167,7 +453,37 @@ func Do(URL *url.URL, edits ...edit.Edit) ([]EditResult, error) {
 	if err := json.NewEncoder(body).Encode(eds); err != nil {
 		return nil, err
 	}
+	httpReq, err := http.NewRequest(http.MethodPost, URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != "" {
+		httpReq.Header.Set("If-Match", ifMatch)
+	}
 	var results []EditResult
+	if err := do(httpReq, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// DoBuffers POSTs a sequence of edits to perform on multiple buffers
+// and returns a list of the BufferEditResults from the response body.
+// The edits are performed on each buffer whose path
+// matches the regular expression match,
+// or, if exclude is true, on each buffer whose path does not match.
+// The URL is expected to point at an editor server's buffers edit path.
+// If the server reports an Edit as malformed, the error is a *ParseError.
+func DoBuffers(URL *url.URL, match string, exclude bool, edits ...edit.Edit) ([]BufferEditResult, error) {
+	be := buffersEdit{Match: match, Exclude: exclude, Edits: []string{}}
+	for _, ed := range edits {
+		be.Edits = append(be.Edits, ed.String())
+	}
+	body := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(body).Encode(be); err != nil {
+		return nil, err
+	}
+	var results []BufferEditResult
 	if err := request(URL, http.MethodPost, body, &results); err != nil {
 		return nil, err
 	}
@@ -180,8 +496,27 @@ func responseError(resp *http.Response) error {
 		return ErrNotFound
 	case http.StatusRequestedRangeNotSatisfiable:
 		return ErrRange
-	default:
-		data, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(resp.Status + ": " + string(data))
+	case http.StatusPreconditionFailed:
+		return ErrStale
+	case http.StatusConflict:
+		if resp.Header.Get("Content-Type") != "application/json" {
+			break
+		}
+		var cerr ConflictError
+		if err := json.NewDecoder(resp.Body).Decode(&cerr); err != nil {
+			return err
+		}
+		return &cerr
+	case http.StatusBadRequest:
+		if resp.Header.Get("Content-Type") != "application/json" {
+			break
+		}
+		var perr ParseError
+		if err := json.NewDecoder(resp.Body).Decode(&perr); err != nil {
+			return err
+		}
+		return &perr
 	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	return errors.New(resp.Status + ": " + string(data))
 }
@@ -6,8 +6,11 @@ package editor
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/eaburns/T/edit"
 )
@@ -22,9 +25,23 @@ type Buffer struct {
 	// Path is the path to the buffer's resource.
 	Path string `json:"path"`
 
+	// File is the path of the file associated with the buffer.
+	// File is empty if the buffer is not associated with a file.
+	File string `json:"file,omitempty"`
+
 	// Sequence is the sequence number of the last edit on the buffer.
 	Sequence int `json:"sequence"`
 
+	// Dirty is whether the buffer has changes
+	// that have not been written to its file.
+	// A buffer associated with a file
+	// that it has not read or written is dirty.
+	Dirty bool `json:"dirty"`
+
+	// Stale is whether the buffer's file was modified, created, or removed
+	// since the buffer last read or wrote it.
+	Stale bool `json:"stale"`
+
 	// Editors containts the buffer's editors.
 	Editors []Editor `json:"editors"`
 }
@@ -51,12 +68,67 @@ func (e *editRequest) UnmarshalText(text []byte) error {
 	if e.Edit, err = edit.Ed(r); err != nil {
 		return err
 	}
-	if l := r.Len(); l != 0 {
-		return errors.New("unexpected trailing text: " + string(text[l:]))
+	// Edits that end with a command, such as pipes,
+	// are terminated by a newline.
+	if l := r.Len(); l != 0 && !(l == 1 && text[len(text)-1] == '\n') {
+		return trailingError(text, l, "end of edit")
 	}
 	return nil
 }
 
+// TrailingError returns an *edit.ParseError
+// for the unexpected, trailing n bytes of text.
+func trailingError(text []byte, n int, expected string) error {
+	left := string(text[len(text)-n:])
+	return &edit.ParseError{
+		Offset:   int64(utf8.RuneCount(text[:len(text)-n])),
+		Token:    left,
+		Expected: expected,
+		Err:      errors.New("unexpected trailing text: " + left),
+	}
+}
+
+// A ParseError describes a malformed Edit or Address.
+// It is the body of the Bad Request response
+// to a malformed Edit list or addr parameter.
+type ParseError struct {
+	// Edit is the index of the malformed Edit in the Edit list.
+	// For a malformed address, Edit is 0.
+	Edit int `json:"edit"`
+
+	// Offset is the offset, in runes, into the Edit or Address
+	// at which the malformed token begins.
+	Offset int64 `json:"offset"`
+
+	// Token is the malformed token.
+	Token string `json:"token"`
+
+	// Expected describes what was expected at Offset.
+	Expected string `json:"expected"`
+
+	// Message is the error message.
+	Message string `json:"message"`
+}
+
+func (err *ParseError) Error() string {
+	return "edit " + strconv.Itoa(err.Edit) + ": #" +
+		strconv.FormatInt(err.Offset, 10) + ": " + err.Message
+}
+
+// A ConflictError describes an edit list
+// that was not performed, because the buffer's sequence number
+// was not the expected sequence number.
+// It is the body of the Conflict response
+// to an edit list with an unexpected sequence number.
+type ConflictError struct {
+	// Sequence is the sequence number of the buffer.
+	Sequence int `json:"sequence"`
+}
+
+func (err *ConflictError) Error() string {
+	return "conflict: buffer sequence is " + strconv.Itoa(err.Sequence)
+}
+
 // An EditResult is result of performing an edito on a buffer.
 type EditResult struct {
 	// Sequence is the sequence number unique to the edit.
@@ -69,6 +141,15 @@ type EditResult struct {
 	Error string `json:"error,omitempty"`
 }
 
+// A BufferEditResult is the result of performing edits on one of multiple buffers.
+type BufferEditResult struct {
+	// Buffer describes the buffer after the edits.
+	Buffer Buffer `json:"buffer"`
+
+	// Results contains the results of the edits.
+	Results []EditResult `json:"results"`
+}
+
 // A ChangeList is an atomic sequence of changes
 // made by an edit to a buffer.
 type ChangeList struct {
@@ -79,27 +160,109 @@ type ChangeList struct {
 	// Changes contains the changes made by an edit.
 	// The changes are in the sequence applied to the buffer.
 	Changes []Change `json:"changes"`
+
+	// Marks are the marks of the change stream's editor,
+	// just after the changes were applied,
+	// in the units of the change stream.
+	// Marks is only set if the change stream was requested
+	// with an editor, and not for replayed ChangeLists.
+	Marks Marks `json:"marks,omitempty"`
+
+	// Reload is whether the ChangeList replaces ChangeLists
+	// that the change stream dropped,
+	// because they were not received quickly enough.
+	// A reload ChangeList has no Changes;
+	// its Sequence is that of the last dropped ChangeList.
+	// A client receiving a reload ChangeList must resynchronize
+	// its copy of the buffer, for example, by reading it again.
+	Reload bool `json:"reload,omitempty"`
+}
+
+// Marks maps mark names to the Spans of the marks.
+// In JSON, it is an object with a single-rune string key for each mark.
+type Marks map[rune]edit.Span
+
+// MarshalJSON implements json.Marshaler.
+func (ms Marks) MarshalJSON() ([]byte, error) {
+	obj := make(map[string]edit.Span, len(ms))
+	for m, s := range ms {
+		obj[string(m)] = s
+	}
+	return json.Marshal(obj)
 }
 
-// MaxInline is the maximum size, in bytes, for which Change.Text is set.
+// UnmarshalJSON implements json.Unmarshaler.
+// It returns an error if a key is not a single rune.
+func (ms *Marks) UnmarshalJSON(data []byte) error {
+	var obj map[string]edit.Span
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*ms = make(Marks, len(obj))
+	for k, s := range obj {
+		m, w := utf8.DecodeRuneInString(k)
+		if w == 0 || w != len(k) {
+			return errors.New("bad mark name: " + k)
+		}
+		(*ms)[m] = s
+	}
+	return nil
+}
+
+// MaxInline is the default maximum size, in bytes,
+// for which Change.Text is set.
 const MaxInline = 8
 
+// MaxInlineLimit is the largest maximum size, in bytes,
+// for which a change stream can request that Change.Text is set.
+const MaxInlineLimit = 1 << 16
+
 // A Change is a single change made to a string of a buffer.
 type Change struct {
 	// Span identifies the string of the buffer that was changed.
 	//
-	// The units of the Span are runes;
-	// the first is the inclusive starting rune index,
-	// and the second is the exclusive ending rune index.
-	//
-	// NOTE: in the future, we plan to change Span to use byte indices.
+	// The units of the Span are runes,
+	// or bytes of the UTF-8 encoding of the buffer
+	// if the change stream was requested with units=bytes;
+	// the first is the inclusive starting index,
+	// and the second is the exclusive ending index.
 	edit.Span `json:"span"`
 
-	// NewSize is the size, in runes, to which the span changed.
+	// NewSize is the size, in the units of Span, to which the span changed.
 	NewSize int64 `json:"newSize"`
 
 	// Text is the text to which the span changed.
 	// Text is not set if the either new text size is 0
-	// or greater than MaxInline bytes.
+	// or greater than the maximum inline size of the change stream,
+	// which is MaxInline bytes unless the stream requested otherwise.
 	Text []byte `json:"text"`
+
+	// Bytes and newBytes are the Span and NewSize in bytes.
+	bytes    edit.Span
+	newBytes int64
+}
+
+// InBytes returns a copy of the ChangeList
+// with the Span and NewSize of each Change in bytes.
+func (cl ChangeList) inBytes() ChangeList {
+	cs := make([]Change, len(cl.Changes))
+	for i, c := range cl.Changes {
+		c.Span, c.NewSize = c.bytes, c.newBytes
+		cs[i] = c
+	}
+	return ChangeList{Sequence: cl.Sequence, Changes: cs, Marks: cl.Marks, Reload: cl.Reload}
+}
+
+// Inline returns a copy of the ChangeList
+// with the Text of each Change set only if
+// the entire new text, of at most n bytes, is known.
+func (cl ChangeList) inline(n int) ChangeList {
+	cs := make([]Change, len(cl.Changes))
+	for i, c := range cl.Changes {
+		if c.newBytes > int64(n) || int64(len(c.Text)) != c.newBytes {
+			c.Text = nil
+		}
+		cs[i] = c
+	}
+	return ChangeList{Sequence: cl.Sequence, Changes: cs, Marks: cl.Marks, Reload: cl.Reload}
 }
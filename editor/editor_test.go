@@ -3,19 +3,34 @@
 package editor
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unicode/utf8"
 
+	"github.com/eaburns/T/auth"
 	"github.com/eaburns/T/edit"
 	"github.com/eaburns/T/editor/editortest"
+	"github.com/eaburns/T/websocket"
+	"github.com/gorilla/mux"
 )
 
 type bufferSlice []Buffer
@@ -162,6 +177,348 @@ func TestCloseBuffer_ClosesEditors(t *testing.T) {
 	}
 }
 
+func TestNewFileBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("Hello, 世界"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, _, 0600)=%v", file, err)
+	}
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	tests := []struct {
+		file     string
+		sequence int
+		text     string
+	}{
+		{file: file, sequence: 1, text: "Hello, 世界"},
+		{file: filepath.Join(dir, "notexist"), sequence: 0, text: ""},
+	}
+	for _, test := range tests {
+		buf, err := NewFileBuffer(buffersURL, test.file)
+		if err != nil || buf.File != test.file || buf.Sequence != test.sequence {
+			t.Errorf("NewFileBuffer(%q, %q)=%v,%v, want {File: %q, Sequence: %d},nil",
+				buffersURL, test.file, buf, err, test.file, test.sequence)
+			continue
+		}
+		if text := bufferText(t, s, buf); text != test.text {
+			t.Errorf("buffer text=%q, want %q", text, test.text)
+		}
+	}
+
+	dirFile := filepath.Join(dir, "dir")
+	if err := os.Mkdir(dirFile, 0700); err != nil {
+		t.Fatalf("os.Mkdir(%q, 0700)=%v", dirFile, err)
+	}
+	if buf, err := NewFileBuffer(buffersURL, dirFile); err == nil {
+		t.Errorf("NewFileBuffer(%q, %q)=%v,nil, want _,non-nil", buffersURL, dirFile, buf)
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	getURL := s.PathURL(buf.Path, "get")
+
+	// No file.
+	if got, err := GetFile(getURL, ""); err == nil {
+		t.Errorf("GetFile(%q, \"\")=%v,nil, want _,non-nil", getURL, got)
+	}
+	// File not found.
+	if got, err := GetFile(getURL, file); err != ErrNotFound {
+		t.Errorf("GetFile(%q, %q)=%v,%v, want _,%v", getURL, file, got, err, ErrNotFound)
+	}
+
+	for i, text := range []string{"Hello, 世界", "", "Hello\nWorld\n"} {
+		if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile(%q, _, 0600)=%v", file, err)
+		}
+		// The first get binds the buffer to the file.
+		f := ""
+		if i == 0 {
+			f = file
+		}
+		got, err := GetFile(getURL, f)
+		if err != nil || got.File != file || got.Sequence != i+1 {
+			t.Errorf("GetFile(%q, %q)=%v,%v, want {File: %q, Sequence: %d},nil",
+				getURL, f, got, err, file, i+1)
+			continue
+		}
+		if got := bufferText(t, s, buf); got != text {
+			t.Errorf("buffer text=%q, want %q", got, text)
+		}
+	}
+
+	// A failed get does not rebind the buffer.
+	missing := filepath.Join(dir, "missing")
+	if got, err := GetFile(getURL, missing); err != ErrNotFound {
+		t.Errorf("GetFile(%q, %q)=%v,%v, want _,%v", getURL, missing, got, err, ErrNotFound)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	if got, err := BufferInfo(bufferURL); err != nil || got.File != file || got.Dirty {
+		t.Errorf("BufferInfo(%q)=%v,%v, want {File: %q, Dirty: false},nil", bufferURL, got, err, file)
+	}
+
+	notFoundURL := s.PathURL("/", "buffer", "notfound", "get")
+	if got, err := GetFile(notFoundURL, file); err != ErrNotFound {
+		t.Errorf("GetFile(%q, %q)=%v,%v, want _,%v", notFoundURL, file, got, err, ErrNotFound)
+	}
+}
+
+func TestPutFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("old text"), 0640); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, _, 0640)=%v", file, err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatalf("os.Symlink(%q, %q)=%v", file, link, err)
+	}
+	newFile := filepath.Join(dir, "new")
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	putURL := s.PathURL(buf.Path, "put")
+
+	// No file.
+	if got, err := PutFile(putURL, "", false); err == nil {
+		t.Errorf("PutFile(%q, \"\")=%v,nil, want _,non-nil", putURL, got)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	textURL := s.PathURL(ed.Path, "text")
+
+	tests := []struct {
+		file, text string
+		// Bound is the file associated with the buffer after the put.
+		bound string
+		// Path is the path of the file written by the put.
+		path string
+		mode os.FileMode
+	}{
+		{file: file, text: "Hello, 世界", bound: file, path: file, mode: 0640},
+		{file: "", text: "Hello\nWorld\n", bound: file, path: file, mode: 0640},
+		{file: link, text: "link", bound: link, path: file, mode: 0640},
+		{file: newFile, text: "new", bound: newFile, path: newFile, mode: 0644},
+	}
+	for _, test := range tests {
+		edits := []edit.Edit{edit.Change(edit.All, test.text)}
+		if _, err := Do(textURL, edits...); err != nil {
+			t.Fatalf("Do(%q, %v...)=_,%v, want _,nil", textURL, edits, err)
+		}
+		got, err := PutFile(putURL, test.file, false)
+		if err != nil || got.File != test.bound {
+			t.Errorf("PutFile(%q, %q)=%v,%v, want {File: %q},nil", putURL, test.file, got, err, test.bound)
+			continue
+		}
+		data, err := ioutil.ReadFile(test.path)
+		if err != nil || string(data) != test.text {
+			t.Errorf("ioutil.ReadFile(%q)=%q,%v, want %q,nil", test.path, data, err, test.text)
+		}
+		info, err := os.Stat(test.path)
+		if err != nil || info.Mode() != test.mode {
+			t.Errorf("os.Stat(%q)=%v,%v, want mode %v,nil", test.path, info.Mode(), err, test.mode)
+		}
+	}
+
+	// A failed put does not rebind the buffer.
+	badFile := filepath.Join(dir, "nodir", "file")
+	if got, err := PutFile(putURL, badFile, false); err == nil {
+		t.Errorf("PutFile(%q, %q)=%v,nil, want _,non-nil", putURL, badFile, got)
+	}
+	if got, err := BufferInfo(bufferURL); err != nil || got.File != newFile {
+		t.Errorf("BufferInfo(%q)=%v,%v, want {File: %q},nil", bufferURL, got, err, newFile)
+	}
+
+	// The link is still a link, and no temporary files are left behind.
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("os.Lstat(%q)=%v,%v, want a symbolic link", link, info, err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil || len(infos) != 3 {
+		t.Errorf("ioutil.ReadDir(%q)=%v,%v, want 3 files", dir, infos, err)
+	}
+}
+
+func TestDirtyStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("Hello"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, _, 0600)=%v", file, err)
+	}
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewFileBuffer(buffersURL, file)
+	if err != nil {
+		t.Fatalf("NewFileBuffer(%q, %q)=%v,%v, want _,nil", buffersURL, file, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	putURL := s.PathURL(buf.Path, "put")
+	getURL := s.PathURL(buf.Path, "get")
+
+	do := func(e edit.Edit) func() error {
+		return func() error {
+			_, err := Do(textURL, e)
+			return err
+		}
+	}
+	writeFile := func(text string) func() error {
+		return func() error { return ioutil.WriteFile(file, []byte(text), 0600) }
+	}
+	// WriteFileTime writes the file and sets its modification time
+	// to a number of days from now,
+	// so that it differs even if the file system's times are coarse.
+	writeFileTime := func(text string, days int) func() error {
+		return func() error {
+			if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+				return err
+			}
+			t := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+			return os.Chtimes(file, t, t)
+		}
+	}
+	tests := []struct {
+		name         string
+		do           func() error
+		dirty, stale bool
+	}{
+		{name: "loaded", do: func() error { return nil }},
+		{name: "print", do: do(edit.Print(edit.All))},
+		{name: "change", do: do(edit.Append(edit.All, ", World")), dirty: true},
+		{
+			name: "put",
+			do: func() error {
+				_, err := PutFile(putURL, "", false)
+				return err
+			},
+		},
+		{name: "undo", do: do(edit.Undo(1)), dirty: true},
+		{name: "modify file", do: writeFile("Hello, 世界"), dirty: true, stale: true},
+		{
+			name: "put stale",
+			do: func() error {
+				if _, err := PutFile(putURL, "", false); err != ErrStale {
+					return fmt.Errorf("PutFile(%q, \"\", false)=_,%v, want _,%v", putURL, err, ErrStale)
+				}
+				return nil
+			},
+			dirty: true,
+			stale: true,
+		},
+		{
+			name: "put stale force",
+			do: func() error {
+				_, err := PutFile(putURL, "", true)
+				return err
+			},
+		},
+		{
+			name: "touch file",
+			do: func() error {
+				tomorrow := time.Now().Add(24 * time.Hour)
+				return os.Chtimes(file, tomorrow, tomorrow)
+			},
+		},
+		// The file is "Hello", written by put stale force.
+		{name: "modify file same size", do: writeFileTime("Jello", 2), stale: true},
+		{name: "restore file", do: writeFileTime("Hello", 3)},
+		{name: "remove file", do: func() error { return os.Remove(file) }, stale: true},
+		{name: "create file", do: writeFile("Hi"), stale: true},
+		{
+			name: "get",
+			do: func() error {
+				_, err := GetFile(getURL, "")
+				return err
+			},
+		},
+		{name: "change again", do: do(edit.Append(edit.All, "!")), dirty: true},
+		{
+			name: "put other file",
+			do: func() error {
+				_, err := PutFile(putURL, filepath.Join(dir, "other"), false)
+				return err
+			},
+		},
+	}
+	for _, test := range tests {
+		if err := test.do(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got, err := BufferInfo(bufferURL)
+		if err != nil || got.Dirty != test.dirty || got.Stale != test.stale {
+			t.Errorf("%s: BufferInfo(%q)=%+v,%v, want {Dirty: %v, Stale: %v},nil",
+				test.name, bufferURL, got, err, test.dirty, test.stale)
+		}
+	}
+}
+
+// BufferText returns the text of a buffer, read using a new editor.
+func bufferText(t *testing.T, s *editortest.Server, buf Buffer) string {
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	defer Close(s.PathURL(ed.Path))
+	textURL := s.PathURL(ed.Path, "text")
+	r, err := Reader(textURL, nil)
+	if err != nil {
+		t.Fatalf("Reader(%q, nil)=_,%v, want _,nil", textURL, err)
+	}
+	defer r.Close()
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(Reader(%q, nil))=_,%v, want _,nil", textURL, err)
+	}
+	return string(text)
+}
+
 func TestNewEditor(t *testing.T) {
 	s := editortest.NewServer(NewServer())
 	defer s.Close()
@@ -332,6 +689,66 @@ func TestDo_Nothing(t *testing.T) {
 	}
 }
 
+func TestDo_Bytes(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+
+	textURL := s.PathURL(ed.Path, "text")
+	edits := []edit.Edit{edit.Append(edit.All, "Hello, 世界!")}
+	if res, err := Do(textURL, edits...); err != nil {
+		t.Fatalf("Do(%q, %v...)=%v,%v, want _,nil", textURL, edits, res, err)
+	}
+
+	bytesURL := *textURL
+	bytesURL.RawQuery = "units=bytes"
+	edits = []edit.Edit{
+		edit.Where(edit.Regexp("世界")),              // 2
+		edit.Print(edit.Byte(7).To(edit.Byte(10))), // 3
+		edit.Change(edit.Byte(10), "_"),            // 4
+		edit.Where(edit.Dot),                       // 5
+		edit.Print(edit.All),                       // 6
+	}
+	want := []EditResult{
+		{Sequence: 2, Print: "#7,#13\n"},
+		{Sequence: 3, Print: "世"},
+		{Sequence: 4},
+		{Sequence: 5, Print: "#10,#11\n"},
+		{Sequence: 6, Print: "Hello, 世_界!"},
+	}
+	got, err := Do(&bytesURL, edits...)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", &bytesURL, edits, got, err, want)
+	}
+
+	// Rune units are the default.
+	runesURL := *textURL
+	runesURL.RawQuery = "units=runes"
+	edits = []edit.Edit{edit.Where(edit.Regexp("界"))}
+	want = []EditResult{{Sequence: 7, Print: "#9,#10\n"}}
+	got, err = Do(&runesURL, edits...)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", &runesURL, edits, got, err, want)
+	}
+
+	badUnitsURL := *textURL
+	badUnitsURL.RawQuery = "units=lines"
+	if got, err := Do(&badUnitsURL, edits...); err == nil {
+		t.Errorf("Do(%q, %v...)=%v,%v, want _,<non-nil>", &badUnitsURL, edits, got, err)
+	}
+}
+
 func TestDo_NotFound(t *testing.T) {
 	s := editortest.NewServer(NewServer())
 	defer s.Close()
@@ -373,7 +790,13 @@ func TestDo_BadRequest(t *testing.T) {
 	}
 }
 
-func TestEditorEdit_UpdateMarks(t *testing.T) {
+// A badEdit is an edit.Edit with a malformed String.
+type badEdit string
+
+func (e badEdit) String() string                  { return string(e) }
+func (e badEdit) Do(edit.Editor, io.Writer) error { panic("unimplemented") }
+
+func TestDo_ParseError(t *testing.T) {
 	s := editortest.NewServer(NewServer())
 	defer s.Close()
 
@@ -389,29 +812,49 @@ func TestEditorEdit_UpdateMarks(t *testing.T) {
 		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
 	}
 
-	const hi = "Hello, 世界!"
-	edits := []edit.Edit{
-		edit.Append(edit.All, hi),
-		edit.Set(edit.Regexp("世界"), 'm'),
-		edit.Change(edit.Regexp("Hello"), "hi"),
-		edit.Print(edit.Mark('.')),
-		edit.Print(edit.Mark('m')),
-	}
-	want := []EditResult{
-		{Sequence: 1},
-		{Sequence: 2},
-		{Sequence: 3},
-		{Sequence: 4, Print: "hi"},
-		{Sequence: 5, Print: "世界"},
-	}
 	textURL := s.PathURL(ed.Path, "text")
-	got, err := Do(textURL, edits...)
-	if err != nil || !reflect.DeepEqual(got, want) {
-		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", textURL, edits, got, err, want)
+	tests := []struct {
+		edits []edit.Edit
+		want  *ParseError
+	}{
+		{
+			edits: []edit.Edit{badEdit("#0 z")},
+			want: &ParseError{
+				Offset:   3,
+				Token:    "z",
+				Expected: "command",
+				Message:  "unknown command: z",
+			},
+		},
+		{
+			edits: []edit.Edit{edit.Print(edit.All), badEdit("1,/α*/+/**/d")},
+			want: &ParseError{
+				Edit:     1,
+				Offset:   8,
+				Token:    "**",
+				Expected: "regular expression",
+				Message:  "error parsing regexp: missing argument to repetition operator: `*`",
+			},
+		},
+		{
+			edits: []edit.Edit{badEdit("c/α/leftover")},
+			want: &ParseError{
+				Offset:   4,
+				Token:    "leftover",
+				Expected: "end of edit",
+				Message:  "unexpected trailing text: leftover",
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := Do(textURL, test.edits...)
+		if !reflect.DeepEqual(err, test.want) {
+			t.Errorf("Do(%q, %v...)=%v,%#v, want nil,%#v", textURL, test.edits, got, err, test.want)
+		}
 	}
 }
 
-func TestEditorEdit_MultipleEditors(t *testing.T) {
+func TestDoIf(t *testing.T) {
 	s := editortest.NewServer(NewServer())
 	defer s.Close()
 
@@ -422,67 +865,1597 @@ func TestEditorEdit_MultipleEditors(t *testing.T) {
 	}
 
 	bufferURL := s.PathURL(buf.Path)
-
-	ed0, err := NewEditor(bufferURL)
-	if err != nil {
-		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
-	}
-	text0URL := s.PathURL(ed0.Path, "text")
-
-	ed1, err := NewEditor(bufferURL)
+	ed, err := NewEditor(bufferURL)
 	if err != nil {
 		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
 	}
-	text1URL := s.PathURL(ed1.Path, "text")
 
-	const hi = "Hello, 世界!"
-	edits := []edit.Edit{
-		edit.Append(edit.All, hi),        // 1
-		edit.Set(edit.Regexp("世界"), 'm'), // 2
+	textURL := s.PathURL(ed.Path, "text")
+	e := edit.Append(edit.All, "a")
+	if got, err := DoIf(textURL, 0, e); err != nil || len(got) != 1 || got[0].Sequence != 1 {
+		t.Errorf("DoIf(%q, 0, %v)=%v,%v, want [{Sequence: 1}],nil", textURL, e, got, err)
+	}
+	want := &ConflictError{Sequence: 1}
+	if got, err := DoIf(textURL, 0, e); !reflect.DeepEqual(err, want) {
+		t.Errorf("DoIf(%q, 0, %v)=%v,%v, want nil,%v", textURL, e, got, err, want)
+	}
+	if text := bufferText(t, s, buf); text != "a" {
+		t.Errorf("buffer text=%q, want %q", text, "a")
+	}
+
+	tests := []struct {
+		ifMatch, body string
+		status        int
+		etag          string
+	}{
+		{body: `["a/b/"]`, status: http.StatusOK, etag: `"2"`},
+		{ifMatch: `*`, body: `["a/c/"]`, status: http.StatusOK, etag: `"3"`},
+		{ifMatch: `"3"`, body: `["a/d/"]`, status: http.StatusOK, etag: `"4"`},
+		{ifMatch: `"0", "4"`, body: `["a/e/"]`, status: http.StatusOK, etag: `"5"`},
+		{ifMatch: `"4"`, body: `["a/f/"]`, status: http.StatusConflict, etag: `"5"`},
+		{body: `{"sequence": 5, "edits": ["a/f/"]}`, status: http.StatusOK, etag: `"6"`},
+		{body: `{"sequence": 5, "edits": ["a/g/"]}`, status: http.StatusConflict, etag: `"6"`},
+		{ifMatch: `"6"`, body: `{"sequence": 5, "edits": ["a/g/"]}`, status: http.StatusConflict, etag: `"6"`},
+		{ifMatch: `"5"`, body: `{"sequence": 6, "edits": ["a/g/"]}`, status: http.StatusConflict, etag: `"6"`},
+		{body: `{"edits": ["a/g/"]}`, status: http.StatusOK, etag: `"7"`},
+		{ifMatch: `seven`, body: `["a/h/"]`, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, textURL.String(), strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("http.NewRequest(%v, %q, %q)=_,%v, want _,nil", http.MethodPost, textURL, test.body, err)
+		}
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.DefaultClient.Do(%v %v)=_,%v, want _,nil", req.Method, req.URL, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("ETag") != test.etag {
+			t.Errorf("If-Match: %s, body: %s: status=%d, ETag=%s, want %d, %s",
+				test.ifMatch, test.body, resp.StatusCode, resp.Header.Get("ETag"), test.status, test.etag)
+		}
 	}
-	if _, err := Do(text0URL, edits...); err != nil {
-		t.Errorf("Do(%q, %v...)=_,%v, want _,nil", text0URL, edits, err)
+	if text := bufferText(t, s, buf); text != "abcdefg" {
+		t.Errorf("buffer text=%q, want %q", text, "abcdefg")
 	}
+}
 
-	edits = []edit.Edit{
-		edit.Change(edit.Regexp("Hello"), "hi"), // 3
-	}
-	if _, err := Do(text1URL, edits...); err != nil {
-		t.Errorf("Do(%q, %v...)=_,%v, want _,nil", text1URL, edits, err)
-	}
+func TestDoBuffers(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
 
-	edits = []edit.Edit{
-		edit.Print(edit.Mark('.')),        // 4
-		edit.Print(edit.Mark('m')),        // 5
-		edit.Insert(edit.Line(0), "Oh, "), // 6
-	}
-	want := []EditResult{
-		{Sequence: 4, Print: ", 世界!"},
-		{Sequence: 5, Print: "世界"},
-		{Sequence: 6},
-	}
-	if got, err := Do(text0URL, edits...); err != nil || !reflect.DeepEqual(got, want) {
-		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", text0URL, edits, got, err, want)
+	buffersURL := s.PathURL("/", "buffers")
+	var bufs []Buffer
+	for i := 0; i < 3; i++ {
+		buf, err := NewBuffer(buffersURL)
+		if err != nil {
+			t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+		}
+		bufs = append(bufs, buf)
 	}
 
-	edits = []edit.Edit{
-		edit.Print(edit.Mark('.')), // 7
-		edit.Print(edit.All),       // 8
-	}
+	editURL := s.PathURL("/", "buffers", "edit")
+	tests := []struct {
+		match   string
+		exclude bool
+		edits   []edit.Edit
+		want    []BufferEditResult
+	}{
+		{
+			match: "/buffer/[02]$",
+			edits: []edit.Edit{edit.Append(edit.All, "x"), edit.Print(edit.Dot)},
+			want: []BufferEditResult{
+				{
+					Buffer:  Buffer{ID: bufs[0].ID, Path: bufs[0].Path, Sequence: 2, Dirty: true},
+					Results: []EditResult{{Sequence: 1}, {Sequence: 2, Print: "x"}},
+				},
+				{
+					Buffer:  Buffer{ID: bufs[2].ID, Path: bufs[2].Path, Sequence: 2, Dirty: true},
+					Results: []EditResult{{Sequence: 1}, {Sequence: 2, Print: "x"}},
+				},
+			},
+		},
+		{
+			match:   "/buffer/[02]$",
+			exclude: true,
+			edits:   []edit.Edit{edit.Append(edit.All, "y"), edit.Print(edit.Dot)},
+			want: []BufferEditResult{
+				{
+					Buffer:  Buffer{ID: bufs[1].ID, Path: bufs[1].Path, Sequence: 2, Dirty: true},
+					Results: []EditResult{{Sequence: 1}, {Sequence: 2, Print: "y"}},
+				},
+			},
+		},
+		{
+			match: "",
+			edits: []edit.Edit{edit.Print(edit.All)},
+			want: []BufferEditResult{
+				{
+					Buffer:  Buffer{ID: bufs[0].ID, Path: bufs[0].Path, Sequence: 3, Dirty: true},
+					Results: []EditResult{{Sequence: 3, Print: "x"}},
+				},
+				{
+					Buffer:  Buffer{ID: bufs[1].ID, Path: bufs[1].Path, Sequence: 3, Dirty: true},
+					Results: []EditResult{{Sequence: 3, Print: "y"}},
+				},
+				{
+					Buffer:  Buffer{ID: bufs[2].ID, Path: bufs[2].Path, Sequence: 3, Dirty: true},
+					Results: []EditResult{{Sequence: 3, Print: "x"}},
+				},
+			},
+		},
+		{
+			match: "nothing",
+			edits: []edit.Edit{edit.Print(edit.All)},
+			want:  []BufferEditResult{},
+		},
+	}
+	for _, test := range tests {
+		got, err := DoBuffers(editURL, test.match, test.exclude, test.edits...)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("DoBuffers(%q, %q, %v, %v...)=%v,%v, want %v,nil",
+				editURL, test.match, test.exclude, test.edits, got, err, test.want)
+		}
+	}
+}
+
+func TestDoBuffers_BadRequest(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	editURL := s.PathURL("/", "buffers", "edit")
+	for _, e := range []string{
+		`not json`,
+		`{"match": "*", "edits": []}`,
+		`{"match": "", "edits": ["badEdit"]}`,
+	} {
+		req, err := http.NewRequest(http.MethodPost, editURL.String(), strings.NewReader(e))
+		if err != nil {
+			t.Fatalf("http.NewRequest(%v, %q, nil)=_,%v, want _,nil", http.MethodPost, editURL, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("http.DefaultClient.Do(%v %v)=%v,%v, want %v,nil",
+				req.Method, req.URL, resp.StatusCode, err, http.StatusBadRequest)
+		}
+	}
+
+	edits := []edit.Edit{edit.Print(edit.All), badEdit("#0 z")}
+	want := &ParseError{
+		Edit:     1,
+		Offset:   3,
+		Token:    "z",
+		Expected: "command",
+		Message:  "unknown command: z",
+	}
+	if got, err := DoBuffers(editURL, "", false, edits...); !reflect.DeepEqual(err, want) {
+		t.Errorf("DoBuffers(%q, \"\", false, %v...)=%v,%#v, want nil,%#v", editURL, edits, got, err, want)
+	}
+}
+
+func TestEditorEdit_UpdateMarks(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+
+	const hi = "Hello, 世界!"
+	edits := []edit.Edit{
+		edit.Append(edit.All, hi),
+		edit.Set(edit.Regexp("世界"), 'm'),
+		edit.Change(edit.Regexp("Hello"), "hi"),
+		edit.Print(edit.Mark('.')),
+		edit.Print(edit.Mark('m')),
+	}
+	want := []EditResult{
+		{Sequence: 1},
+		{Sequence: 2},
+		{Sequence: 3},
+		{Sequence: 4, Print: "hi"},
+		{Sequence: 5, Print: "世界"},
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	got, err := Do(textURL, edits...)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", textURL, edits, got, err, want)
+	}
+}
+
+func TestEditorEdit_MultipleEditors(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+
+	ed0, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+	text0URL := s.PathURL(ed0.Path, "text")
+
+	ed1, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+	text1URL := s.PathURL(ed1.Path, "text")
+
+	const hi = "Hello, 世界!"
+	edits := []edit.Edit{
+		edit.Append(edit.All, hi),        // 1
+		edit.Set(edit.Regexp("世界"), 'm'), // 2
+	}
+	if _, err := Do(text0URL, edits...); err != nil {
+		t.Errorf("Do(%q, %v...)=_,%v, want _,nil", text0URL, edits, err)
+	}
+
+	edits = []edit.Edit{
+		edit.Change(edit.Regexp("Hello"), "hi"), // 3
+	}
+	if _, err := Do(text1URL, edits...); err != nil {
+		t.Errorf("Do(%q, %v...)=_,%v, want _,nil", text1URL, edits, err)
+	}
+
+	edits = []edit.Edit{
+		edit.Print(edit.Mark('.')),        // 4
+		edit.Print(edit.Mark('m')),        // 5
+		edit.Insert(edit.Line(0), "Oh, "), // 6
+	}
+	want := []EditResult{
+		{Sequence: 4, Print: ", 世界!"},
+		{Sequence: 5, Print: "世界"},
+		{Sequence: 6},
+	}
+	if got, err := Do(text0URL, edits...); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", text0URL, edits, got, err, want)
+	}
+
+	edits = []edit.Edit{
+		edit.Print(edit.Mark('.')), // 7
+		edit.Print(edit.All),       // 8
+	}
 	want = []EditResult{
 		{Sequence: 7, Print: "hi"},
 		{Sequence: 8, Print: "Oh, hi, 世界!"},
 	}
-	if got, err := Do(text1URL, edits...); err != nil || !reflect.DeepEqual(got, want) {
-		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", text1URL, edits, got, err, want)
+	if got, err := Do(text1URL, edits...); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", text1URL, edits, got, err, want)
+	}
+}
+
+func TestEditorEdit_UndoLocal(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	var textURLs [2]*url.URL
+	for i := range textURLs {
+		ed, err := NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+		}
+		textURLs[i] = s.PathURL(ed.Path, "text")
+	}
+
+	tests := []struct {
+		ed    int
+		edit  edit.Edit
+		print string
+		err   string
+		want  string
+	}{
+		{ed: 0, edit: edit.Append(edit.End, "aaa"), want: "aaa"},
+		{ed: 1, edit: edit.Append(edit.End, "bbb"), want: "aaabbb"},
+		{ed: 0, edit: edit.Insert(edit.Rune(0), "x"), want: "xaaabbb"},
+		{ed: 0, edit: edit.UndoLocal(1), want: "aaabbb"},
+		{ed: 1, edit: edit.UndoLocal(1), want: "aaa"},
+		{ed: 1, edit: edit.Print(edit.Mark('.')), print: "", want: "aaa"},
+		{ed: 0, edit: edit.RedoLocal(1), want: "xaaa"},
+		{ed: 0, edit: edit.Print(edit.Mark('.')), print: "x", want: "xaaa"},
+		{ed: 0, edit: edit.UndoLocal(2), want: ""},
+		{ed: 1, edit: edit.RedoLocal(1), want: "bbb"},
+		{ed: 0, edit: edit.RedoLocal(1), want: "bbbaaa"},
+		{ed: 0, edit: edit.Print(edit.Mark('.')), print: "aaa", want: "bbbaaa"},
+
+		// Another editor changed the text of the change.
+		{ed: 1, edit: edit.Change(edit.Regexp("aa"), "AA"), want: "bbbAAa"},
+		{ed: 0, edit: edit.UndoLocal(1), err: "conflicting change", want: "bbbAAa"},
+
+		// The editor changed its own text; it can be undone.
+		{ed: 1, edit: edit.Change(edit.Regexp("A+"), "A"), want: "bbbAa"},
+		{ed: 1, edit: edit.UndoLocal(1), want: "bbbAAa"},
+		{ed: 1, edit: edit.UndoLocal(1), want: "bbbaaa"},
+
+		// A buffer-wide undo conflicts with the local undos of the text it changes.
+		{ed: 1, edit: edit.Undo(1), want: "bbbAAa"},
+		{ed: 1, edit: edit.RedoLocal(1), err: "conflicting change", want: "bbbAAa"},
+
+		// Jumping to a state of the undo tree also conflicts.
+		{ed: 0, edit: edit.Append(edit.End, "ccc"), want: "bbbAAaccc"},
+		{ed: 0, edit: edit.Jump(0), want: ""},
+		{ed: 0, edit: edit.UndoLocal(1), err: "conflicting change", want: ""},
+
+		// A buffer-wide undo does not conflict with other local undos.
+		{ed: 0, edit: edit.Append(edit.End, "aaa"), want: "aaa"},
+		{ed: 1, edit: edit.Append(edit.End, "bbb"), want: "aaabbb"},
+		{ed: 1, edit: edit.Undo(1), want: "aaa"},
+		{ed: 1, edit: edit.UndoLocal(1), err: "conflicting change", want: "aaa"},
+		{ed: 0, edit: edit.UndoLocal(1), want: ""},
+		{ed: 0, edit: edit.RedoLocal(1), want: "aaa"},
+
+		// A buffer-wide undo that re-inserts deleted text
+		// conflicts with the local undo of the deletion.
+		{ed: 1, edit: edit.Delete(edit.All), want: ""},
+		{ed: 1, edit: edit.Undo(1), want: "aaa"},
+		{ed: 1, edit: edit.UndoLocal(1), err: "conflicting change", want: "aaa"},
+	}
+	for i, test := range tests {
+		textURL := textURLs[test.ed]
+		results, err := Do(textURL, test.edit)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("%d: Do(%q, %v)=%v,%v, want 1 result,nil", i, textURL, test.edit, results, err)
+		}
+		if r := results[0]; r.Print != test.print || r.Error != test.err {
+			t.Errorf("%d: Do(%q, %v)=%v, want print %q, error %q", i, textURL, test.edit, r, test.print, test.err)
+		}
+		if text := bufferText(t, s, buf); text != test.want {
+			t.Errorf("%d: after %v, text=%q, want %q", i, test.edit, text, test.want)
+		}
+	}
+}
+
+func TestEditorTrim(t *testing.T) {
+	batch := func(id, n int) localBatch {
+		return localBatch{id: id, changes: make([]localChange, n)}
+	}
+	ids := func(stack []localBatch) []int {
+		var ids []int
+		for _, b := range stack {
+			ids = append(ids, b.id)
+		}
+		return ids
+	}
+	tests := []struct {
+		undos, redos []localBatch
+		want         []int
+	}{
+		{undos: nil, want: nil},
+		{undos: []localBatch{batch(1, 1), batch(2, 1)}, want: []int{1, 2}},
+		{undos: []localBatch{batch(1, maxLocalChanges)}, want: []int{1}},
+		{undos: []localBatch{batch(1, 1), batch(2, maxLocalChanges)}, want: []int{2}},
+		{undos: []localBatch{batch(1, 1), batch(2, maxLocalChanges-1)}, want: []int{1, 2}},
+		{undos: []localBatch{batch(1, maxLocalChanges+1)}, want: nil},
+		{undos: []localBatch{batch(1, 1), batch(2, maxLocalChanges+1)}, want: nil},
+		{
+			undos: []localBatch{batch(1, 1), batch(2, 1)},
+			redos: []localBatch{batch(3, maxLocalChanges-1)},
+			want:  []int{2},
+		},
+	}
+	for _, test := range tests {
+		ed := &editor{undos: test.undos, redos: test.redos}
+		ed.trim()
+		if got := ids(ed.undos); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("trim(undos=%v, redos=%v)=%v, want %v",
+				ids(test.undos), ids(test.redos), got, test.want)
+		}
+	}
+}
+
+func TestEditorEdit_Coalesce(t *testing.T) {
+	editorServer := NewServer()
+	s := editortest.NewServer(editorServer)
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	var textURLs [2]*url.URL
+	for i := range textURLs {
+		ed, err := NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+		}
+		textURLs[i] = s.PathURL(ed.Path, "text")
+	}
+
+	tests := []struct {
+		ed   int
+		edit edit.Edit
+		want string
+		// Coalesce is whether to coalesce insertions.
+		coalesce bool
+	}{
+		{ed: 0, edit: edit.Append(edit.End, "a"), want: "a", coalesce: true},
+		{ed: 0, edit: edit.Append(edit.End, "b"), want: "ab", coalesce: true},
+		{ed: 0, edit: edit.Append(edit.End, "c"), want: "abc", coalesce: true},
+		{ed: 0, edit: edit.Undo(1), want: "", coalesce: true},
+		{ed: 0, edit: edit.Redo(1), want: "abc", coalesce: true},
+
+		// Insertions by other editors are not coalesced.
+		{ed: 1, edit: edit.Append(edit.End, "d"), want: "abcd", coalesce: true},
+		{ed: 0, edit: edit.Append(edit.End, "e"), want: "abcde", coalesce: true},
+		{ed: 0, edit: edit.Undo(1), want: "abcd", coalesce: true},
+		{ed: 0, edit: edit.Undo(1), want: "abc", coalesce: true},
+
+		// Non-adjacent insertions are not coalesced.
+		{ed: 0, edit: edit.Append(edit.End, "f"), want: "abcf", coalesce: true},
+		{ed: 0, edit: edit.Insert(edit.Rune(0), "g"), want: "gabcf", coalesce: true},
+		{ed: 0, edit: edit.Undo(1), want: "abcf", coalesce: true},
+
+		// Changes that delete text are not coalesced.
+		{ed: 0, edit: edit.Append(edit.End, "h"), want: "abcfh", coalesce: true},
+		{ed: 0, edit: edit.Change(edit.Regexp("h"), "i"), want: "abcfi", coalesce: true},
+		{ed: 0, edit: edit.Undo(1), want: "abcfh", coalesce: true},
+
+		// Insertions after undo are not coalesced.
+		{ed: 0, edit: edit.Append(edit.End, "j"), want: "abcfhj", coalesce: true},
+		{ed: 0, edit: edit.Undo(1), want: "abcfh", coalesce: true},
+
+		// Insertions outside of the time window are not coalesced.
+		{ed: 0, edit: edit.Append(edit.End, "k"), want: "abcfhk", coalesce: false},
+		{ed: 0, edit: edit.Append(edit.End, "l"), want: "abcfhkl", coalesce: false},
+		{ed: 0, edit: edit.Undo(1), want: "abcfhk", coalesce: false},
+	}
+	for i, test := range tests {
+		if test.coalesce {
+			editorServer.buffers[buf.ID].coalesce = time.Hour
+		} else {
+			editorServer.buffers[buf.ID].coalesce = 0
+		}
+		textURL := textURLs[test.ed]
+		results, err := Do(textURL, test.edit)
+		if err != nil || len(results) != 1 || results[0].Error != "" {
+			t.Fatalf("%d: Do(%q, %v)=%v,%v, want 1 result,nil", i, textURL, test.edit, results, err)
+		}
+		if text := bufferText(t, s, buf); text != test.want {
+			t.Errorf("%d: after %v, text=%q, want %q", i, test.edit, text, test.want)
+		}
+	}
+}
+
+func TestEditorEdit_UndoGroup(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	var textURLs, groupURLs [2]*url.URL
+	for i := range textURLs {
+		ed, err := NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+		}
+		textURLs[i] = s.PathURL(ed.Path, "text")
+		groupURLs[i] = s.PathURL(ed.Path, "group")
+	}
+
+	const (
+		begin = "begin"
+		end   = "end"
+	)
+	tests := []struct {
+		ed int
+		// Op is begin, end, or empty to perform edit.
+		op   string
+		edit edit.Edit
+		err  string
+		want string
+	}{
+		{ed: 0, edit: edit.Append(edit.End, "abc"), want: "abc"},
+		{ed: 0, op: begin, want: "abc"},
+		{ed: 0, edit: edit.Change(edit.Regexp("b"), "B"), want: "aBc"},
+		{ed: 0, edit: edit.Delete(edit.Regexp("a")), want: "Bc"},
+		{ed: 0, op: begin, want: "Bc"},
+		{ed: 0, edit: edit.Append(edit.End, "def"), want: "Bcdef"},
+		{ed: 0, op: end, want: "Bcdef"},
+		{ed: 0, edit: edit.Delete(edit.Regexp("d")), want: "Bcef"},
+		{ed: 0, op: end, want: "Bcef"},
+		{ed: 0, op: end, err: "no undo group", want: "Bcef"},
+		{ed: 0, edit: edit.Undo(1), want: "abc"},
+		{ed: 0, edit: edit.Redo(1), want: "Bcef"},
+
+		// Changes by other editors are not in the group.
+		{ed: 0, op: begin, want: "Bcef"},
+		{ed: 0, edit: edit.Delete(edit.Regexp("B")), want: "cef"},
+		{ed: 1, edit: edit.Delete(edit.Regexp("c")), want: "ef"},
+		{ed: 0, edit: edit.Delete(edit.Regexp("e")), want: "f"},
+		{ed: 0, edit: edit.Delete(edit.Regexp("f")), want: ""},
+		{ed: 0, op: end, want: ""},
+		{ed: 0, edit: edit.Undo(1), want: "ef"},
+		{ed: 0, edit: edit.Undo(1), want: "cef"},
+		{ed: 0, edit: edit.Undo(1), want: "Bcef"},
+	}
+	for i, test := range tests {
+		var err error
+		switch test.op {
+		case begin:
+			err = BeginGroup(groupURLs[test.ed])
+		case end:
+			err = EndGroup(groupURLs[test.ed])
+		default:
+			var results []EditResult
+			results, err = Do(textURLs[test.ed], test.edit)
+			if err == nil && results[0].Error != "" {
+				err = errors.New(results[0].Error)
+			}
+		}
+		if (err == nil) != (test.err == "") || err != nil && !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%d: %s %v err=%v, want matching %q", i, test.op, test.edit, err, test.err)
+		}
+		if text := bufferText(t, s, buf); text != test.want {
+			t.Errorf("%d: after %s %v, text=%q, want %q", i, test.op, test.edit, text, test.want)
+		}
+	}
+
+	notFoundURL := s.PathURL("/", "editor", "notfound", "group")
+	if err := BeginGroup(notFoundURL); err != ErrNotFound {
+		t.Errorf("BeginGroup(%q)=%v, want %v", notFoundURL, err, ErrNotFound)
+	}
+	if err := EndGroup(notFoundURL); err != ErrNotFound {
+		t.Errorf("EndGroup(%q)=%v, want %v", notFoundURL, err, ErrNotFound)
+	}
+}
+
+func TestEditorEdit_PipeRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	var textURLs [2]*url.URL
+	for i := range textURLs {
+		ed, err := NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+		}
+		textURLs[i] = s.PathURL(ed.Path, "text")
+	}
+
+	tests := []struct {
+		// Other is an edit by the other editor while the command runs.
+		other edit.Edit
+		want  string
+		err   string
+	}{
+		{
+			other: edit.Append(edit.End, "!"),
+			want:  "Hello, World!",
+		},
+		{
+			other: edit.Insert(edit.Rune(0), "¡"),
+			want:  "¡Hello, World",
+		},
+		{
+			other: edit.Change(edit.Regexp("世"), "x"),
+			want:  "Hello, x界",
+			err:   "conflicting change",
+		},
+		{
+			// Undo changes the text back to that of the previous test.
+			other: edit.Undo(1),
+			want:  "Hello, x界",
+			err:   "conflicting change",
+		},
+	}
+	for i, test := range tests {
+		reset := edit.Change(edit.All, "Hello, 世界")
+		if res, err := Do(textURLs[0], reset); err != nil || res[0].Error != "" {
+			t.Fatalf("%d: Do(%q, %v)=%v,%v, want _,nil", i, textURLs[0], reset, res, err)
+		}
+		started, proceed := filepath.Join(dir, "started"), filepath.Join(dir, "proceed")
+		os.Remove(started)
+		os.Remove(proceed)
+		cmd := "touch " + started + "; while [ ! -e " + proceed + " ]; do sleep 0.01; done; echo -n World"
+		pipe := edit.Pipe(edit.Regexp("世界"), cmd)
+		results := make(chan []EditResult, 1)
+		go func() {
+			res, err := Do(textURLs[0], pipe)
+			if err != nil {
+				t.Errorf("%d: Do(%q, %v)=%v,%v, want _,nil", i, textURLs[0], pipe, res, err)
+			}
+			results <- res
+		}()
+		waitForFile(t, started)
+
+		// The buffer is not locked while the command runs.
+		if res, err := Do(textURLs[1], test.other); err != nil || res[0].Error != "" {
+			t.Errorf("%d: Do(%q, %v)=%v,%v, want _,nil", i, textURLs[1], test.other, res, err)
+		}
+		if err := ioutil.WriteFile(proceed, nil, 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile(%q, nil, 0600)=%v", proceed, err)
+		}
+		res := <-results
+		if len(res) != 1 || res[0].Error != test.err {
+			t.Errorf("%d: Do(%q, %v)=%v, want error %q", i, textURLs[0], pipe, res, test.err)
+		}
+		if text := bufferText(t, s, buf); text != test.want {
+			t.Errorf("%d: text=%q, want %q", i, text, test.want)
+		}
+	}
+}
+
+// Tests that the edits of other editors
+// may be performed between the edits of a request
+// while a pipe edit of the request is released.
+func TestEditorEdit_PipeReleaseInterleaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	var textURLs [2]*url.URL
+	for i := range textURLs {
+		ed, err := NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+		}
+		textURLs[i] = s.PathURL(ed.Path, "text")
+	}
+	reset := edit.Change(edit.All, "Hello, 世界")
+	if res, err := Do(textURLs[0], reset); err != nil || res[0].Error != "" {
+		t.Fatalf("Do(%q, %v)=%v,%v, want _,nil", textURLs[0], reset, res, err)
+	}
+
+	started, proceed := filepath.Join(dir, "started"), filepath.Join(dir, "proceed")
+	cmd := "touch " + started + "; while [ ! -e " + proceed + " ]; do sleep 0.01; done; echo -n World"
+	eds := []edit.Edit{
+		edit.Pipe(edit.Regexp("世界"), cmd),
+		edit.Append(edit.End, "!"),
+	}
+	results := make(chan []EditResult, 1)
+	go func() {
+		res, err := Do(textURLs[0], eds...)
+		if err != nil {
+			t.Errorf("Do(%q, %v...)=%v,%v, want _,nil", textURLs[0], eds, res, err)
+		}
+		results <- res
+	}()
+	waitForFile(t, started)
+
+	other := edit.Insert(edit.Rune(0), "¡")
+	otherRes, err := Do(textURLs[1], other)
+	if err != nil || len(otherRes) != 1 || otherRes[0].Error != "" {
+		t.Fatalf("Do(%q, %v)=%v,%v, want _,nil", textURLs[1], other, otherRes, err)
+	}
+	if err := ioutil.WriteFile(proceed, nil, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, nil, 0600)=%v", proceed, err)
+	}
+	res := <-results
+	if len(res) != 2 || res[0].Error != "" || res[1].Error != "" {
+		t.Fatalf("Do(%q, %v...)=%v, want 2 results without errors", textURLs[0], eds, res)
+	}
+	if seq := otherRes[0].Sequence; seq >= res[0].Sequence {
+		t.Errorf("other edit sequence=%d, want < pipe edit sequence %d", seq, res[0].Sequence)
+	}
+	if text, want := bufferText(t, s, buf), "¡Hello, World!"; text != want {
+		t.Errorf("text=%q, want %q", text, want)
+	}
+}
+
+// Tests that a conditional request is not released by a pipe edit,
+// so no other edits are performed between its edits.
+func TestEditorEdit_PipeConditional(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	var textURLs [2]*url.URL
+	for i := range textURLs {
+		ed, err := NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+		}
+		textURLs[i] = s.PathURL(ed.Path, "text")
+	}
+	reset := edit.Change(edit.All, "Hello, 世界")
+	res, err := Do(textURLs[0], reset)
+	if err != nil || res[0].Error != "" {
+		t.Fatalf("Do(%q, %v)=%v,%v, want _,nil", textURLs[0], reset, res, err)
+	}
+	seq := res[0].Sequence
+
+	started, proceed := filepath.Join(dir, "started"), filepath.Join(dir, "proceed")
+	cmd := "touch " + started + "; while [ ! -e " + proceed + " ]; do sleep 0.01; done; echo -n World"
+	eds := []edit.Edit{
+		edit.Pipe(edit.Regexp("世界"), cmd),
+		edit.Append(edit.End, "!"),
+	}
+	results := make(chan []EditResult, 1)
+	go func() {
+		res, err := DoIf(textURLs[0], seq, eds...)
+		if err != nil {
+			t.Errorf("DoIf(%q, %d, %v...)=%v,%v, want _,nil", textURLs[0], seq, eds, res, err)
+		}
+		results <- res
+	}()
+	waitForFile(t, started)
+
+	// The buffer is locked while the command runs,
+	// so the other edit waits for the request to finish.
+	other := edit.Insert(edit.Rune(0), "¡")
+	otherResults := make(chan []EditResult, 1)
+	go func() {
+		res, err := Do(textURLs[1], other)
+		if err != nil || len(res) != 1 || res[0].Error != "" {
+			t.Errorf("Do(%q, %v)=%v,%v, want _,nil", textURLs[1], other, res, err)
+		}
+		otherResults <- res
+	}()
+	var otherRes []EditResult
+	select {
+	case otherRes = <-otherResults:
+		t.Errorf("Do(%q, %v)=%v, want it to wait for the pipe edit", textURLs[1], other, otherRes)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := ioutil.WriteFile(proceed, nil, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, nil, 0600)=%v", proceed, err)
+	}
+	res = <-results
+	if len(res) != 2 || res[0].Error != "" || res[1].Error != "" {
+		t.Fatalf("DoIf(%q, %d, %v...)=%v, want 2 results without errors", textURLs[0], seq, eds, res)
+	}
+	if otherRes == nil {
+		otherRes = <-otherResults
+	}
+	if len(otherRes) != 1 || otherRes[0].Sequence <= res[1].Sequence {
+		t.Errorf("other edit results=%v, want sequence > %d", otherRes, res[1].Sequence)
+	}
+	if text, want := bufferText(t, s, buf), "¡Hello, World!"; text != want {
+		t.Errorf("text=%q, want %q", text, want)
+	}
+}
+
+func TestEditorEdit_PipeCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	cancelURL := s.PathURL(ed.Path, "cancel")
+
+	started := filepath.Join(dir, "started")
+	eds := []edit.Edit{
+		edit.Pipe(edit.All, "touch "+started+"; sleep 10"),
+		edit.Append(edit.End, "abc"),
+	}
+	results := make(chan []EditResult, 1)
+	go func() {
+		res, err := Do(textURL, eds...)
+		if err != nil {
+			t.Errorf("Do(%q, %v...)=%v,%v, want _,nil", textURL, eds, res, err)
+		}
+		results <- res
+	}()
+	waitForFile(t, started)
+	if err := Cancel(cancelURL); err != nil {
+		t.Fatalf("Cancel(%q)=%v, want nil", cancelURL, err)
+	}
+	res := <-results
+	if len(res) != 2 || res[0].Error != "context canceled" || res[1].Error != "context canceled" {
+		t.Errorf("Do(%q, %v...)=%v, want 2 context canceled errors", textURL, eds, res)
+	}
+
+	timeoutURL := *textURL
+	timeoutURL.RawQuery = "timeout=10ms"
+	res, err = Do(&timeoutURL, eds...)
+	if err != nil || len(res) != 2 || res[0].Error != "context deadline exceeded" {
+		t.Errorf("Do(%q, %v...)=%v,%v, want context deadline exceeded", timeoutURL.String(), eds, res, err)
+	}
+	if text := bufferText(t, s, buf); text != "" {
+		t.Errorf("text=%q, want \"\"", text)
+	}
+
+	timeoutURL.RawQuery = "timeout=-1s"
+	if res, err := Do(&timeoutURL, eds...); err == nil {
+		t.Errorf("Do(%q, %v...)=%v,nil, want error", timeoutURL.String(), eds, res)
+	}
+	notFoundURL := s.PathURL("/", "editor", "notfound", "cancel")
+	if err := Cancel(notFoundURL); err != ErrNotFound {
+		t.Errorf("Cancel(%q)=%v, want %v", notFoundURL, err, ErrNotFound)
+	}
+}
+
+// WaitForFile waits for a file to exist.
+func waitForFile(t *testing.T, file string) {
+	for i := 0; ; i++ {
+		if _, err := os.Stat(file); err == nil {
+			return
+		}
+		if i == 500 {
+			t.Fatalf("timed out waiting for %s", file)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReader(t *testing.T) {
+	const line1 = "Hello, World\n"
+	const hi = line1 + "☺☹\n←→\n"
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+
+	textURL := s.PathURL(ed.Path, "text")
+
+	// Empty reader.
+	r, err := Reader(textURL, nil)
+	if err != nil {
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil || len(data) != 0 {
+		t.Errorf("ioutil.ReadAll(r)=%v,%v, want [],nil", data, err)
+	}
+
+	edits := []edit.Edit{edit.Append(edit.All, hi)}
+	if resp, err := Do(textURL, edits...); err != nil {
+		t.Fatalf("Do(%q, %v...)=%v,%v, want _,nil", textURL, edits, resp, err)
+	}
+
+	// Read everything.
+	r, err = Reader(textURL, nil)
+	if err != nil {
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+	}
+	data, err = ioutil.ReadAll(r)
+	if str := string(data); err != nil || str != hi {
+		t.Errorf("ioutil.ReadAll(r)=%q,%v, want %q,nil", str, err, hi)
+	}
+	r.Close()
+
+	// Read from an address.
+	r, err = Reader(textURL, edit.Line(1))
+	if err != nil {
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+	}
+	data, err = ioutil.ReadAll(r)
+	if str := string(data); err != nil || str != line1 {
+		t.Errorf("ioutil.ReadAll(r)=%q,%v, want %q,nil", str, err, line1)
+	}
+	r.Close()
+
+	// Address requires escaping
+	r, err = Reader(textURL, edit.Regexp("Hello")) // /Hello/, / must be escaped.
+	if err != nil {
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+	}
+	data, err = ioutil.ReadAll(r)
+	if str := string(data); err != nil || str != "Hello" {
+		t.Errorf("ioutil.ReadAll(r)=%q,%v, want %q,nil", str, err, "Hello")
+	}
+	r.Close()
+
+	// Out of range.
+	r, err = Reader(textURL, edit.Line(100))
+	if err != ErrRange {
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,%v", textURL, err, ErrRange)
+	}
+	if err == nil {
+		r.Close()
+	}
+
+	// Not found.
+	notFoundURL := s.PathURL("/", "editor", "notfound", "text")
+	r, err = Reader(notFoundURL, nil)
+	if err != ErrNotFound {
+		t.Errorf("Do(%q)=_,%v, want %v", notFoundURL, err, ErrNotFound)
+	}
+	if err == nil {
+		r.Close()
+	}
+
+	// Multiple Addrs.
+	multiAddrURL := *textURL
+	multiAddrURL.RawQuery = "addr=0"
+	r, err = Reader(&multiAddrURL, edit.Line(1))
+	if err == nil {
+		r.Close()
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
+	}
+
+	// Bad addr.
+	badAddrURL := *textURL
+	badAddrURL.RawQuery = "addr=" + strconv.FormatInt(math.MaxInt64, 10) + "0"
+	r, err = Reader(&badAddrURL, nil)
+	if err == nil {
+		r.Close()
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
+	}
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("Reader(%v,nil)=_,%v, want _,*ParseError", textURL, err)
+	}
+
+	// Leftover after addr.
+	leftoverAddrURL := *textURL
+	leftoverAddrURL.RawQuery = "addr=1hi"
+	r, err = Reader(&leftoverAddrURL, nil)
+	if err == nil {
+		r.Close()
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
+	}
+	wantErr := &ParseError{Offset: 1, Token: "hi", Expected: "end of address", Message: "unexpected trailing text: hi"}
+	if !reflect.DeepEqual(err, wantErr) {
+		t.Errorf("Reader(%v,nil)=_,%#v, want _,%#v", textURL, err, wantErr)
+	}
+
+	// Malformed parameters
+	badParamsURL := *textURL
+	badParamsURL.RawQuery = "addr=%G" // G is not valid hex.
+	r, err = Reader(&badParamsURL, nil)
+	if err == nil {
+		r.Close()
+		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
+	}
+}
+
+func TestReader_Bytes(t *testing.T) {
+	const hi = "☺☹\n←→\n"
+
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+
+	textURL := s.PathURL(ed.Path, "text")
+	edits := []edit.Edit{edit.Append(edit.All, hi)}
+	if resp, err := Do(textURL, edits...); err != nil {
+		t.Fatalf("Do(%q, %v...)=%v,%v, want _,nil", textURL, edits, resp, err)
+	}
+
+	tests := []struct {
+		addr edit.Address
+		want string
+	}{
+		{addr: edit.All, want: hi},
+		{addr: edit.Rune(1).To(edit.Rune(2)), want: "☹"},
+		{addr: edit.Byte(3).To(edit.Byte(6)), want: "☹"},
+		{addr: edit.Byte(4).To(edit.Byte(6)), want: "☹"},
+		{addr: edit.Rune(3).To(edit.End), want: "←→\n"},
+		{addr: edit.Byte(7).To(edit.End), want: "←→\n"},
+		{addr: edit.Line(2), want: "←→\n"},
+	}
+	for _, test := range tests {
+		bytesURL := *textURL
+		bytesURL.RawQuery = "units=bytes"
+		r, err := Reader(&bytesURL, test.addr)
+		if err != nil {
+			t.Errorf("Reader(%v,%v)=_,%v, want _,nil", &bytesURL, test.addr, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if str := string(data); err != nil || str != test.want {
+			t.Errorf("ioutil.ReadAll(Reader(%v,%v))=%q,%v, want %q,nil", &bytesURL, test.addr, str, err, test.want)
+		}
+	}
+
+	badUnitsURL := *textURL
+	badUnitsURL.RawQuery = "units=lines"
+	if r, err := Reader(&badUnitsURL, nil); err == nil {
+		r.Close()
+		t.Errorf("Reader(%v,nil)=_,%v, want _,<non-nil>", &badUnitsURL, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	var eds [2]Editor
+	for i := range eds {
+		eds[i], err = NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, eds[i], err)
+		}
+	}
+
+	// Registers are initially empty.
+	reg0URL := s.PathURL(eds[0].Path, "register", "α")
+	if text, err := Register(reg0URL); err != nil || len(text) != 0 {
+		t.Errorf("Register(%q)=%q,%v, want \"\",nil", reg0URL, text, err)
+	}
+
+	const hi = "Hello, 世界!"
+	if err := SetRegister(reg0URL, []byte(hi)); err != nil {
+		t.Fatalf("SetRegister(%q, %q)=%v, want nil", reg0URL, hi, err)
+	}
+	if text, err := Register(reg0URL); err != nil || string(text) != hi {
+		t.Errorf("Register(%q)=%q,%v, want %q,nil", reg0URL, text, err, hi)
+	}
+
+	// Registers are per-editor.
+	reg1URL := s.PathURL(eds[1].Path, "register", "α")
+	if text, err := Register(reg1URL); err != nil || len(text) != 0 {
+		t.Errorf("Register(%q)=%q,%v, want \"\",nil", reg1URL, text, err)
+	}
+
+	// Registers set over HTTP are visible to the edit language.
+	text0URL := s.PathURL(eds[0].Path, "text")
+	edits := []edit.Edit{
+		edit.Put(edit.All, 'α'),             // 1
+		edit.Yank(edit.Regexp("世界"), 'β'),   // 2
+		edit.Put(edit.Regexp("Hello"), 'β'), // 3
+		edit.Print(edit.All),                // 4
+	}
+	want := []EditResult{
+		{Sequence: 1},
+		{Sequence: 2},
+		{Sequence: 3},
+		{Sequence: 4, Print: "世界, 世界!"},
+	}
+	got, err := Do(text0URL, edits...)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Do(%q, %v...)=%v,%v, want %v,nil", text0URL, edits, got, err, want)
+	}
+
+	// Registers set by the edit language are visible over HTTP.
+	regβURL := s.PathURL(eds[0].Path, "register", "β")
+	if text, err := Register(regβURL); err != nil || string(text) != "世界" {
+		t.Errorf("Register(%q)=%q,%v, want %q,nil", regβURL, text, err, "世界")
+	}
+	if text, err := Register(reg1URL); err != nil || len(text) != 0 {
+		t.Errorf("Register(%q)=%q,%v, want \"\",nil", reg1URL, text, err)
+	}
+}
+
+func TestRegister_BadName(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+
+	badURL := s.PathURL(ed.Path, "register", "abc")
+	if text, err := Register(badURL); err == nil {
+		t.Errorf("Register(%q)=%q,%v, want _,<non-nil>", badURL, text, err)
+	}
+	if err := SetRegister(badURL, []byte("xyz")); err == nil {
+		t.Errorf("SetRegister(%q, \"xyz\")=%v, want <non-nil>", badURL, err)
+	}
+}
+
+func TestRegister_NotFound(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	notFoundURL := s.PathURL("/", "editor", "notfound", "register", "a")
+	if _, err := Register(notFoundURL); err != ErrNotFound {
+		t.Errorf("Register(%q)=_,%v, want %v", notFoundURL, err, ErrNotFound)
+	}
+	if err := SetRegister(notFoundURL, []byte("xyz")); err != ErrNotFound {
+		t.Errorf("SetRegister(%q, \"xyz\")=%v, want %v", notFoundURL, err, ErrNotFound)
+	}
+}
+
+func TestMarks(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, edit.Insert(edit.All, "Hello, 世界!")); err != nil {
+		t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURL, res, err)
+	}
+
+	marksURL := s.PathURL(ed.Path, "marks")
+	bytesURL := s.PathURL(ed.Path, "marks")
+	bytesURL.RawQuery = "units=bytes"
+	set := Marks{'a': edit.Span{0, 5}, 'b': edit.Span{7, 9}}
+	if err := SetMarks(marksURL, set); err != nil {
+		t.Fatalf("SetMarks(%q, %v)=%v, want nil", marksURL, set, err)
+	}
+	if err := SetMarks(bytesURL, Marks{'c': edit.Span{13, 14}}); err != nil {
+		t.Fatalf("SetMarks(%q, …)=%v, want nil", bytesURL, err)
+	}
+	// Marks are set atomically.
+	bad := Marks{'a': edit.Span{1, 1}, 'd': edit.Span{0, 100}}
+	if err := SetMarks(marksURL, bad); err == nil {
+		t.Errorf("SetMarks(%q, %v)=nil, want error", marksURL, bad)
+	}
+	body := strings.NewReader(`{"ab": [0, 0]}`)
+	if err := request(marksURL, http.MethodPut, body, nil); err == nil {
+		t.Errorf("PUT %q with a bad mark name succeeded, want error", marksURL)
+	}
+
+	tests := []struct {
+		url  *url.URL
+		want Marks
+	}{
+		{url: marksURL, want: Marks{'a': {0, 5}, 'b': {7, 9}, 'c': {9, 10}}},
+		{url: bytesURL, want: Marks{'a': {0, 5}, 'b': {7, 13}, 'c': {13, 14}}},
+	}
+	for _, test := range tests {
+		marks, err := GetMarks(test.url)
+		if err != nil {
+			t.Errorf("GetMarks(%q)=_,%v, want _,nil", test.url, err)
+			continue
+		}
+		for m, want := range test.want {
+			if got := marks[m]; got != want {
+				t.Errorf("GetMarks(%q)[%q]=%v, want %v", test.url, m, got, want)
+			}
+		}
+		if s, ok := marks['d']; ok {
+			t.Errorf("GetMarks(%q)['d']=%v, want unset", test.url, s)
+		}
+	}
+
+	e := edit.Print(edit.Mark('a'))
+	if res, err := Do(textURL, e); err != nil || res[0].Print != "Hello" {
+		t.Errorf("Do(%q, %v)=%v,%v, want [{Print: Hello}],nil", textURL, e, res, err)
+	}
+
+	notFoundURL := s.PathURL("/", "editor", "notfound", "marks")
+	if _, err := GetMarks(notFoundURL); err != ErrNotFound {
+		t.Errorf("GetMarks(%q)=_,%v, want _,%v", notFoundURL, err, ErrNotFound)
+	}
+	if err := SetMarks(notFoundURL, set); err != ErrNotFound {
+		t.Errorf("SetMarks(%q, %v)=%v, want %v", notFoundURL, set, err, ErrNotFound)
+	}
+}
+
+func TestChangeStream(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	var watchers [3]*ChangeStream
+	for i := range watchers {
+		var err error
+		watchers[i], err = Changes(changesURL)
+		if err != nil {
+			t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
+		}
+		defer watchers[i].Close()
+	}
+
+	var hi = "Hello, 世界!" + strings.Repeat("x", MaxInline)
+	eds := []edit.Edit{
+		edit.Insert(edit.All, hi),                                        // 1
+		edit.Change(edit.Regexp("世界"), "World"),                          // 2
+		edit.SubGlobal(edit.All, ",|!", "."),                             // 3
+		edit.Print(edit.All),                                             // 4
+		edit.Where(edit.Dot),                                             // 5
+		edit.Block(edit.All, edit.Where(edit.Dot), edit.Print(edit.Dot)), // 6
+		edit.Delete(edit.All),                                            // 7
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, eds...); err != nil {
+		t.Fatalf("ed.Do(%q, %v...)=%v,%v want _,nil", textURL, eds, res, err)
+	}
+
+	wants := []ChangeList{
+		ChangeList{
+			Sequence: 1,
+			Changes: []Change{
+				{
+					Span:    edit.Span{0: 0, 1: 0},
+					NewSize: int64(utf8.RuneCountInString(hi)),
+				},
+			},
+		},
+		ChangeList{
+			Sequence: 2,
+			Changes: []Change{
+				{
+					Span:    edit.Span{0: 7, 1: 9},
+					NewSize: int64(utf8.RuneCountInString("World")),
+					Text:    []byte("World"),
+				},
+			},
+		},
+		ChangeList{
+			Sequence: 3,
+			Changes: []Change{
+				{
+					Span:    edit.Span{0: 5, 1: 6},
+					NewSize: 1,
+					Text:    []byte("."),
+				},
+				{
+					Span:    edit.Span{0: 12, 1: 13},
+					NewSize: 1,
+					Text:    []byte("."),
+				},
+			},
+		},
+		// Sequence 4 is a Print, which generates no change.
+		// Sequence 5 is a Where, which generates no change.
+		// Sequence 6 is a Block with Where and Print, which generates no change.
+		ChangeList{
+			Sequence: 7,
+			Changes: []Change{
+				{
+					// +3, because 世界 changed to World.
+					Span:    edit.Span{0: 0, 1: int64(utf8.RuneCountInString(hi)) + 3},
+					NewSize: 0,
+				},
+			},
+		},
+	}
+	for _, want := range wants {
+		for i := range watchers {
+			got, err := watchers[i].Next()
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("watchers[%d].Next()=%v,%v, want %v,nil", i, got, err, want)
+			}
+		}
+	}
+}
+
+func TestChangeStream_Bytes(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	changesURL.RawQuery = "units=bytes"
+	changes, err := Changes(changesURL)
+	if err != nil {
+		t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
+	}
+	defer changes.Close()
+
+	eds := []edit.Edit{
+		edit.Insert(edit.All, "Hello, 世界!"),     // 1
+		edit.Change(edit.Regexp("世界"), "World"), // 2
+		edit.Change(edit.Regexp("!"), "☺"),      // 3
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, eds...); err != nil {
+		t.Fatalf("ed.Do(%q, %v...)=%v,%v want _,nil", textURL, eds, res, err)
+	}
+
+	wants := []ChangeList{
+		{
+			Sequence: 1,
+			Changes:  []Change{{Span: edit.Span{0: 0, 1: 0}, NewSize: 14}},
+		},
+		{
+			Sequence: 2,
+			Changes:  []Change{{Span: edit.Span{0: 7, 1: 13}, NewSize: 5, Text: []byte("World")}},
+		},
+		{
+			Sequence: 3,
+			Changes:  []Change{{Span: edit.Span{0: 12, 1: 13}, NewSize: 3, Text: []byte("☺")}},
+		},
+	}
+	for _, want := range wants {
+		got, err := changes.Next()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("changes.Next()=%v,%v, want %v,nil", got, err, want)
+		}
+	}
+}
+
+func TestChangeStream_Marks(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	var eds [2]Editor
+	for i := range eds {
+		if eds[i], err = NewEditor(bufferURL); err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, eds[i], err)
+		}
+	}
+
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	badURL := *changesURL
+	badURL.RawQuery = "editor=notfound"
+	if changes, err := Changes(&badURL); err == nil {
+		changes.Close()
+		t.Errorf("Changes(%q)=_,nil, want _,error", badURL.String())
+	}
+
+	tests := []struct {
+		query string
+		want  []Marks
+	}{
+		{query: "", want: []Marks{nil, nil}},
+		{
+			query: "editor=" + eds[0].ID,
+			want:  []Marks{{'a': {0, 0}}, {'a': {3, 4}}},
+		},
+		{
+			query: "editor=" + eds[0].ID + "&units=bytes",
+			want:  []Marks{{'a': {0, 0}}, {'a': {7, 8}}},
+		},
+	}
+	var streams []*ChangeStream
+	for _, test := range tests {
+		u := *changesURL
+		u.RawQuery = test.query
+		changes, err := Changes(&u)
+		if err != nil {
+			t.Fatalf("Changes(%q)=_,%v, want _,nil", u.String(), err)
+		}
+		defer changes.Close()
+		streams = append(streams, changes)
+	}
+
+	textURLs := [2]*url.URL{s.PathURL(eds[0].Path, "text"), s.PathURL(eds[1].Path, "text")}
+	e := edit.Set(edit.Regexp("b"), 'a')
+	if res, err := Do(textURLs[0], edit.Insert(edit.All, "abc"), e); err != nil {
+		t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURLs[0], res, err)
+	}
+	// The change by the other editor moves the mark.
+	e = edit.Insert(edit.Regexp("a"), "世界")
+	if res, err := Do(textURLs[1], e); err != nil {
+		t.Fatalf("Do(%q, %v)=%v,%v, want _,nil", textURLs[1], e, res, err)
+	}
+
+	for i, test := range tests {
+		for _, want := range test.want {
+			got, err := streams[i].Next()
+			if err != nil {
+				t.Errorf("%q: changes.Next()=_,%v, want _,nil", test.query, err)
+				continue
+			}
+			if want == nil && got.Marks != nil {
+				t.Errorf("%q: changes.Next().Marks=%v, want nil", test.query, got.Marks)
+			}
+			for m, s := range want {
+				if got.Marks[m] != s {
+					t.Errorf("%q: changes.Next().Marks[%q]=%v, want %v", test.query, m, got.Marks[m], s)
+				}
+			}
+		}
+	}
+}
+
+func TestChangeStream_Inline(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+	}
+
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	for _, q := range []string{"inline=-1", "inline=x", "inline=1&inline=2", "inline=" + strconv.Itoa(MaxInlineLimit+1)} {
+		u := *changesURL
+		u.RawQuery = q
+		if changes, err := Changes(&u); err == nil {
+			changes.Close()
+			t.Errorf("Changes(%q)=_,nil, want _,error", u.String())
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []ChangeList
+	}{
+		{
+			query: "",
+			want: []ChangeList{
+				{Sequence: 1, Changes: []Change{{Span: edit.Span{0, 0}, NewSize: 9}}},
+				{Sequence: 2, Changes: []Change{{Span: edit.Span{9, 9}, NewSize: 1, Text: []byte("!")}}},
+			},
+		},
+		{
+			query: "inline=0",
+			want: []ChangeList{
+				{Sequence: 1, Changes: []Change{{Span: edit.Span{0, 0}, NewSize: 9}}},
+				{Sequence: 2, Changes: []Change{{Span: edit.Span{9, 9}, NewSize: 1}}},
+			},
+		},
+		{
+			query: "inline=16",
+			want: []ChangeList{
+				{Sequence: 1, Changes: []Change{{Span: edit.Span{0, 0}, NewSize: 9, Text: []byte("Hello, 世界")}}},
+				{Sequence: 2, Changes: []Change{{Span: edit.Span{9, 9}, NewSize: 1, Text: []byte("!")}}},
+			},
+		},
+		{
+			query: "inline=16&units=bytes",
+			want: []ChangeList{
+				{Sequence: 1, Changes: []Change{{Span: edit.Span{0, 0}, NewSize: 13, Text: []byte("Hello, 世界")}}},
+				{Sequence: 2, Changes: []Change{{Span: edit.Span{13, 13}, NewSize: 1, Text: []byte("!")}}},
+			},
+		},
+	}
+	var streams []*ChangeStream
+	for _, test := range tests {
+		u := *changesURL
+		u.RawQuery = test.query
+		changes, err := Changes(&u)
+		if err != nil {
+			t.Fatalf("Changes(%q)=_,%v, want _,nil", u.String(), err)
+		}
+		defer changes.Close()
+		streams = append(streams, changes)
 	}
-}
 
-func TestReader(t *testing.T) {
-	const line1 = "Hello, World\n"
-	const hi = line1 + "☺☹\n←→\n"
+	eds := []edit.Edit{
+		edit.Insert(edit.All, "Hello, 世界"), // 1
+		edit.Append(edit.All, "!"),         // 2
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, eds...); err != nil {
+		t.Fatalf("ed.Do(%q, %v...)=%v,%v want _,nil", textURL, eds, res, err)
+	}
 
-	s := editortest.NewServer(NewServer())
+	for i, test := range tests {
+		for _, want := range test.want {
+			got, err := streams[i].Next()
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("%q: changes.Next()=%v,%v, want %v,nil", test.query, got, err, want)
+			}
+		}
+	}
+}
+
+func TestChangeStream_Since(t *testing.T) {
+	editorServer := NewServer()
+	s := editortest.NewServer(editorServer)
 	defer s.Close()
 
 	buffersURL := s.PathURL("/", "buffers")
@@ -490,6 +2463,7 @@ func TestReader(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
 	}
+	editorServer.buffers[buf.ID].maxHistory = 2
 
 	bufferURL := s.PathURL(buf.Path)
 	ed, err := NewEditor(bufferURL)
@@ -497,114 +2471,469 @@ func TestReader(t *testing.T) {
 		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
 	}
 
+	eds := []edit.Edit{
+		edit.Insert(edit.All, "a"), // 1
+		edit.Insert(edit.All, "b"), // 2
+		edit.Print(edit.All),       // 3
+		edit.Insert(edit.All, "c"), // 4
+	}
 	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, eds...); err != nil {
+		t.Fatalf("ed.Do(%q, %v...)=%v,%v want _,nil", textURL, eds, res, err)
+	}
 
-	// Empty reader.
-	r, err := Reader(textURL, nil)
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	// The history has only the ChangeLists of edits 2 and 4.
+	if _, err := ChangesSince(changesURL, 0); err != ErrTruncated {
+		t.Errorf("ChangesSince(%q, 0)=_,%v, want _,%v", changesURL, err, ErrTruncated)
+	}
+
+	tests := []struct {
+		since int
+		want  []int
+	}{
+		{since: 1, want: []int{2, 4, 5}},
+		{since: 2, want: []int{4, 5}},
+		{since: 3, want: []int{4, 5}},
+		{since: 4, want: []int{5}},
+	}
+	var streams []*ChangeStream
+	for _, test := range tests {
+		changes, err := ChangesSince(changesURL, test.since)
+		if err != nil {
+			t.Fatalf("ChangesSince(%q, %d)=_,%v, want _,nil", changesURL, test.since, err)
+		}
+		defer changes.Close()
+		streams = append(streams, changes)
+	}
+
+	e := edit.Insert(edit.All, "d") // 5
+	if res, err := Do(textURL, e); err != nil {
+		t.Fatalf("ed.Do(%q, %v)=%v,%v want _,nil", textURL, e, res, err)
+	}
+
+	for i, test := range tests {
+		for _, want := range test.want {
+			got, err := streams[i].Next()
+			if err != nil || got.Sequence != want {
+				t.Errorf("since %d: changes.Next()=%v,%v, want {Sequence: %d},nil", test.since, got, err, want)
+			}
+		}
+	}
+}
+
+func TestChangeStream_Reconnect(t *testing.T) {
+	// The hijacked connections are recorded,
+	// so that the websocket connections can be broken.
+	var mu sync.Mutex
+	var hijacked []net.Conn
+	editorServer := NewServer()
+	defer editorServer.Close()
+	router := mux.NewRouter()
+	editorServer.RegisterHandlers(router)
+	httpServer := httptest.NewUnstartedServer(router)
+	httpServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			mu.Lock()
+			hijacked = append(hijacked, conn)
+			mu.Unlock()
+		}
+	}
+	httpServer.Start()
+	defer httpServer.Close()
+	serverURL, err := url.Parse(httpServer.URL)
 	if err != nil {
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+		t.Fatalf("url.Parse(%q)=_,%v, want _,nil", httpServer.URL, err)
 	}
-	data, err := ioutil.ReadAll(r)
-	if err != nil || len(data) != 0 {
-		t.Errorf("ioutil.ReadAll(r)=%v,%v, want [],nil", data, err)
+	s := &editortest.Server{URL: serverURL}
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
 	}
+	editorServer.buffers[buf.ID].maxHistory = 2
 
-	edits := []edit.Edit{edit.Append(edit.All, hi)}
-	if resp, err := Do(textURL, edits...); err != nil {
-		t.Fatalf("Do(%q, %v...)=%v,%v, want _,nil", textURL, edits, resp, err)
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
 	}
+	textURL := s.PathURL(ed.Path, "text")
 
-	// Read everything.
-	r, err = Reader(textURL, nil)
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	changes, err := ChangesSince(changesURL, 0)
 	if err != nil {
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+		t.Fatalf("ChangesSince(%q, 0)=_,%v, want _,nil", changesURL, err)
 	}
-	data, err = ioutil.ReadAll(r)
-	if str := string(data); err != nil || str != hi {
-		t.Errorf("ioutil.ReadAll(r)=%q,%v, want %q,nil", str, err, hi)
+	defer changes.Close()
+
+	// BreakAndDo breaks the stream's connection and performs the edits.
+	breakAndDo := func(eds ...edit.Edit) {
+		mu.Lock()
+		for _, conn := range hijacked {
+			conn.Close()
+		}
+		hijacked = nil
+		mu.Unlock()
+		if res, err := Do(textURL, eds...); err != nil {
+			t.Fatalf("ed.Do(%q, %v...)=%v,%v want _,nil", textURL, eds, res, err)
+		}
 	}
-	r.Close()
 
-	// Read from an address.
-	r, err = Reader(textURL, edit.Line(1))
+	breakAndDo(edit.Insert(edit.All, "a"), edit.Insert(edit.All, "b"))
+	for _, want := range []int{1, 2} {
+		got, err := changes.Next()
+		if err != nil || got.Sequence != want {
+			t.Errorf("changes.Next()=%v,%v, want {Sequence: %d},nil", got, err, want)
+		}
+	}
+
+	breakAndDo(edit.Insert(edit.All, "c"), edit.Insert(edit.All, "d"), edit.Insert(edit.All, "e"))
+	if got, err := changes.Next(); err != ErrTruncated {
+		t.Errorf("changes.Next()=%v,%v, want _,%v", got, err, ErrTruncated)
+	}
+
+	e := edit.Insert(edit.All, "f") // 6
+	if res, err := Do(textURL, e); err != nil {
+		t.Fatalf("ed.Do(%q, %v)=%v,%v want _,nil", textURL, e, res, err)
+	}
+	if got, err := changes.Next(); err != nil || got.Sequence != 6 {
+		t.Errorf("changes.Next()=%v,%v, want {Sequence: 6},nil", got, err)
+	}
+}
+
+func TestChangeStream_Close(t *testing.T) {
+	editorServer := NewServer()
+	s := editortest.NewServer(editorServer)
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
 	if err != nil {
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
 	}
-	data, err = ioutil.ReadAll(r)
-	if str := string(data); err != nil || str != line1 {
-		t.Errorf("ioutil.ReadAll(r)=%q,%v, want %q,nil", str, err, line1)
+
+	editorServer.buffers[buf.ID].watcherRemoved = make(chan struct{})
+
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	changes, err := Changes(changesURL)
+	if err != nil {
+		t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
 	}
-	r.Close()
 
-	// Address requires escaping
-	r, err = Reader(textURL, edit.Regexp("Hello")) // /Hello/, / must be escaped.
+	if err := changes.Close(); err != nil {
+		t.Fatalf("changes.Close()=%v, want nil", err)
+	}
+
+	// Wait 1 second for the server to receive the close
+	// and call the defer to remove the watcher.
+	// This is suboptimal, but better than nothing.
+	select {
+	case <-editorServer.buffers[buf.ID].watcherRemoved:
+	case <-time.After(1 * time.Second):
+		t.Errorf("timed out waiting for watcher to close")
+	}
+}
+
+func TestChangeStream_BufferClose(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
 	if err != nil {
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,nil", textURL, err)
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
 	}
-	data, err = ioutil.ReadAll(r)
-	if str := string(data); err != nil || str != "Hello" {
-		t.Errorf("ioutil.ReadAll(r)=%q,%v, want %q,nil", str, err, "Hello")
+
+	changesURL := s.PathURL(buf.Path, "changes")
+	changesURL.Scheme = "ws"
+	changes, err := Changes(changesURL)
+	if err != nil {
+		t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
 	}
-	r.Close()
 
-	// Out of range.
-	r, err = Reader(textURL, edit.Line(100))
-	if err != ErrRange {
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,%v", textURL, err, ErrRange)
+	bufferURL := s.PathURL(buf.Path)
+	if err := Close(bufferURL); err != nil {
+		t.Fatalf("buf.Close()=%v, want nil", err)
 	}
-	if err == nil {
-		r.Close()
+
+	if _, err := changes.Next(); err == nil {
+		t.Errorf("changes.Next()=_,%v, want non-nil", err)
 	}
+}
 
-	// Not found.
-	notFoundURL := s.PathURL("/", "editor", "notfound", "text")
-	r, err = Reader(notFoundURL, nil)
+func TestChangeStream_NotFound(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	changesURL := s.PathURL("buffer", "notfound", "changes")
+	changesURL.Scheme = "ws"
+	changes, err := Changes(changesURL)
 	if err != ErrNotFound {
-		t.Errorf("Do(%q)=_,%v, want %v", notFoundURL, err, ErrNotFound)
+		t.Errorf("Changes(%q)=_,%v, want _,%v", changesURL, err, ErrNotFound)
 	}
 	if err == nil {
-		r.Close()
+		changes.Close()
 	}
+}
 
-	// Multiple Addrs.
-	multiAddrURL := *textURL
-	multiAddrURL.RawQuery = "addr=0"
-	r, err = Reader(&multiAddrURL, edit.Line(1))
-	if err == nil {
-		r.Close()
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
+func TestChangeStream_Events(t *testing.T) {
+	editorServer := NewServer()
+	s := editortest.NewServer(editorServer)
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, edit.Insert(edit.All, "Hello")); err != nil {
+		t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURL, res, err)
+	}
+	// Both streams' watchers are removed, but only the first is awaited.
+	editorServer.buffers[buf.ID].watcherRemoved = make(chan struct{}, 2)
+
+	changesURL := s.PathURL(buf.Path, "changes")
+	// The first stream resumes after the event with ID 0,
+	// and the second stream after the event with ID 1.
+	var bodies []io.ReadCloser
+	var events []*bufio.Reader
+	for _, lastID := range []string{"0", "1"} {
+		req, err := http.NewRequest(http.MethodGet, changesURL.String(), nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(GET, %q, nil)=_,%v", changesURL, err)
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", lastID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %q=_,%v, want _,nil", changesURL, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %q status=%d, want %d", changesURL, resp.StatusCode, http.StatusOK)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("GET %q Content-Type=%q, want text/event-stream", changesURL, ct)
+		}
+		bodies = append(bodies, resp.Body)
+		events = append(events, bufio.NewReader(resp.Body))
+	}
+
+	if res, err := Do(textURL, edit.Append(edit.End, ", 世界")); err != nil {
+		t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURL, res, err)
+	}
+	wants := [][]ChangeList{
+		{
+			{
+				Sequence: 1,
+				Changes:  []Change{{Span: edit.Span{0, 0}, NewSize: 5, Text: []byte("Hello")}},
+			},
+			{
+				Sequence: 2,
+				Changes:  []Change{{Span: edit.Span{5, 5}, NewSize: 4, Text: []byte(", 世界")}},
+			},
+		},
+		{
+			{
+				Sequence: 2,
+				Changes:  []Change{{Span: edit.Span{5, 5}, NewSize: 4, Text: []byte(", 世界")}},
+			},
+		},
+	}
+	for i, want := range wants {
+		for _, w := range want {
+			typ, id, got := readEvent(t, events[i])
+			if typ != "change" || id != strconv.Itoa(w.Sequence) || !reflect.DeepEqual(got, w) {
+				t.Errorf("stream %d: event %s, id %s, %+v; want change, %d, %+v", i, typ, id, got, w.Sequence, w)
+			}
+		}
+	}
+
+	bodies[0].Close()
+	select {
+	case <-editorServer.buffers[buf.ID].watcherRemoved:
+	case <-time.After(1 * time.Second):
+		t.Errorf("timed out waiting for watcher to close")
+	}
+}
+
+// ReadEvent reads a Server-Sent Event with ChangeList data,
+// and returns its type, its ID, and the ChangeList.
+func readEvent(t *testing.T, r *bufio.Reader) (string, string, ChangeList) {
+	var typ, id string
+	var cl ChangeList
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return typ, id, cl
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &cl); err != nil {
+				t.Fatalf("failed to unmarshal event data %q: %v", line, err)
+			}
+		default:
+			t.Fatalf("unexpected event line: %q", line)
+		}
+	}
+}
+
+func TestChangeStream_EventsError(t *testing.T) {
+	s := editortest.NewServer(NewServer())
+	defer s.Close()
+
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	tests := []struct {
+		path, lastID string
+		want         int
+	}{
+		{path: path.Join("/buffer", "notfound", "changes"), want: http.StatusNotFound},
+		{path: path.Join(buf.Path, "changes"), lastID: "x", want: http.StatusBadRequest},
+		{path: path.Join(buf.Path, "changes"), lastID: "-1", want: http.StatusBadRequest},
+		{path: path.Join(buf.Path, "changes"), lastID: "100", want: http.StatusOK},
+	}
+	for _, test := range tests {
+		changesURL := s.PathURL(test.path)
+		req, err := http.NewRequest(http.MethodGet, changesURL.String(), nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(GET, %q, nil)=_,%v", changesURL, err)
+		}
+		req.Header.Set("Accept", "text/html, text/event-stream;q=0.9")
+		if test.lastID != "" {
+			req.Header.Set("Last-Event-ID", test.lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %q=_,%v, want _,nil", changesURL, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("GET %q, Last-Event-ID %q: status=%d, want %d", changesURL, test.lastID, resp.StatusCode, test.want)
+		}
 	}
+}
+
+func TestChangeStream_Overflow(t *testing.T) {
+	tests := []struct {
+		limit  int
+		reload bool
+		edits  int
+		// Want are the waiting ChangeLists,
+		// or nil if the watcher is removed.
+		want []ChangeList
+	}{
+		{limit: 2, edits: 1, want: []ChangeList{{Sequence: 1}}},
+		{limit: 2, edits: 2, want: []ChangeList{{Sequence: 1}, {Sequence: 2}}},
+		{limit: 2, edits: 3, want: nil},
+		{limit: 1, edits: 2, want: nil},
+		{limit: 2, reload: true, edits: 2, want: []ChangeList{{Sequence: 1}, {Sequence: 2}}},
+		{limit: 2, reload: true, edits: 3, want: []ChangeList{{Sequence: 3, Reload: true}}},
+		{limit: 2, reload: true, edits: 4, want: []ChangeList{{Sequence: 3, Reload: true}, {Sequence: 4}}},
+		{limit: 2, reload: true, edits: 5, want: []ChangeList{{Sequence: 5, Reload: true}}},
+		{limit: 1, reload: true, edits: 3, want: []ChangeList{{Sequence: 3, Reload: true}}},
+	}
+	for _, test := range tests {
+		editorServer := NewServer()
+		s := editortest.NewServer(editorServer)
+
+		buffersURL := s.PathURL("/", "buffers")
+		buf, err := NewBuffer(buffersURL)
+		if err != nil {
+			t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+		}
+		bufferURL := s.PathURL(buf.Path)
+		ed, err := NewEditor(bufferURL)
+		if err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+		}
 
-	// Bad addr.
-	badAddrURL := *textURL
-	badAddrURL.RawQuery = "addr=" + strconv.FormatInt(math.MaxInt64, 10) + "0"
-	r, err = Reader(&badAddrURL, nil)
-	if err == nil {
-		r.Close()
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
-	}
+		// The watcher is never read, like a stalled client.
+		b := editorServer.buffers[buf.ID]
+		b.watcherRemoved = make(chan struct{}, 1)
+		wr := &watcher{
+			changes: make(chan []ChangeList, 1),
+			inline:  MaxInline,
+			limit:   test.limit,
+			reload:  test.reload,
+			resync:  make(chan struct{}),
+		}
+		b.Lock()
+		b.watchers = append(b.watchers, wr)
+		b.Unlock()
+
+		textURL := s.PathURL(ed.Path, "text")
+		for i := 0; i < test.edits; i++ {
+			if res, err := Do(textURL, edit.Append(edit.End, "x")); err != nil {
+				t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURL, res, err)
+			}
+		}
 
-	// Leftover after addr.
-	leftoverAddrURL := *textURL
-	leftoverAddrURL.RawQuery = "addr=1hi"
-	r, err = Reader(&leftoverAddrURL, nil)
-	if err == nil {
-		r.Close()
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
+		name := fmt.Sprintf("limit %d, reload %v, %d edits", test.limit, test.reload, test.edits)
+		if test.want == nil {
+			select {
+			case <-b.watcherRemoved:
+			default:
+				t.Errorf("%s: watcher not removed", name)
+			}
+			select {
+			case <-wr.resync:
+			default:
+				t.Errorf("%s: resync not closed", name)
+			}
+			s.Close()
+			continue
+		}
+		select {
+		case <-b.watcherRemoved:
+			t.Errorf("%s: watcher removed", name)
+		default:
+		}
+		var got []ChangeList
+		for _, cl := range <-wr.changes {
+			got = append(got, ChangeList{Sequence: cl.Sequence, Reload: cl.Reload})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: waiting ChangeLists are %v, want %v", name, got, test.want)
+		}
+		s.Close()
 	}
+}
 
-	// Malformed parameters
-	badParamsURL := *textURL
-	badParamsURL.RawQuery = "addr=%G" // G is not valid hex.
-	r, err = Reader(&badParamsURL, nil)
-	if err == nil {
-		r.Close()
-		t.Fatalf("Reader(%v,nil)=_,%v, want _,<non-nil>", textURL, err)
+// SetWatcherLimits sets the limit of all watchers of a buffer.
+// A limit of 0 overflows on the next change, like a stalled client.
+func setWatcherLimits(b *buffer, limit int) {
+	b.Lock()
+	for _, wr := range b.watchers {
+		wr.limit = limit
 	}
+	b.Unlock()
 }
 
-func TestChangeStream(t *testing.T) {
-	s := editortest.NewServer(NewServer())
+func TestChangeStream_Resync(t *testing.T) {
+	editorServer := NewServer()
+	s := editortest.NewServer(editorServer)
 	defer s.Close()
 
 	buffersURL := s.PathURL("/", "buffers")
@@ -612,100 +2941,48 @@ func TestChangeStream(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
 	}
-
 	bufferURL := s.PathURL(buf.Path)
 	ed, err := NewEditor(bufferURL)
 	if err != nil {
-		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, buf, err)
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
 	}
+	b := editorServer.buffers[buf.ID]
+	b.watcherRemoved = make(chan struct{}, 2)
 
 	changesURL := s.PathURL(buf.Path, "changes")
 	changesURL.Scheme = "ws"
-	var watchers [3]*ChangeStream
-	for i := range watchers {
-		var err error
-		watchers[i], err = Changes(changesURL)
-		if err != nil {
-			t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
-		}
-		defer watchers[i].Close()
+	changes, err := Changes(changesURL)
+	if err != nil {
+		t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
 	}
+	defer changes.Close()
+	setWatcherLimits(b, 0)
 
-	var hi = "Hello, 世界!" + strings.Repeat("x", MaxInline)
-	eds := []edit.Edit{
-		edit.Insert(edit.All, hi),                                        // 1
-		edit.Change(edit.Regexp("世界"), "World"),                          // 2
-		edit.SubGlobal(edit.All, ",|!", "."),                             // 3
-		edit.Print(edit.All),                                             // 4
-		edit.Where(edit.Dot),                                             // 5
-		edit.Block(edit.All, edit.Where(edit.Dot), edit.Print(edit.Dot)), // 6
-		edit.Delete(edit.All),                                            // 7
-	}
 	textURL := s.PathURL(ed.Path, "text")
-	if res, err := Do(textURL, eds...); err != nil {
-		t.Fatalf("ed.Do(%q, %v...)=%v,%v want _,nil", textURL, eds, res, err)
+	e := edit.Insert(edit.All, "a") // 1
+	if res, err := Do(textURL, e); err != nil {
+		t.Fatalf("Do(%q, %v)=%v,%v, want _,nil", textURL, e, res, err)
+	}
+	select {
+	case <-b.watcherRemoved:
+	case <-time.After(1 * time.Second):
+		t.Errorf("timed out waiting for watcher to be removed")
+	}
+	if got, err := changes.Next(); err != ErrTruncated {
+		t.Errorf("changes.Next()=%v,%v, want _,%v", got, err, ErrTruncated)
 	}
 
-	wants := []ChangeList{
-		ChangeList{
-			Sequence: 1,
-			Changes: []Change{
-				{
-					Span:    edit.Span{0: 0, 1: 0},
-					NewSize: int64(utf8.RuneCountInString(hi)),
-				},
-			},
-		},
-		ChangeList{
-			Sequence: 2,
-			Changes: []Change{
-				{
-					Span:    edit.Span{0: 7, 1: 9},
-					NewSize: int64(utf8.RuneCountInString("World")),
-					Text:    []byte("World"),
-				},
-			},
-		},
-		ChangeList{
-			Sequence: 3,
-			Changes: []Change{
-				{
-					Span:    edit.Span{0: 5, 1: 6},
-					NewSize: 1,
-					Text:    []byte("."),
-				},
-				{
-					Span:    edit.Span{0: 12, 1: 13},
-					NewSize: 1,
-					Text:    []byte("."),
-				},
-			},
-		},
-		// Sequence 4 is a Print, which generates no change.
-		// Sequence 5 is a Where, which generates no change.
-		// Sequence 6 is a Block with Where and Print, which generates no change.
-		ChangeList{
-			Sequence: 7,
-			Changes: []Change{
-				{
-					// +3, because 世界 changed to World.
-					Span:    edit.Span{0: 0, 1: int64(utf8.RuneCountInString(hi)) + 3},
-					NewSize: 0,
-				},
-			},
-		},
+	// The stream is reconnected to receive new changes.
+	e = edit.Insert(edit.All, "b") // 2
+	if res, err := Do(textURL, e); err != nil {
+		t.Fatalf("Do(%q, %v)=%v,%v, want _,nil", textURL, e, res, err)
 	}
-	for _, want := range wants {
-		for i := range watchers {
-			got, err := watchers[i].Next()
-			if err != nil || !reflect.DeepEqual(got, want) {
-				t.Errorf("watchers[%d].Next()=%v,%v, want %v,nil", i, got, err, want)
-			}
-		}
+	if got, err := changes.Next(); err != nil || got.Sequence != 2 {
+		t.Errorf("changes.Next()=%v,%v, want {Sequence: 2},nil", got, err)
 	}
 }
 
-func TestChangeStream_Close(t *testing.T) {
+func TestChangeStream_EventsResync(t *testing.T) {
 	editorServer := NewServer()
 	s := editortest.NewServer(editorServer)
 	defer s.Close()
@@ -715,31 +2992,46 @@ func TestChangeStream_Close(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
 	}
-
-	editorServer.buffers[buf.ID].watcherRemoved = make(chan struct{})
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	b := editorServer.buffers[buf.ID]
+	b.watcherRemoved = make(chan struct{}, 1)
 
 	changesURL := s.PathURL(buf.Path, "changes")
-	changesURL.Scheme = "ws"
-	changes, err := Changes(changesURL)
+	req, err := http.NewRequest(http.MethodGet, changesURL.String(), nil)
 	if err != nil {
-		t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
+		t.Fatalf("http.NewRequest(GET, %q, nil)=_,%v", changesURL, err)
 	}
-
-	if err := changes.Close(); err != nil {
-		t.Fatalf("changes.Close()=%v, want nil", err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %q=_,%v, want _,nil", changesURL, err)
 	}
+	defer resp.Body.Close()
+	setWatcherLimits(b, 0)
 
-	// Wait 1 second for the server to receive the close
-	// and call the defer to remove the watcher.
-	// This is suboptimal, but better than nothing.
+	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, edit.Insert(edit.All, "a")); err != nil {
+		t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURL, res, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(GET %q)=_,%v, want _,nil", changesURL, err)
+	}
+	if want := "event: resync\ndata: resync required\n\n"; string(body) != want {
+		t.Errorf("GET %q body=%q, want %q", changesURL, body, want)
+	}
 	select {
-	case <-editorServer.buffers[buf.ID].watcherRemoved:
-	case <-time.After(1 * time.Second):
-		t.Errorf("timed out waiting for watcher to close")
+	case <-b.watcherRemoved:
+	default:
+		t.Errorf("watcher not removed")
 	}
 }
 
-func TestChangeStream_BufferClose(t *testing.T) {
+func TestChangeStream_BadLimit(t *testing.T) {
 	s := editortest.NewServer(NewServer())
 	defer s.Close()
 
@@ -748,35 +3040,309 @@ func TestChangeStream_BufferClose(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
 	}
+	for _, query := range []string{
+		"limit=0",
+		"limit=-1",
+		"limit=1025",
+		"limit=x",
+		"limit=1&limit=2",
+		"overflow=drop",
+		"overflow=close&overflow=reload",
+	} {
+		changesURL := s.PathURL(buf.Path, "changes")
+		changesURL.Scheme = "ws"
+		changesURL.RawQuery = query
+		changes, err := Changes(changesURL)
+		if hsErr, ok := err.(websocket.HandshakeError); !ok || hsErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("Changes(%q)=_,%v, want _,%v", changesURL, err, http.StatusBadRequest)
+		}
+		if err == nil {
+			changes.Close()
+		}
+	}
+}
 
-	changesURL := s.PathURL(buf.Path, "changes")
+func TestAuth(t *testing.T) {
+	const token = "secret"
+	editorServer := NewServer()
+	defer editorServer.Close()
+	router := mux.NewRouter()
+	editorServer.RegisterHandlers(router)
+	httpServer := httptest.NewServer(auth.Handler(token, router))
+	defer httpServer.Close()
+	u, err := url.Parse(httpServer.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q)=_,%v", httpServer.URL, err)
+	}
+
+	noToken := *u
+	noToken.Path = "/buffers"
+	if buf, err := NewBuffer(&noToken); err == nil {
+		t.Errorf("NewBuffer(%q)=%v,nil, want _,non-nil", noToken.String(), buf)
+	}
+	wrongToken := noToken
+	wrongToken.User = url.User("wrong")
+	if buf, err := NewBuffer(&wrongToken); err == nil {
+		t.Errorf("NewBuffer(%q)=%v,nil, want _,non-nil", wrongToken.String(), buf)
+	}
+
+	pathURL := func(elems ...string) *url.URL {
+		v := *u
+		v.User = url.User(token)
+		v.Path = path.Join(elems...)
+		return &v
+	}
+	buffersURL := pathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := pathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+
+	changesURL := pathURL(buf.Path, "changes")
 	changesURL.Scheme = "ws"
 	changes, err := Changes(changesURL)
 	if err != nil {
 		t.Fatalf("Changes(%q)=_,%v, want _,nil", changesURL, err)
 	}
+	defer changes.Close()
+
+	textURL := pathURL(ed.Path, "text")
+	if res, err := Do(textURL, edit.Insert(edit.All, "Hello")); err != nil {
+		t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURL, res, err)
+	}
+	cl, err := changes.Next()
+	if err != nil {
+		t.Fatalf("changes.Next()=_,%v, want _,nil", err)
+	}
+	if cl.Sequence != 1 || len(cl.Changes) != 1 || cl.Changes[0].NewSize != 5 {
+		t.Errorf("changes.Next()=%v, want sequence 1 inserting 5 runes", cl)
+	}
 
+	rd, err := Reader(textURL, edit.All)
+	if err != nil {
+		t.Fatalf("Reader(%q, %v)=_,%v, want _,nil", textURL, edit.All, err)
+	}
+	defer rd.Close()
+	if text, err := ioutil.ReadAll(rd); err != nil || string(text) != "Hello" {
+		t.Errorf("ReadAll(Reader(%q, %v))=%q,%v, want %q,nil", textURL, edit.All, text, err, "Hello")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("Hello, World"), 0640); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, _, 0640)=%v", file, err)
+	}
+	snapshotDir := filepath.Join(dir, "snapshot")
+
+	es := NewServer()
+	s := editortest.NewServer(es)
+	buffersURL := s.PathURL("/", "buffers")
+	closed, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, closed, err)
+	}
+	buf, err := NewFileBuffer(buffersURL, file)
+	if err != nil {
+		t.Fatalf("NewFileBuffer(%q, %q)=%v,%v, want _,nil", buffersURL, file, buf, err)
+	}
 	bufferURL := s.PathURL(buf.Path)
-	if err := Close(bufferURL); err != nil {
-		t.Fatalf("buf.Close()=%v, want nil", err)
+	var eds [2]Editor
+	for i := range eds {
+		if eds[i], err = NewEditor(bufferURL); err != nil {
+			t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, eds[i], err)
+		}
+	}
+	textURL := s.PathURL(eds[0].Path, "text")
+	for _, e := range []edit.Edit{
+		edit.Change(edit.Regexp("World"), "世界"),
+		edit.Append(edit.End, "!"),
+		edit.UndoLocal(1),
+		edit.Set(edit.Regexp("世界"), 'm'),
+	} {
+		if res, err := Do(textURL, e); err != nil || len(res) != 1 || res[0].Error != "" {
+			t.Fatalf("Do(%q, %v)=%v,%v, want no error", textURL, e, res, err)
+		}
+	}
+	registerURL := s.PathURL(eds[1].Path, "register", "r")
+	if err := SetRegister(registerURL, []byte("register text")); err != nil {
+		t.Fatalf("SetRegister(%q, _)=%v, want nil", registerURL, err)
 	}
 
-	if _, err := changes.Next(); err == nil {
-		t.Errorf("changes.Next()=_,%v, want non-nil", err)
+	// Snapshot twice; the second snapshot replaces the first.
+	if err := es.Snapshot(snapshotDir, true); err != nil {
+		t.Fatalf("es.Snapshot(%q, true)=%v, want nil", snapshotDir, err)
+	}
+	closedURL := s.PathURL(closed.Path)
+	if err := Close(closedURL); err != nil {
+		t.Fatalf("Close(%q)=%v, want nil", closedURL, err)
+	}
+	if err := es.Snapshot(snapshotDir, true); err != nil {
+		t.Fatalf("es.Snapshot(%q, true)=%v, want nil", snapshotDir, err)
+	}
+	wantBufs, err := BufferList(buffersURL)
+	if err != nil {
+		t.Fatalf("BufferList(%q)=%v,%v, want _,nil", buffersURL, wantBufs, err)
+	}
+	wantMarks, err := GetMarks(s.PathURL(eds[0].Path, "marks"))
+	if err != nil {
+		t.Fatalf("GetMarks(%q)=%v,%v, want _,nil", s.PathURL(eds[0].Path, "marks"), wantMarks, err)
+	}
+	s.Close()
+	if _, err := os.Stat(filepath.Join(snapshotDir, "buffer-"+closed.ID)); !os.IsNotExist(err) {
+		t.Errorf("the snapshot file of closed buffer %s exists", closed.ID)
+	}
+
+	restored, err := Restore(snapshotDir)
+	if err != nil {
+		t.Fatalf("Restore(%q)=_,%v, want _,nil", snapshotDir, err)
+	}
+	s = editortest.NewServer(restored)
+	defer s.Close()
+
+	buffersURL = s.PathURL("/", "buffers")
+	switch bufs, err := BufferList(buffersURL); {
+	case err != nil:
+		t.Fatalf("BufferList(%q)=%v,%v, want _,nil", buffersURL, bufs, err)
+	case !reflect.DeepEqual(bufs, wantBufs):
+		t.Errorf("BufferList(%q)=%v, want %v", buffersURL, bufs, wantBufs)
+	}
+	marksURL := s.PathURL(eds[0].Path, "marks")
+	switch marks, err := GetMarks(marksURL); {
+	case err != nil:
+		t.Fatalf("GetMarks(%q)=%v,%v, want _,nil", marksURL, marks, err)
+	case !reflect.DeepEqual(marks, wantMarks):
+		t.Errorf("GetMarks(%q)=%v, want %v", marksURL, marks, wantMarks)
+	}
+	registerURL = s.PathURL(eds[1].Path, "register", "r")
+	switch text, err := Register(registerURL); {
+	case err != nil:
+		t.Fatalf("Register(%q)=%q,%v, want _,nil", registerURL, text, err)
+	case string(text) != "register text":
+		t.Errorf("Register(%q)=%q, want %q", registerURL, text, "register text")
+	}
+	if text := bufferText(t, s, buf); text != "Hello, 世界" {
+		t.Errorf("restored text=%q, want %q", text, "Hello, 世界")
+	}
+
+	// The local and buffer-wide undo histories are restored.
+	textURL = s.PathURL(eds[0].Path, "text")
+	for _, test := range []struct {
+		edit edit.Edit
+		want string
+	}{
+		{edit: edit.RedoLocal(1), want: "Hello, 世界!"},
+		{edit: edit.UndoLocal(2), want: "Hello, World"},
+		{edit: edit.Undo(1), want: "Hello, 世界"},
+	} {
+		if res, err := Do(textURL, test.edit); err != nil || len(res) != 1 || res[0].Error != "" {
+			t.Fatalf("Do(%q, %v)=%v,%v, want no error", textURL, test.edit, res, err)
+		}
+		if text := bufferText(t, s, buf); text != test.want {
+			t.Errorf("after %v, text=%q, want %q", test.edit, text, test.want)
+		}
+	}
+
+	// New buffers do not reuse the IDs of closed buffers.
+	newBuf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, newBuf, err)
+	}
+	for _, id := range []string{closed.ID, buf.ID, eds[0].ID, eds[1].ID} {
+		if newBuf.ID == id {
+			t.Errorf("NewBuffer(%q).ID=%q, which was already used", buffersURL, newBuf.ID)
+		}
 	}
 }
 
-func TestChangeStream_NotFound(t *testing.T) {
-	s := editortest.NewServer(NewServer())
+func TestSnapshot_NoHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	es := NewServer()
+	s := editortest.NewServer(es)
+	buffersURL := s.PathURL("/", "buffers")
+	buf, err := NewBuffer(buffersURL)
+	if err != nil {
+		t.Fatalf("NewBuffer(%q)=%v,%v, want _,nil", buffersURL, buf, err)
+	}
+	bufferURL := s.PathURL(buf.Path)
+	ed, err := NewEditor(bufferURL)
+	if err != nil {
+		t.Fatalf("NewEditor(%q)=%v,%v, want _,nil", bufferURL, ed, err)
+	}
+	textURL := s.PathURL(ed.Path, "text")
+	if res, err := Do(textURL, edit.Append(edit.End, "Hello")); err != nil {
+		t.Fatalf("Do(%q, …)=%v,%v, want _,nil", textURL, res, err)
+	}
+	if err := es.Snapshot(dir, false); err != nil {
+		t.Fatalf("es.Snapshot(%q, false)=%v, want nil", dir, err)
+	}
+	s.Close()
+
+	restored, err := Restore(dir)
+	if err != nil {
+		t.Fatalf("Restore(%q)=_,%v, want _,nil", dir, err)
+	}
+	s = editortest.NewServer(restored)
 	defer s.Close()
+	textURL = s.PathURL(ed.Path, "text")
+	for _, e := range []edit.Edit{edit.UndoLocal(1), edit.Undo(1)} {
+		if res, err := Do(textURL, e); err != nil || len(res) != 1 || res[0].Error != "" {
+			t.Fatalf("Do(%q, %v)=%v,%v, want no error", textURL, e, res, err)
+		}
+		if text := bufferText(t, s, buf); text != "Hello" {
+			t.Errorf("after %v, text=%q, want %q", e, text, "Hello")
+		}
+	}
 
-	changesURL := s.PathURL("buffer", "notfound", "changes")
+	// The change history is not restored.
+	changesURL := s.PathURL(buf.Path, "changes")
 	changesURL.Scheme = "ws"
-	changes, err := Changes(changesURL)
-	if err != ErrNotFound {
-		t.Errorf("Changes(%q)=_,%v, want _,%v", changesURL, err, ErrNotFound)
+	if changes, err := ChangesSince(changesURL, 0); err != ErrTruncated {
+		t.Errorf("ChangesSince(%q, 0)=_,%v, want _,%v", changesURL, err, ErrTruncated)
+		if err == nil {
+			changes.Close()
+		}
 	}
-	if err == nil {
-		changes.Close()
+}
+
+func TestRestore_Error(t *testing.T) {
+	dir, err := ioutil.TempDir("", "editor_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(\"\", \"editor_test\")=_,%v", err)
+	}
+	defer os.RemoveAll(dir)
+	if s, err := Restore(dir); err == nil {
+		s.Close()
+		t.Errorf("Restore(%q)=_,nil, want error", dir)
+	}
+
+	file := filepath.Join(dir, "server.json")
+	for _, snap := range []string{
+		`{"nextID": 1, "buffers": [{"id": "0"}]}`,
+		`{"nextID": 1, "buffers": [{"id": "../0"}]}`,
+		`{"nextID": 0, "buffers": [{"id": "0"}]}`,
+	} {
+		if err := ioutil.WriteFile(file, []byte(snap), 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile(%q, _, 0600)=%v", file, err)
+		}
+		if s, err := Restore(dir); err == nil {
+			s.Close()
+			t.Errorf("Restore(%s)=_,nil, want error", snap)
+		}
 	}
 }
@@ -0,0 +1,222 @@
+// Copyright © 2016, The T Authors.
+
+package editor
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eaburns/T/edit"
+)
+
+// A fileStat records the state of a file
+// when it was last read or written by a buffer.
+type fileStat struct {
+	// Path is the path of the file.
+	// It is empty if the buffer never read or wrote a file.
+	path string
+	// Exists is whether the file existed.
+	// If it is false, the remaining fields are zero values.
+	exists  bool
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// A fileHash is the hash of a file
+// with a given modification time and size.
+type fileHash struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// Info returns the buffer's Buffer.
+// If the staleness of the buffer's file
+// cannot be determined without hashing the file,
+// info also returns a fileCheck,
+// whose stale method must be called to set the Stale field.
+// Must be called with the read Lock held,
+// but the fileCheck should be used after it is released.
+func (buf *buffer) info() (Buffer, *fileCheck) {
+	info := buf.Buffer
+	info.Dirty = buf.changed > buf.clean || buf.File != buf.stat.path
+	var c *fileCheck
+	info.Stale, c = buf.stale()
+	return info, c
+}
+
+// Stale returns whether the buffer's file differs
+// from when the buffer last read or wrote it.
+// If the file's modification time changed, but not its size,
+// its contents must be hashed,
+// so stale instead returns a fileCheck that returns the staleness.
+// Must be called with the read Lock held.
+func (buf *buffer) stale() (bool, *fileCheck) {
+	if buf.File == "" || buf.File != buf.stat.path {
+		return false, nil
+	}
+	info, err := os.Stat(buf.File)
+	switch {
+	case os.IsNotExist(err):
+		return buf.stat.exists, nil
+	case err != nil || !buf.stat.exists || info.Size() != buf.stat.size:
+		return true, nil
+	case info.ModTime().Equal(buf.stat.modTime):
+		return false, nil
+	}
+	// The modification time changed, but the contents may not have.
+	return false, &fileCheck{
+		path:    buf.File,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		hash:    buf.stat.hash,
+		checked: &buf.checked,
+	}
+}
+
+// A fileCheck hashes a buffer's file to check whether it is stale.
+// It holds copies of the buffer's fields,
+// so that the file can be read without the buffer's Lock held.
+type fileCheck struct {
+	// Path, modTime, and size are of the file when the check was created.
+	path    string
+	modTime time.Time
+	size    int64
+	// Hash is the hash of the file
+	// when the buffer last read or wrote it.
+	hash [sha256.Size]byte
+	// Checked is the buffer's cache of the most recent hash.
+	checked *fileHash
+}
+
+// Stale returns whether the hash of the file
+// differs from that of when the buffer last read or wrote it.
+// The hash is cached until the modification time or size changes.
+func (c *fileCheck) stale() bool {
+	// The cache has its own Mutex,
+	// since the buffer's Lock is not held.
+	c.checked.Lock()
+	defer c.checked.Unlock()
+	ch := c.checked
+	if ch.path == c.path && ch.modTime.Equal(c.modTime) && ch.size == c.size {
+		return ch.hash != c.hash
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return true
+	}
+	ch.path, ch.modTime, ch.size = c.path, c.modTime, c.size
+	copy(ch.hash[:], h.Sum(nil))
+	return ch.hash != c.hash
+}
+
+// Load replaces the text of the buffer with the contents of a file.
+// Must be called with the write Lock held.
+func (buf *buffer) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	ed := buf.tempEditor()
+	if _, err := ed.Change(edit.Span{0, ed.Size()}, io.TeeReader(f, h)); err != nil {
+		return err
+	}
+	if err := ed.Apply(); err != nil {
+		return err
+	}
+	buf.Sequence++
+	buf.clean = buf.Sequence
+	buf.stat = fileStat{
+		path:    path,
+		exists:  true,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	copy(buf.stat.hash[:], h.Sum(nil))
+	return nil
+}
+
+// Save writes the text of the buffer to a file.
+// Must be called with the write Lock held.
+func (buf *buffer) save(path string) error {
+	h := sha256.New()
+	r := io.TeeReader(buf.buffer.Reader(edit.Span{0, buf.buffer.Size()}), h)
+	if err := writeFile(path, r); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	buf.clean = buf.Sequence
+	buf.stat = fileStat{
+		path:    path,
+		exists:  true,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	copy(buf.stat.hash[:], h.Sum(nil))
+	return nil
+}
+
+// WriteFile atomically replaces the file at the path
+// with the contents read from the Reader.
+// The contents are written to a temporary file in the same directory,
+// which is then renamed to the path.
+// If the path exists, the new file has the same permissions as the old.
+// If the path is a symbolic link, the file to which it links is replaced.
+func writeFile(path string, r io.Reader) (err error) {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p
+	}
+	mode := os.FileMode(0644)
+	switch info, err := os.Stat(path); {
+	case err == nil:
+		mode = info.Mode().Perm()
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,114 @@
+// Copyright © 2016, The T Authors.
+
+package editor
+
+import (
+	"context"
+	"errors"
+
+	"github.com/eaburns/T/edit"
+)
+
+// ErrEditorClosed indicates that an editor
+// or its buffer was closed while the editor was released.
+var errEditorClosed = errors.New("editor closed")
+
+// Begin begins an edit request with the given Context
+// and its CancelFunc.
+// If atomic is true, the editor is not released during the request.
+// It must be called with the editing lock held.
+func (ed *editor) begin(ctx context.Context, cancel context.CancelFunc, atomic bool) {
+	ed.ctx = ctx
+	ed.atomic = atomic
+	ed.cancelMu.Lock()
+	ed.cancel = cancel
+	ed.cancelMu.Unlock()
+}
+
+// End ends the current edit request.
+// It must be called with the editing lock held.
+func (ed *editor) end() {
+	ed.cancelMu.Lock()
+	ed.cancel = nil
+	ed.cancelMu.Unlock()
+	ed.ctx = nil
+	ed.atomic = false
+}
+
+// CancelEdit cancels the current edit request, if any.
+func (ed *editor) cancelEdit() {
+	ed.cancelMu.Lock()
+	if ed.cancel != nil {
+		ed.cancel()
+	}
+	ed.cancelMu.Unlock()
+}
+
+// Context returns the Context of the current edit request,
+// or the background Context if there is none.
+func (ed *editor) Context() context.Context {
+	if ed.ctx == nil {
+		return context.Background()
+	}
+	return ed.ctx
+}
+
+// Closed returns whether the editor or its buffer was closed.
+// Must be called with the buffer's Lock held.
+func (ed *editor) closed() bool {
+	select {
+	case <-ed.buffer.done:
+		return true
+	default:
+		return ed.temporary()
+	}
+}
+
+// Release unlocks the buffer, so that it can be used by others
+// while an edit of the editor waits for a command.
+// Temporary editors, editors with pending changes,
+// and editors of atomic edit requests are not released.
+// It must only be called by an edit, with the buffer's write Lock held.
+func (ed *editor) Release() bool {
+	if len(ed.pending) > 0 || ed.temporary() || ed.atomic {
+		return false
+	}
+	dot := ed.marks['.']
+	ed.watch, ed.watchConflict = &dot, false
+	ed.buffer.Unlock()
+	return true
+}
+
+// Acquire re-locks the buffer of a released editor,
+// and sets dot to its watched Span.
+// If the editor or its buffer was closed while it was released,
+// the current edit request is canceled.
+func (ed *editor) Acquire() error {
+	ed.buffer.Lock()
+	dot, conflict := *ed.watch, ed.watchConflict
+	ed.watch = nil
+	switch {
+	case ed.closed():
+		ed.cancelEdit()
+		return errEditorClosed
+	case conflict:
+		return edit.ErrConflict
+	}
+	ed.marks['.'] = dot
+	return nil
+}
+
+// RebaseWatch updates the watched dot of a released editor
+// for applied changes.
+// A change that overlaps the watched dot is a conflict.
+func (ed *editor) rebaseWatch(as []applied) {
+	if ed.watch == nil {
+		return
+	}
+	for _, a := range as {
+		var ok bool
+		if *ed.watch, ok = rebaseSpan(*ed.watch, a); !ok {
+			ed.watchConflict = true
+		}
+	}
+}
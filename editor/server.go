@@ -4,21 +4,48 @@ package editor
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/eaburns/T/edit"
+	"github.com/eaburns/T/edit/runes"
 	"github.com/eaburns/T/websocket"
 	"github.com/gorilla/mux"
 )
 
+// MaxHistory is the maximum number of ChangeLists
+// kept in the history of each buffer.
+const maxHistory = 1024
+
+// MaxBacklog is the default and maximum number of ChangeLists
+// waiting to be sent on a change stream.
+const maxBacklog = 1024
+
+// ResyncReason is the reason with which a change stream is closed
+// when its backlog exceeds its limit.
+const resyncReason = "resync required"
+
+// CoalesceWindow is the maximum time between consecutive insertions
+// by the same editor that are merged into a single undo state.
+const coalesceWindow = time.Second
+
 // Server implements http.Handler, serving an HTTP text editor.
 // It provides an HTTP API for creating buffers of text
 // and editors to read and modify those buffers.
@@ -34,7 +61,8 @@ import (
 // using the T edit language documented here:
 // https://godoc.org/github.com/eaburns/T/edit#Ed.
 // While multiple editors can edit the same buffer concurrently,
-// each editor maintains its own local state.
+// each editor maintains its own local state,
+// such as its marks and registers.
 type Server struct {
 	sync.RWMutex
 	buffers map[string]*buffer
@@ -75,10 +103,44 @@ func (s *Server) Close() error {
 // 	• OK on success.
 // 	• Internal Server Error on internal error.
 //
-// 	PUT creates a new, empty buffer and returns its Buffer.
+// 	PUT creates a new buffer and returns its Buffer.
+// 	Parameters:
+// 	• file can optionally be set to the path of a file.
+// 	  If it is set, the buffer is associated with the file,
+// 	  and the buffer's text is read from the file if it exists.
+// 	  Otherwise, the buffer is empty.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Bad Request if the URL parameters are malformed.
+//
+//  /buffers/edit performs edits on multiple buffers, like Sam's X and Y.
+//
+// 	POST performs an atomic sequence of edits on each selected buffer.
+// 	Unlike the edits of an editor, the buffers are not released
+// 	while the command of a pipe edit runs.
+// 	The body must be a JSON object with the following fields:
+// 	• match is a regular expression matched against
+// 	  the path of each buffer and of its file, if any.
+// 	• exclude is an optional boolean.
+// 	  If it is false, the buffers with a matching path are selected.
+// 	  If it is true, the buffers without a matching path are selected.
+// 	• edits is an ordered list of Edits.
+// 	The edits are performed on each selected buffer in turn
+// 	by a new editor with all marks set to the empty string
+// 	at the beginning of the buffer, and no registers set.
+// 	The response is a BufferEditResult list,
+// 	in increasing order of buffer ID.
+// 	Parameters:
+// 	• units can optionally be set to runes or bytes.
+// 	  If it is bytes, the edits are performed
+// 	  with offsets into the UTF-8 encoding of the text.
+// 	  The default is runes.
 // 	Returns:
 // 	• OK on success.
 // 	• Internal Server Error on internal error.
+// 	• Bad Request if the URL parameters, body, or Edit list are malformed.
+// 	  If an Edit is malformed, the body is a ParseError.
 //
 //  /buffer/<ID> is the buffer with the given ID.
 //
@@ -105,9 +167,86 @@ func (s *Server) Close() error {
 // 	GET upgrades the connection to a websocket.
 // 	A ChangeList is sent on the websocket
 // 	for each edit made to the buffer.
+// 	If the Accept header accepts text/event-stream,
+// 	the ChangeLists are instead sent as a Server-Sent Events stream.
+// 	Each event has the type change, the ChangeList's Sequence as its ID,
+// 	and the JSON-encoded ChangeList as its data.
+// 	If since is not set, the Last-Event-ID header sets it,
+// 	so a reconnecting event stream resumes after its last event.
+// 	If more than limit ChangeLists are waiting to be sent,
+// 	the stream is overflowed and handled according to overflow.
+// 	Parameters:
+// 	• units can optionally be set to runes or bytes.
+// 	  It sets the units of the Change Spans and sizes.
+// 	  The default is runes.
+// 	• since can optionally be set to a sequence number.
+// 	  If it is set, the ChangeLists of edits after that sequence number
+// 	  are sent before those of new edits.
+// 	  The buffer keeps a history of only its most recent ChangeLists;
+// 	  if the history no longer has all of the ChangeLists after since,
+// 	  the response is Gone.
+// 	• inline can optionally be set to a size in bytes.
+// 	  The Text of a Change is set only if its new text
+// 	  is no greater than the inline size.
+// 	  The default is MaxInline, and the maximum is MaxInlineLimit.
+// 	  The Text of a replayed ChangeList may not be set
+// 	  for changes that were made while no stream
+// 	  requested an inline size that large.
+// 	• limit can optionally be set to the maximum number of ChangeLists
+// 	  waiting to be sent on the stream, from 1 to 1024.
+// 	  The default is 1024.
+// 	• overflow can optionally be set to close or reload.
+// 	  If it is close, an overflowed stream is closed:
+// 	  a websocket is closed with the reason "resync required",
+// 	  and an event stream ends with a resync event.
+// 	  If it is reload, the waiting ChangeLists of an overflowed stream
+// 	  are replaced by a single ChangeList with Reload set.
+// 	  The default is close.
+// 	• editor can optionally be set to the ID of an editor of the buffer.
+// 	  If it is set, the Marks of each ChangeList of a new edit
+// 	  are set to the editor's marks just after the changes.
+// 	Returns:
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the buffer is not found.
+// 	• Bad Request if the URL parameters are malformed.
+// 	• Gone if the ChangeLists after since are no longer in the history.
+//
+//  /buffer/<ID>/get reads the buffer's file, like Sam's e.
+//
+// 	POST replaces the buffer's text with the contents of its file
+// 	and returns the buffer's Buffer.
+// 	The text is replaced by a single edit.
+// 	Parameters:
+// 	• file can optionally be set to the path of a file.
+// 	  If it is set, the file is read instead of the buffer's file,
+// 	  and on success, the buffer is associated with the file.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the buffer or the file is not found.
+// 	• Bad Request if the URL parameters are malformed
+// 	  or the buffer is not associated with a file.
+//
+//  /buffer/<ID>/put writes the buffer's file, like Sam's w.
+//
+// 	POST writes the buffer's text to its file
+// 	and returns the buffer's Buffer.
+// 	The file is replaced atomically
+// 	and it keeps the permissions of the file that it replaces.
+// 	Parameters:
+// 	• file can optionally be set to the path of a file.
+// 	  If it is set, the file is written instead of the buffer's file,
+// 	  and on success, the buffer is associated with the file.
+// 	• force can optionally be set to true or false.
+// 	  If it is true, the file is written even if it is stale.
+// 	  The default is false.
 // 	Returns:
+// 	• OK on success.
 // 	• Internal Server Error on internal error.
 // 	• Not Found if the buffer is not found.
+// 	• Bad Request if the URL parameters are malformed
+// 	  or the buffer is not associated with a file.
+// 	• Precondition Failed if the file is stale and force is not true.
 //
 //  /editor/<ID> is the editor with the given ID.
 //
@@ -131,35 +270,174 @@ func (s *Server) Close() error {
 // 	  It must not appear multiple times, there can only be one addr.
 // 	  If it is set, only the text within the address is returned.
 //  	  Otherwise, all text is returned.
+// 	• units can optionally be set to runes or bytes.
+// 	  If it is bytes, the address is evaluated
+// 	  with offsets into the UTF-8 encoding of the text.
+// 	  The default is runes.
 // 	Returns:
 // 	• OK on success.
 // 	• Internal Server Error on internal error.
 // 	• Not Found if the editor is not found.
 // 	• Bad Request if the URL parameters or addr value are malformed.
+// 	  If the addr value is malformed, the body is a ParseError.
 // 	• Range Not Satisfiable if there is an error evaluating the address.
 // 	  The response body will contain an error message.
+// 	On success, the ETag header is the buffer's sequence number.
 //
-// 	POST performs an atomic sequence of edits on the buffer.
-// 	The body must be an ordered list of Edits.
+// 	POST performs a sequence of edits on the buffer.
+// 	The body must be either an ordered list of Edits
+// 	or a JSON object with the following fields:
+// 	• sequence is an optional, expected sequence number of the buffer.
+// 	• edits is an ordered list of Edits.
+// 	The edits are only performed if the buffer's sequence number
+// 	is the expected sequence number given by the sequence field
+// 	and by the If-Match header, if either is set.
+// 	The edits are atomic, unless the buffer is released
+// 	by a pipe edit, as described below.
+// 	The If-Match header may be *, or a list of entity tags,
+// 	each of which is a quoted sequence number, for example, "12".
 // 	The response is an ordered list of EditResult.
+// 	On success, the ETag header is the buffer's sequence number
+// 	after the edits.
+// 	Parameters:
+// 	• units can optionally be set to runes or bytes.
+// 	  If it is bytes, the edits are performed
+// 	  with offsets into the UTF-8 encoding of the text,
+// 	  for example, as printed by =#.
+// 	  The default is runes.
+// 	• timeout can optionally be set to a duration, for example, 10s.
+// 	  If it is set, commands run by the edits are killed
+// 	  once the duration has passed since the request.
+// 	The edits of an editor are performed one request at a time.
+// 	While a command of a pipe edit runs, outside of a loop or block,
+// 	the buffer is released for use by others,
+// 	unless the sequence field is set
+// 	or the If-Match header is set to a list of entity tags.
+// 	The edits of other editors may then be performed
+// 	between the edits before and after the pipe edit.
+// 	If another editor changes the piped text while the command runs,
+// 	the pipe edit fails with a conflicting change error.
+// 	If the request is canceled, by its connection closing
+// 	or with the editor's cancel path, commands are killed,
+// 	and the edits that have not yet begun are not performed.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the editor is not found.
+// 	• Bad Request if the URL parameters, If-Match header,
+// 	  body, or Edit list are malformed.
+// 	  If an Edit is malformed, the body is a ParseError.
+// 	• Conflict if the buffer's sequence number is not the expected one.
+// 	  The body is a ConflictError with the buffer's sequence number.
+//
+//  /editor/<ID>/cancel cancels the editor's edits.
+//
+// 	POST cancels the edits of the editor's in-progress request, if any.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the editor is not found.
+//
+//  /editor/<ID>/group is the editor's undo group.
+//  The changes of an editor's edits create states of the buffer's undo tree.
+//  Within an undo group, the changes of the editor's edits
+//  are merged into a single state, which is undone and redone as a whole.
+//  Changes made by other editors, undo, and redo
+//  end the state into which changes are merged;
+//  the next change of the group begins a new state.
+//  Outside of an undo group, an edit that inserts text
+//  just after the text inserted by the editor's previous edit,
+//  within a short time, is merged into the same state.
+//
+// 	PUT begins an undo group.
+// 	Groups may be nested;
+// 	changes are merged until the outermost group ends.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the editor is not found.
+//
+// 	DELETE ends an undo group.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the editor is not found.
+// 	• Bad Request if the editor has no undo group.
+//
+//  /editor/<ID>/marks is the editor's marks.
+//
+// 	GET returns the editor's Marks.
+// 	Marks that were never set are not returned;
+// 	they are the empty string at the start of the buffer.
+// 	Parameters:
+// 	• units can optionally be set to runes or bytes.
+// 	  It sets the units of the mark Spans.
+// 	  The default is runes.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the editor is not found.
+// 	• Bad Request if the URL parameters are malformed.
+//
+// 	PUT sets the marks of the request body, which must be Marks.
+// 	Either all of the marks are set or none of them are.
+// 	Marks not in the body are unchanged.
+// 	Parameters:
+// 	• units can optionally be set to runes or bytes.
+// 	  It sets the units of the mark Spans.
+// 	  The default is runes.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the editor is not found.
+// 	• Bad Request if the URL parameters or the body are malformed.
+// 	• Range Not Satisfiable if a Span is outside of the text.
+//
+//  /editor/<ID>/register/<name> is the editor's register with the given name.
+//  The name is a single rune.
+//
+// 	GET returns the text of the register.
+// 	If the register was never set, the text is empty.
+// 	Returns:
+// 	• OK on success.
+// 	• Internal Server Error on internal error.
+// 	• Not Found if the editor is not found.
+// 	• Bad Request if the name is not a single rune.
+//
+// 	PUT sets the text of the register to the request body.
 // 	Returns:
 // 	• OK on success.
 // 	• Internal Server Error on internal error.
 // 	• Not Found if the editor is not found.
-// 	• Bad Request if the Edit list is malformed.
+// 	• Bad Request if the name is not a single rune.
 //
 // Unless otherwise stated, the body of all error responses is the error message.
+//
+// The handlers accept any request.
+// To require a secret token with each request,
+// serve the Router wrapped with auth.Handler,
+// and give the token as the user name of the server's URL to clients.
 func (s *Server) RegisterHandlers(r *mux.Router) {
 	r.HandleFunc("/buffers", s.listBuffers).Methods(http.MethodGet)
 	r.HandleFunc("/buffers", s.newBuffer).Methods(http.MethodPut)
+	r.HandleFunc("/buffers/edit", s.editBuffers).Methods(http.MethodPost)
 	r.HandleFunc("/buffer/{id}", s.bufferInfo).Methods(http.MethodGet)
 	r.HandleFunc("/buffer/{id}", s.closeBuffer).Methods(http.MethodDelete)
 	r.HandleFunc("/buffer/{id}", s.newEditor).Methods(http.MethodPut)
 	r.HandleFunc("/buffer/{id}/changes", s.changes).Methods(http.MethodGet)
+	r.HandleFunc("/buffer/{id}/get", s.getFile).Methods(http.MethodPost)
+	r.HandleFunc("/buffer/{id}/put", s.putFile).Methods(http.MethodPost)
 	r.HandleFunc("/editor/{id}", s.editorInfo).Methods(http.MethodGet)
 	r.HandleFunc("/editor/{id}", s.closeEditor).Methods(http.MethodDelete)
 	r.HandleFunc("/editor/{id}/text", s.read).Methods(http.MethodGet)
 	r.HandleFunc("/editor/{id}/text", s.edit).Methods(http.MethodPost)
+	r.HandleFunc("/editor/{id}/cancel", s.cancelEdit).Methods(http.MethodPost)
+	r.HandleFunc("/editor/{id}/group", s.beginGroup).Methods(http.MethodPut)
+	r.HandleFunc("/editor/{id}/group", s.endGroup).Methods(http.MethodDelete)
+	r.HandleFunc("/editor/{id}/marks", s.readMarks).Methods(http.MethodGet)
+	r.HandleFunc("/editor/{id}/marks", s.writeMarks).Methods(http.MethodPut)
+	r.HandleFunc("/editor/{id}/register/{name}", s.readRegister).Methods(http.MethodGet)
+	r.HandleFunc("/editor/{id}/register/{name}", s.writeRegister).Methods(http.MethodPut)
 }
 
 // respond JSON encodes resp to w, and sends an Internal Server Error on failure.
@@ -175,34 +453,126 @@ func respond(w http.ResponseWriter, resp interface{}) {
 	}
 }
 
+// respondParseError responds with a Bad Request.
+// If err is an *edit.ParseError, the body is a JSON-encoded ParseError
+// for the ith Edit, otherwise the body is the error message.
+func respondParseError(w http.ResponseWriter, i int, err error) {
+	perr, ok := err.(*edit.ParseError)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := json.Marshal(ParseError{
+		Edit:     i,
+		Offset:   perr.Offset,
+		Token:    perr.Token,
+		Expected: perr.Expected,
+		Message:  perr.Err.Error(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(body)
+}
+
+// UseBytes returns whether the units parameter selects byte units.
+func useBytes(vars url.Values) (bool, error) {
+	switch u := vars["units"]; {
+	case len(u) == 0:
+		return false, nil
+	case len(u) > 1:
+		return false, errors.New("units can only be given once")
+	case u[0] == "runes":
+		return false, nil
+	case u[0] == "bytes":
+		return true, nil
+	default:
+		return false, errors.New("bad units: " + u[0])
+	}
+}
+
 func (s *Server) listBuffers(w http.ResponseWriter, req *http.Request) {
 	s.RLock()
-	var bufs []Buffer
+	bs := make([]*buffer, 0, len(s.buffers))
 	for _, b := range s.buffers {
-		bufs = append(bufs, b.Buffer)
+		bs = append(bs, b)
 	}
 	s.RUnlock()
 
+	// The info is computed without the server Lock,
+	// and the stale files are read without the buffer Locks.
+	var bufs []Buffer
+	for _, b := range bs {
+		b.RLock()
+		select {
+		case <-b.done:
+			// The buffer was closed after it was listed.
+			b.RUnlock()
+			continue
+		default:
+		}
+		info, c := b.info()
+		b.RUnlock()
+		if c != nil {
+			info.Stale = c.stale()
+		}
+		bufs = append(bufs, info)
+	}
+
 	respond(w, bufs)
 }
 
 func (s *Server) newBuffer(w http.ResponseWriter, req *http.Request) {
-	s.Lock()
-	id := strconv.Itoa(s.nextID)
-	s.nextID++
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, err := fileParam(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	buf := &buffer{
-		Buffer: Buffer{
-			ID:   id,
-			Path: path.Join("/", "buffer", id),
-		},
-		buffer:  edit.NewBuffer(),
-		editors: make(map[string]*editor),
-		done:    make(chan struct{}),
+		Buffer:     Buffer{File: file},
+		buffer:     edit.NewBuffer(),
+		editors:    make(map[string]*editor),
+		done:       make(chan struct{}),
+		maxHistory: maxHistory,
+		coalesce:   coalesceWindow,
+	}
+	buf.buffer.SetMoveFunc(buf.moved)
+	if file != "" {
+		switch err := buf.load(file); {
+		case os.IsNotExist(err):
+			// The file will be created when the buffer is written.
+			buf.stat = fileStat{path: file}
+		case err != nil:
+			buf.close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
+
+	s.Lock()
+	buf.ID = strconv.Itoa(s.nextID)
+	buf.Path = path.Join("/", "buffer", buf.ID)
+	s.nextID++
 	s.buffers[buf.ID] = buf
+	buf.RLock()
 	s.Unlock()
+	info, c := buf.info()
+	buf.RUnlock()
+	if c != nil {
+		info.Stale = c.stale()
+	}
 
-	respond(w, buf.Buffer)
+	respond(w, info)
 }
 
 func (s *Server) bufferInfo(w http.ResponseWriter, req *http.Request) {
@@ -213,10 +583,13 @@ func (s *Server) bufferInfo(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
+	s.RUnlock()
 	buf.RLock()
-	info := buf.Buffer
+	info, c := buf.info()
 	buf.RUnlock()
-	s.RUnlock()
+	if c != nil {
+		info.Stale = c.stale()
+	}
 
 	respond(w, info)
 }
@@ -242,7 +615,189 @@ func (s *Server) closeBuffer(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (s *Server) getFile(w http.ResponseWriter, req *http.Request) {
+	s.fileOp(w, req, (*buffer).load)
+}
+
+func (s *Server) putFile(w http.ResponseWriter, req *http.Request) {
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var force bool
+	switch f := vars["force"]; {
+	case len(f) > 1:
+		http.Error(w, "force can only be given once", http.StatusBadRequest)
+		return
+	case len(f) == 1:
+		if force, err = strconv.ParseBool(f[0]); err != nil {
+			http.Error(w, "bad force: "+f[0], http.StatusBadRequest)
+			return
+		}
+	}
+	s.fileOp(w, req, func(buf *buffer, file string) error {
+		if !force && file == buf.File {
+			// The file is hashed with the Lock held,
+			// so that the buffer cannot be saved or loaded
+			// between the check and the save.
+			stale, c := buf.stale()
+			if c != nil {
+				stale = c.stale()
+			}
+			if stale {
+				return ErrStale
+			}
+		}
+		return buf.save(file)
+	})
+}
+
+// FileOp performs op on the buffer named by the request
+// with the file parameter, if any, or the buffer's file.
+// If op succeeds, the buffer is bound to the file.
+func (s *Server) fileOp(w http.ResponseWriter, req *http.Request, op func(*buffer, string) error) {
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, err := fileParam(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.RLock()
+	buf, ok := s.buffers[mux.Vars(req)["id"]]
+	if !ok {
+		s.RUnlock()
+		http.NotFound(w, req)
+		return
+	}
+	buf.Lock()
+	s.RUnlock()
+
+	if file == "" {
+		file = buf.File
+	}
+	if file == "" {
+		buf.Unlock()
+		http.Error(w, "no file", http.StatusBadRequest)
+		return
+	}
+	switch err := op(buf, file); {
+	case err == ErrStale:
+		buf.Unlock()
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case os.IsNotExist(err):
+		buf.Unlock()
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		buf.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.File = file
+	info, c := buf.info()
+	buf.Unlock()
+	if c != nil {
+		info.Stale = c.stale()
+	}
+	respond(w, info)
+}
+
+// FileParam returns the absolute path of the file parameter,
+// or the empty string if there is no file parameter.
+func fileParam(vars url.Values) (string, error) {
+	switch f := vars["file"]; {
+	case len(f) == 0:
+		return "", nil
+	case len(f) > 1:
+		return "", errors.New("file can only be given once")
+	case f[0] == "":
+		return "", errors.New("empty file")
+	default:
+		return filepath.Abs(f[0])
+	}
+}
+
 func (s *Server) changes(w http.ResponseWriter, req *http.Request) {
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inBytes, err := useBytes(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events := acceptsEvents(req)
+	since := -1
+	switch sinces := vars["since"]; {
+	case len(sinces) > 1:
+		http.Error(w, "since can only be given once", http.StatusBadRequest)
+		return
+	case len(sinces) == 1:
+		if since, err = strconv.Atoi(sinces[0]); err != nil || since < 0 {
+			http.Error(w, "bad since: "+sinces[0], http.StatusBadRequest)
+			return
+		}
+	case events && req.Header.Get("Last-Event-ID") != "":
+		// An EventSource that reconnects resumes after the last event.
+		id := req.Header.Get("Last-Event-ID")
+		if since, err = strconv.Atoi(id); err != nil || since < 0 {
+			http.Error(w, "bad Last-Event-ID: "+id, http.StatusBadRequest)
+			return
+		}
+	}
+	var edID string
+	switch eds := vars["editor"]; {
+	case len(eds) > 1:
+		http.Error(w, "editor can only be given once", http.StatusBadRequest)
+		return
+	case len(eds) == 1:
+		edID = eds[0]
+	}
+	limit := maxBacklog
+	switch limits := vars["limit"]; {
+	case len(limits) > 1:
+		http.Error(w, "limit can only be given once", http.StatusBadRequest)
+		return
+	case len(limits) == 1:
+		limit, err = strconv.Atoi(limits[0])
+		if err != nil || limit < 1 || limit > maxBacklog {
+			http.Error(w, "bad limit: "+limits[0], http.StatusBadRequest)
+			return
+		}
+	}
+	var reload bool
+	switch overflows := vars["overflow"]; {
+	case len(overflows) > 1:
+		http.Error(w, "overflow can only be given once", http.StatusBadRequest)
+		return
+	case len(overflows) == 1 && overflows[0] == "reload":
+		reload = true
+	case len(overflows) == 1 && overflows[0] != "close":
+		http.Error(w, "bad overflow: "+overflows[0], http.StatusBadRequest)
+		return
+	}
+	inline := MaxInline
+	switch inlines := vars["inline"]; {
+	case len(inlines) > 1:
+		http.Error(w, "inline can only be given once", http.StatusBadRequest)
+		return
+	case len(inlines) == 1:
+		inline, err = strconv.Atoi(inlines[0])
+		if err != nil || inline < 0 || inline > MaxInlineLimit {
+			http.Error(w, "bad inline: "+inlines[0], http.StatusBadRequest)
+			return
+		}
+	}
+
 	s.Lock()
 	buf, ok := s.buffers[mux.Vars(req)["id"]]
 	if !ok {
@@ -252,33 +807,98 @@ func (s *Server) changes(w http.ResponseWriter, req *http.Request) {
 	}
 	buf.Lock()
 	s.Unlock()
-	changes := make(chan []ChangeList, 1)
-	buf.watchers = append(buf.watchers, changes)
+	wr := &watcher{
+		changes: make(chan []ChangeList, 1),
+		inline:  inline,
+		bytes:   inBytes,
+		limit:   limit,
+		reload:  reload,
+		resync:  make(chan struct{}),
+	}
+	if edID != "" {
+		if wr.editor, ok = buf.editors[edID]; !ok {
+			buf.Unlock()
+			http.Error(w, "bad editor: "+edID, http.StatusBadRequest)
+			return
+		}
+	}
+	if since >= 0 {
+		if since < buf.truncated {
+			buf.Unlock()
+			http.Error(w, "change history truncated", http.StatusGone)
+			return
+		}
+		var replay []ChangeList
+		for _, cl := range buf.history {
+			if cl.Sequence > since {
+				replay = append(replay, cl)
+			}
+		}
+		if len(replay) > 0 {
+			wr.changes <- replay
+		}
+	}
+	buf.watchers = append(buf.watchers, wr)
 	buf.Unlock()
 
 	defer func() {
 		buf.Lock()
-		for i := range buf.watchers {
-			if buf.watchers[i] == changes {
-				buf.watchers = append(buf.watchers[:i], buf.watchers[i+1:]...)
-				if buf.watcherRemoved != nil {
-					buf.watcherRemoved <- struct{}{}
-				}
-				break
-			}
-		}
+		buf.removeWatcher(wr)
 		buf.Unlock()
 	}()
 
-	conn, err := websocket.Upgrade(w, req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var send func(ChangeList) error
+	// Resync ends the stream after the backlog exceeded its limit.
+	var resync func()
+	var done <-chan struct{}
+	if events {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", eventStream)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		done = req.Context().Done()
+		send = func(cl ChangeList) error {
+			if err := writeEvent(w, cl); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+		resync = func() {
+			io.WriteString(w, "event: resync\ndata: "+resyncReason+"\n\n")
+			flusher.Flush()
+		}
+	} else {
+		conn, err := websocket.Upgrade(w, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var reason string
+		defer func() {
+			if reason != "" {
+				conn.CloseWithReason(reason)
+			} else {
+				conn.Close()
+			}
+		}()
+		resync = func() { reason = resyncReason }
+		recvDone := make(chan struct{})
+		go recvUntilError(conn, recvDone)
+		done = recvDone
+		send = func(cl ChangeList) error {
+			err := conn.Send(cl)
+			if err != nil && err != websocket.ErrCloseSent {
+				log.Printf("Error sending to websocket: %v", err)
+			}
+			return err
+		}
 	}
-	defer conn.Close()
-
-	done := make(chan struct{})
-	go recvUntilError(conn, done)
 
 	for {
 		select {
@@ -286,12 +906,16 @@ func (s *Server) changes(w http.ResponseWriter, req *http.Request) {
 			return
 		case <-buf.done:
 			return
-		case cls := <-changes:
+		case <-wr.resync:
+			resync()
+			return
+		case cls := <-wr.changes:
 			for _, cl := range cls {
-				if err := conn.Send(cl); err != nil {
-					if err != websocket.ErrCloseSent {
-						log.Printf("Error sending to websocket: %v", err)
-					}
+				cl = cl.inline(inline)
+				if inBytes {
+					cl = cl.inBytes()
+				}
+				if err := send(cl); err != nil {
 					return
 				}
 			}
@@ -299,6 +923,34 @@ func (s *Server) changes(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// EventStream is the media type of a Server-Sent Events stream.
+const eventStream = "text/event-stream"
+
+// AcceptsEvents returns whether the Accept header of a request
+// accepts a Server-Sent Events stream.
+func acceptsEvents(req *http.Request) bool {
+	for _, accept := range req.Header["Accept"] {
+		for _, r := range strings.Split(accept, ",") {
+			if t, _, err := mime.ParseMediaType(r); err == nil && t == eventStream {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteEvent writes a ChangeList as a Server-Sent Event.
+// The event's type is change, its ID is the ChangeList's Sequence,
+// and its data is the JSON-encoded ChangeList.
+func writeEvent(w io.Writer, cl ChangeList) error {
+	data, err := json.Marshal(cl)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "event: change\nid: "+strconv.Itoa(cl.Sequence)+"\ndata: "+string(data)+"\n\n")
+	return err
+}
+
 func recvUntilError(conn *websocket.Conn, done chan<- struct{}) {
 	defer close(done)
 	for {
@@ -329,9 +981,10 @@ func (s *Server) newEditor(w http.ResponseWriter, req *http.Request) {
 			Path:       path.Join("/", "editor", id),
 			BufferPath: buf.Path,
 		},
-		buffer: buf,
-		Buffer: buf.buffer,
-		marks:  make(map[rune]edit.Span),
+		buffer:    buf,
+		Buffer:    buf.buffer,
+		marks:     make(map[rune]edit.Span),
+		registers: make(map[rune][]byte),
 	}
 	s.editors[ed.ID] = ed
 	buf.editors[ed.ID] = ed
@@ -378,12 +1031,17 @@ func (s *Server) closeEditor(w http.ResponseWriter, req *http.Request) {
 			break
 		}
 	}
+	err := ed.close()
 
 	ed.buffer.Unlock()
 	s.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-func (s *Server) read(w http.ResponseWriter, req *http.Request) {
+func (s *Server) beginGroup(w http.ResponseWriter, req *http.Request) {
 	s.Lock()
 	ed, ok := s.editors[mux.Vars(req)["id"]]
 	if !ok {
@@ -392,65 +1050,279 @@ func (s *Server) read(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	ed.buffer.Lock()
-	defer ed.buffer.Unlock()
 	s.Unlock()
 
-	addr := edit.All
-	vars, err := url.ParseQuery(req.URL.RawQuery)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if ed.group == 0 {
+		ed.groupState = -1
 	}
-	if a, ok := vars["addr"]; ok {
-		if len(a) > 1 {
+	ed.group++
+	ed.buffer.Unlock()
+}
+
+func (s *Server) endGroup(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	ed, ok := s.editors[mux.Vars(req)["id"]]
+	if !ok {
+		s.Unlock()
+		http.NotFound(w, req)
+		return
+	}
+	ed.buffer.Lock()
+	s.Unlock()
+
+	if ed.group == 0 {
+		ed.buffer.Unlock()
+		http.Error(w, "no undo group", http.StatusBadRequest)
+		return
+	}
+	ed.group--
+	ed.buffer.Unlock()
+}
+
+func (s *Server) read(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	ed, ok := s.editors[mux.Vars(req)["id"]]
+	if !ok {
+		s.Unlock()
+		http.NotFound(w, req)
+		return
+	}
+	ed.buffer.Lock()
+	defer ed.buffer.Unlock()
+	s.Unlock()
+
+	addr := edit.All
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var text edit.Text = ed.Buffer
+	switch inBytes, err := useBytes(vars); {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case inBytes:
+		text = edit.Bytes(ed.Buffer)
+	}
+	if a, ok := vars["addr"]; ok {
+		if len(a) > 1 {
 			http.Error(w, "addr can only be given once", http.StatusBadRequest)
 			return
 		}
 		r := strings.NewReader(a[0])
 		addr, err = edit.Addr(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			respondParseError(w, 0, err)
 			return
 		}
-		if r.Len() != 0 {
-			http.Error(w, "bad address: "+a[0], http.StatusBadRequest)
+		if l := r.Len(); l != 0 {
+			respondParseError(w, 0, trailingError([]byte(a[0]), l, "end of address"))
 			return
 		}
 	}
-	span, err := addr.Where(ed.Buffer)
+	span, err := addr.Where(text)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain")
-	if _, err = io.Copy(w, ed.Buffer.Reader(span)); err != nil {
+	w.Header().Set("ETag", etag(ed.buffer.Sequence))
+	if _, err = io.Copy(w, text.Reader(span)); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
 func (s *Server) edit(w http.ResponseWriter, req *http.Request) {
-	var edits []editRequest
-	if err := json.NewDecoder(req.Body).Decode(&edits); err != nil {
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inBytes, err := useBytes(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout, err := timeoutParam(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seqs, err := ifMatch(req)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Sequence *int     `json:"sequence"`
+		Edits    []string `json:"edits"`
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		err = json.Unmarshal(raw, &body)
+	} else {
+		err = json.Unmarshal(raw, &body.Edits)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	edits := make([]editRequest, len(body.Edits))
+	for i, str := range body.Edits {
+		if err := edits[i].UnmarshalText([]byte(str)); err != nil {
+			respondParseError(w, i, err)
+			return
+		}
+	}
 
-	s.Lock()
+	ctx, cancel := context.WithCancel(req.Context())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	}
+	defer cancel()
+
+	s.RLock()
 	ed, ok := s.editors[mux.Vars(req)["id"]]
+	s.RUnlock()
 	if !ok {
-		s.Unlock()
 		http.NotFound(w, req)
 		return
 	}
+	// The buffer may be released while the edits are performed,
+	// but the edits of the editor must not run concurrently.
+	ed.editing.Lock()
+	defer ed.editing.Unlock()
 	ed.buffer.Lock()
-	s.Unlock()
+	if ed.closed() {
+		// The editor was closed before the edits began.
+		ed.buffer.Unlock()
+		http.NotFound(w, req)
+		return
+	}
+
+	if cur := ed.buffer.Sequence; !matchSequence(seqs, cur) ||
+		body.Sequence != nil && *body.Sequence != cur {
+		ed.buffer.Unlock()
+		respondConflict(w, cur)
+		return
+	}
+	// A conditional request is not released,
+	// so the edits of other editors cannot be performed
+	// between its edits after its sequence is checked.
+	ed.begin(ctx, cancel, seqs != nil || body.Sequence != nil)
+	results := ed.do(edits, inBytes)
+	ed.end()
+	seq := ed.buffer.Sequence
+	ed.buffer.Unlock()
+
+	w.Header().Set("ETag", etag(seq))
+	respond(w, results)
+}
+
+// TimeoutParam returns the duration of the timeout parameter,
+// or 0 if there is no timeout parameter.
+func timeoutParam(vars url.Values) (time.Duration, error) {
+	switch t := vars["timeout"]; {
+	case len(t) == 0:
+		return 0, nil
+	case len(t) > 1:
+		return 0, errors.New("timeout can only be given once")
+	default:
+		d, err := time.ParseDuration(t[0])
+		if err != nil || d <= 0 {
+			return 0, errors.New("bad timeout: " + t[0])
+		}
+		return d, nil
+	}
+}
 
+func (s *Server) cancelEdit(w http.ResponseWriter, req *http.Request) {
+	s.RLock()
+	ed, ok := s.editors[mux.Vars(req)["id"]]
+	s.RUnlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	ed.cancelEdit()
+}
+
+// IfMatch returns the sequence numbers of the If-Match header.
+// The header must be * or a list of entity tags,
+// each of which is a quoted sequence number.
+// If the header is not set or is *, no sequence numbers are returned.
+func ifMatch(req *http.Request) ([]int, error) {
+	h := strings.TrimSpace(req.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return nil, nil
+	}
+	var seqs []int
+	for _, tag := range strings.Split(h, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) >= 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+			tag = tag[1 : len(tag)-1]
+		}
+		seq, err := strconv.Atoi(tag)
+		if err != nil {
+			return nil, errors.New("bad If-Match: " + h)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs, nil
+}
+
+// MatchSequence returns whether seq is one of seqs,
+// or true if seqs is empty.
+func matchSequence(seqs []int, seq int) bool {
+	for _, s := range seqs {
+		if s == seq {
+			return true
+		}
+	}
+	return len(seqs) == 0
+}
+
+// Etag returns an entity tag for a buffer sequence number.
+func etag(seq int) string { return `"` + strconv.Itoa(seq) + `"` }
+
+// RespondConflict responds with a Conflict
+// and a body that is a JSON-encoded ConflictError.
+func respondConflict(w http.ResponseWriter, seq int) {
+	body, err := json.Marshal(ConflictError{Sequence: seq})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("ETag", etag(seq))
+	w.WriteHeader(http.StatusConflict)
+	w.Write(body)
+}
+
+// Do performs the edits, returning their results.
+// If inBytes is true, the edits are performed
+// with offsets into the UTF-8 encoding of the text.
+// Must be called with the buffer's write Lock held.
+func (ed *editor) do(edits []editRequest, inBytes bool) []EditResult {
+	var target edit.Editor = ed
+	if inBytes {
+		target = edit.Bytes(ed)
+	}
 	var results []EditResult
 	print := bytes.NewBuffer(nil)
 	for _, e := range edits {
 		print.Reset()
-		err := e.Do(ed, print)
+		err := ed.Context().Err()
+		if err == nil {
+			err = e.Do(target, print)
+		}
 		ed.buffer.Sequence++
 		result := EditResult{
 			Sequence: ed.buffer.Sequence,
@@ -461,12 +1333,218 @@ func (s *Server) edit(w http.ResponseWriter, req *http.Request) {
 		}
 		results = append(results, result)
 	}
+	return results
+}
 
-	ed.buffer.Unlock()
+// A buffersEdit is the body of a POST to the buffers edit path.
+type buffersEdit struct {
+	// Match is a regular expression matched against buffer paths.
+	Match string `json:"match"`
+	// Exclude is whether to select the buffers
+	// that do not match, instead of the buffers that do.
+	Exclude bool `json:"exclude,omitempty"`
+	// Edits is the edit list to perform on each selected buffer.
+	Edits []string `json:"edits"`
+}
+
+func (s *Server) editBuffers(w http.ResponseWriter, req *http.Request) {
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inBytes, err := useBytes(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var be buffersEdit
+	if err := json.NewDecoder(req.Body).Decode(&be); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	re, err := regexp.Compile(be.Match)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	edits := make([]editRequest, len(be.Edits))
+	for i, str := range be.Edits {
+		if err := edits[i].UnmarshalText([]byte(str)); err != nil {
+			respondParseError(w, i, err)
+			return
+		}
+	}
+
+	s.RLock()
+	var bufs []*buffer
+	for _, buf := range s.buffers {
+		buf.RLock()
+		match := re.MatchString(buf.Path) || buf.File != "" && re.MatchString(buf.File)
+		buf.RUnlock()
+		if match != be.Exclude {
+			bufs = append(bufs, buf)
+		}
+	}
+	s.RUnlock()
+	sort.Sort(buffersByID(bufs))
+
+	results := []BufferEditResult{}
+	for _, buf := range bufs {
+		buf.Lock()
+		select {
+		case <-buf.done:
+			// The buffer was closed after it was selected.
+			buf.Unlock()
+			continue
+		default:
+		}
+		ed := buf.tempEditor()
+		ed.ctx = req.Context()
+		rs := ed.do(edits, inBytes)
+		info, c := buf.info()
+		buf.Unlock()
+		if c != nil {
+			info.Stale = c.stale()
+		}
+		results = append(results, BufferEditResult{Buffer: info, Results: rs})
+	}
 
 	respond(w, results)
 }
 
+// BuffersByID sorts buffers in increasing order of their numeric IDs.
+type buffersByID []*buffer
+
+func (s buffersByID) Len() int { return len(s) }
+
+func (s buffersByID) Less(i, j int) bool {
+	a, b := s[i].ID, s[j].ID
+	return len(a) < len(b) || len(a) == len(b) && a < b
+}
+
+func (s buffersByID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// RegisterName returns the register named by the name URL variable.
+func registerName(req *http.Request) (rune, error) {
+	name := mux.Vars(req)["name"]
+	r, w := utf8.DecodeRuneInString(name)
+	if w == 0 || w != len(name) {
+		return 0, errors.New("bad register name: " + name)
+	}
+	return r, nil
+}
+
+func (s *Server) readRegister(w http.ResponseWriter, req *http.Request) {
+	name, err := registerName(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.RLock()
+	ed, ok := s.editors[mux.Vars(req)["id"]]
+	if !ok {
+		s.RUnlock()
+		http.NotFound(w, req)
+		return
+	}
+	ed.buffer.RLock()
+	text := ed.Register(name)
+	ed.buffer.RUnlock()
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+	w.Write(text)
+}
+
+func (s *Server) writeRegister(w http.ResponseWriter, req *http.Request) {
+	name, err := registerName(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	text, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.RLock()
+	ed, ok := s.editors[mux.Vars(req)["id"]]
+	if !ok {
+		s.RUnlock()
+		http.NotFound(w, req)
+		return
+	}
+	ed.buffer.Lock()
+	ed.SetRegister(name, text)
+	ed.buffer.Unlock()
+	s.RUnlock()
+}
+
+func (s *Server) readMarks(w http.ResponseWriter, req *http.Request) {
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inBytes, err := useBytes(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.RLock()
+	ed, ok := s.editors[mux.Vars(req)["id"]]
+	if !ok {
+		s.RUnlock()
+		http.NotFound(w, req)
+		return
+	}
+	ed.buffer.RLock()
+	marks := ed.markSpans(inBytes)
+	ed.buffer.RUnlock()
+	s.RUnlock()
+
+	respond(w, marks)
+}
+
+func (s *Server) writeMarks(w http.ResponseWriter, req *http.Request) {
+	vars, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inBytes, err := useBytes(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var marks Marks
+	if err := json.NewDecoder(req.Body).Decode(&marks); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.RLock()
+	ed, ok := s.editors[mux.Vars(req)["id"]]
+	if !ok {
+		s.RUnlock()
+		http.NotFound(w, req)
+		return
+	}
+	ed.buffer.Lock()
+	err = ed.setMarks(marks, inBytes)
+	ed.buffer.Unlock()
+	s.RUnlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+	}
+}
+
 type buffer struct {
 	sync.RWMutex
 	Buffer
@@ -474,25 +1552,230 @@ type buffer struct {
 
 	editors map[string]*editor
 
-	watchers []chan []ChangeList
-	done     chan struct{}
+	// Changed is the sequence number of the last edit
+	// that changed the text of the buffer.
+	changed int
+	// Clean is the sequence number of the last edit
+	// before the buffer was last read from or written to its file.
+	clean int
+	// Stat is the state of the file when it was last read or written.
+	stat fileStat
+	// Checked is the hash of the file
+	// computed by the most recent check for staleness.
+	checked fileHash
+
+	watchers []*watcher
+	// History contains the most recent ChangeLists,
+	// in increasing order of sequence number.
+	history []ChangeList
+	// Truncated is the sequence number of the last ChangeList
+	// dropped from the history, or 0 if none were dropped.
+	truncated int
+	// MaxHistory is the maximum number of ChangeLists in the history.
+	maxHistory int
+	done       chan struct{}
+
+	// Applied is the editor whose Apply
+	// created the most recent state of the undo tree.
+	applied *editor
+	// Inserted is the insertion made by the most recent Apply,
+	// if it was a single insertion.
+	inserted insertion
+	// Coalesce is the maximum time between consecutive insertions
+	// by the same editor that are merged into a single undo state.
+	coalesce time.Duration
+	// Moves are the changes made by the current
+	// buffer-wide Undo, Redo, or SetState
+	// that are not yet rebased onto the editors.
+	moves []applied
+
 	// watcherRemoved is for testing purposes.
 	// If non-nil, an empty struct is sent when a watcher is removed.
 	watcherRemoved chan struct{}
 }
 
+// A watcher is a subscriber to a buffer's change stream.
+type watcher struct {
+	changes chan []ChangeList
+	// Inline is the maximum size, in bytes,
+	// of the text inlined in the watcher's Changes.
+	inline int
+	// Bytes is whether the watcher's units are bytes.
+	bytes bool
+	// Editor, if non-nil, is the editor
+	// whose marks are sent with each ChangeList.
+	editor *editor
+	// Limit is the maximum number of ChangeLists
+	// waiting to be sent to the watcher.
+	limit int
+	// Reload is whether a backlog exceeding the limit
+	// is collapsed into a single reload ChangeList.
+	// Otherwise, the watcher is removed, and resync is closed.
+	reload bool
+	resync chan struct{}
+}
+
+// Deliver adds a ChangeList to the backlog of a watcher.
+// If the backlog then exceeds the watcher's limit,
+// it is either collapsed into a reload ChangeList,
+// or the watcher is removed and its resync channel closed.
+// Must be called with the write Lock held.
+func (buf *buffer) deliver(wr *watcher, cl ChangeList) {
+	var cls []ChangeList
+	select {
+	case cls = <-wr.changes:
+	default:
+	}
+	cls = append(cls, cl)
+	switch {
+	case len(cls) <= wr.limit:
+		wr.changes <- cls
+	case wr.reload:
+		wr.changes <- []ChangeList{{Sequence: cl.Sequence, Marks: cl.Marks, Reload: true}}
+	default:
+		buf.removeWatcher(wr)
+		close(wr.resync)
+	}
+}
+
+// RemoveWatcher removes a watcher from the buffer,
+// if it is one of the buffer's watchers.
+// Must be called with the write Lock held.
+func (buf *buffer) removeWatcher(wr *watcher) {
+	for i := range buf.watchers {
+		if buf.watchers[i] != wr {
+			continue
+		}
+		// The watchers are copied, not modified in place,
+		// as the caller may be iterating over them.
+		ws := make([]*watcher, 0, len(buf.watchers)-1)
+		ws = append(ws, buf.watchers[:i]...)
+		buf.watchers = append(ws, buf.watchers[i+1:]...)
+		if buf.watcherRemoved != nil {
+			buf.watcherRemoved <- struct{}{}
+		}
+		return
+	}
+}
+
+// Inline returns the maximum size, in bytes,
+// of the text to record with each Change:
+// the largest inline size of any watcher, and at least MaxInline.
+// Must be called with the Lock held.
+func (buf *buffer) inline() int {
+	n := MaxInline
+	for _, wr := range buf.watchers {
+		if wr.inline > n {
+			n = wr.inline
+		}
+	}
+	return n
+}
+
+// An insertion is a change that inserted text
+// without deleting any text.
+type insertion struct {
+	// By is the editor that made the insertion,
+	// or nil if the most recent Apply was not an insertion.
+	by *editor
+	// State is the state of the undo tree after the insertion.
+	state int
+	// End is the offset just after the inserted text.
+	end int64
+	// Time is the time at which the insertion was applied.
+	time time.Time
+}
+
+// Record adds a ChangeList to the history,
+// dropping the oldest ChangeList if the history is full.
+// Must be called with the write Lock held.
+func (buf *buffer) record(cl ChangeList) {
+	buf.history = append(buf.history, cl)
+	if n := len(buf.history) - buf.maxHistory; n > 0 {
+		buf.truncated = buf.history[n-1].Sequence
+		buf.history = append(buf.history[:0], buf.history[n:]...)
+	}
+}
+
 // Must be called with the write Lock held.
 func (buf *buffer) close() error {
 	close(buf.done)
-	return buf.buffer.Close()
+	err := buf.buffer.Close()
+	for _, ed := range buf.editors {
+		if cerr := ed.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// TempEditor returns a new editor that is not one of the buffer's editors.
+// Its marks begin as the empty string at the start of the buffer,
+// and its registers are empty.
+func (buf *buffer) tempEditor() *editor {
+	return &editor{
+		buffer:    buf,
+		Buffer:    buf.buffer,
+		marks:     make(map[rune]edit.Span),
+		registers: make(map[rune][]byte),
+	}
 }
 
 type editor struct {
 	Editor
 	*edit.Buffer
-	buffer  *buffer
-	marks   map[rune]edit.Span
-	pending []Change
+	buffer    *buffer
+	marks     map[rune]edit.Span
+	registers map[rune][]byte
+	pending   []Change
+	// Prevs are the Spans, in the history,
+	// of the texts replaced by the pending changes.
+	// They are not recorded for temporary editors.
+	prevs []edit.Span
+	// History is a disk-backed log of the texts
+	// of the changes of the local Undo and Redo stacks,
+	// and of the texts that they replaced.
+	// It is nil for temporary editors.
+	history *runes.Buffer
+
+	// Undos and redos are the editor's local Undo and Redo stacks,
+	// containing only the batches of changes applied by the editor,
+	// and at most maxLocalChanges changes.
+	undos, redos []localBatch
+	// Reverting is the stack from which the pending changes
+	// were popped by UndoLocal or RedoLocal, or nil.
+	reverting *[]localBatch
+	// NextBatch is the ID of the most recent localBatch.
+	nextBatch int
+
+	// Group is the nesting depth of the editor's undo groups.
+	group int
+	// GroupState is the state of the undo tree
+	// into which the changes of the current undo group are merged,
+	// or -1 if no changes were applied in the group.
+	groupState int
+
+	// Editing is held for the duration of each edit request,
+	// so that the edits of an editor never run concurrently,
+	// even while the editor is released.
+	editing sync.Mutex
+	// Ctx is the Context of the current edit request, or nil.
+	ctx context.Context
+	// Atomic is whether the current edit request
+	// must not release the buffer.
+	atomic bool
+	// CancelMu guards cancel.
+	// It is separate from the buffer's lock,
+	// which an edit request may hold for a long time.
+	cancelMu sync.Mutex
+	// Cancel cancels the current edit request, or is nil.
+	cancel context.CancelFunc
+	// Watch is dot at the time that the editor was released,
+	// updated for the changes made while it is released,
+	// or nil if the editor is not released.
+	watch *edit.Span
+	// WatchConflict is whether a change overlapped watch.
+	watchConflict bool
 }
 
 type change struct {
@@ -510,15 +1793,59 @@ func (ed *editor) SetMark(m rune, s edit.Span) error {
 	return nil
 }
 
+// MarkSpans returns a copy of the editor's marks.
+// The Spans are in bytes if inBytes is true,
+// otherwise they are in runes.
+func (ed *editor) markSpans(inBytes bool) Marks {
+	marks := make(Marks, len(ed.marks))
+	for m, s := range ed.marks {
+		if inBytes {
+			s = edit.Span{ed.ByteOffset(s[0]), ed.ByteOffset(s[1])}
+		}
+		marks[m] = s
+	}
+	return marks
+}
+
+// SetMarks sets the editor's marks to the Spans of marks,
+// which are in bytes if inBytes is true,
+// otherwise they are in runes.
+// If any Span is outside of the text, no marks are set,
+// and edit.ErrInvalidArgument is returned.
+func (ed *editor) setMarks(marks Marks, inBytes bool) error {
+	var target edit.Editor = ed
+	if inBytes {
+		target = edit.Bytes(ed)
+	}
+	size := target.Size()
+	for _, s := range marks {
+		if s[0] < 0 || s[1] < 0 || s[0] > size || s[1] > size {
+			return edit.ErrInvalidArgument
+		}
+	}
+	for m, s := range marks {
+		if err := target.SetMark(m, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ed *editor) Register(r rune) []byte { return ed.registers[r] }
+
+func (ed *editor) SetRegister(r rune, text []byte) { ed.registers[r] = text }
+
 type changeReader struct {
-	r      io.Reader
+	r io.Reader
+	// Max is the maximum number of bytes recorded in text.
+	max    int
 	nbytes int
 	text   []byte
 }
 
 func (cr *changeReader) Read(d []byte) (int, error) {
 	n, err := cr.r.Read(d)
-	m := MaxInline - len(cr.text)
+	m := cr.max - len(cr.text)
 	if m > n {
 		m = n
 	}
@@ -528,53 +1855,189 @@ func (cr *changeReader) Read(d []byte) (int, error) {
 }
 
 func (ed *editor) Change(s edit.Span, r io.Reader) (int64, error) {
-	cr := changeReader{r: r}
+	cr := changeReader{r: r, max: ed.buffer.inline()}
 	n, err := ed.Buffer.Change(s, &cr)
-	if err == nil {
-		c := Change{Span: s, NewSize: n}
-		if 0 < cr.nbytes && cr.nbytes <= MaxInline {
-			c.Text = cr.text
+	if err != nil {
+		// The Buffer cancels all staged changes on error.
+		ed.pending, ed.prevs = nil, nil
+		return n, err
+	}
+	if !ed.temporary() {
+		prev, err := ed.record(ed.Buffer.Reader(s))
+		if err != nil {
+			return n, err
 		}
-		ed.pending = append(ed.pending, c)
+		ed.prevs = append(ed.prevs, prev)
 	}
-	return n, err
+	c := Change{
+		Span:     s,
+		NewSize:  n,
+		bytes:    edit.Span{ed.ByteOffset(s[0]), ed.ByteOffset(s[1])},
+		newBytes: int64(cr.nbytes),
+	}
+	if 0 < cr.nbytes && cr.nbytes <= cr.max {
+		c.Text = cr.text
+	}
+	ed.pending = append(ed.pending, c)
+	return n, nil
+}
+
+// Undo changes the buffer to the parent of the current state
+// of its undo tree.
+// It must only be called by an edit, as the edit's sequence number
+// is recorded as that of the last change to the buffer.
+func (ed *editor) Undo() error {
+	err := ed.Buffer.Undo()
+	ed.buffer.rebaseMoves()
+	if err != nil {
+		return err
+	}
+	ed.buffer.changed = ed.buffer.Sequence + 1
+	return nil
+}
+
+// Redo changes the buffer to the most recently visited child
+// of the current state of its undo tree.
+// It must only be called by an edit, as the edit's sequence number
+// is recorded as that of the last change to the buffer.
+func (ed *editor) Redo() error {
+	err := ed.Buffer.Redo()
+	ed.buffer.rebaseMoves()
+	if err != nil {
+		return err
+	}
+	ed.buffer.changed = ed.buffer.Sequence + 1
+	return nil
+}
+
+// SetState changes the buffer to a state of its undo tree.
+// It must only be called by an edit, as the edit's sequence number
+// is recorded as that of the last change to the buffer.
+func (ed *editor) SetState(i int) error {
+	err := ed.Buffer.SetState(i)
+	ed.buffer.rebaseMoves()
+	if err != nil {
+		return err
+	}
+	ed.buffer.changed = ed.buffer.Sequence + 1
+	return nil
 }
 
 func (ed *editor) Apply() error {
-	if err := ed.Buffer.Apply(); err != nil {
+	as := ed.applied()
+	merge := ed.merges()
+	if merge {
+		ed.Buffer.ContinueGroup()
+	}
+	err := ed.Buffer.Apply()
+	if merge {
+		ed.Buffer.EndGroup()
+	}
+	if err != nil {
 		return err
 	}
+	for _, e := range ed.buffer.editors {
+		if e != ed {
+			e.rebase(ed, as)
+		}
+		e.rebaseWatch(as)
+	}
+	if cs := ed.rebase(ed, as); len(as) > 0 && !ed.temporary() {
+		ed.log(as, cs)
+	}
 	for _, c := range ed.pending {
 		for _, e := range ed.buffer.editors {
-			for m, s := range e.marks {
-				if e == ed && m == '.' && c.Span[0] == s[0] {
-					// We handle dot of the current editor specially.
-					// If the change has the same start, grow dot.
-					// Otherwise, update would simply leave it
-					// as a point address and move it.
-					dot := e.marks[m]
-					dot[1] = dot.Update(c.Span, c.NewSize)[1]
-					e.marks[m] = dot
-				} else {
-					e.marks[m] = e.marks[m].Update(c.Span, c.NewSize)
-				}
-			}
+			e.update(ed, c)
+		}
+		if ed.buffer.editors[ed.ID] != ed {
+			// A temporary editor is not one of the buffer's editors,
+			// but its marks must still be updated.
+			ed.update(ed, c)
 		}
 	}
 	if len(ed.pending) == 0 {
 		return nil
 	}
+	ed.buffer.applied = ed
+	if ed.group > 0 {
+		ed.groupState = ed.Buffer.State()
+	}
+	ed.buffer.inserted = insertion{}
+	if c, ok := ed.insertion(); ok {
+		ed.buffer.inserted = insertion{
+			by:    ed,
+			state: ed.Buffer.State(),
+			end:   c.Span[0] + c.NewSize,
+			time:  time.Now(),
+		}
+	}
+	if ed.buffer.changed > ed.buffer.Sequence {
+		// The current edit already applied changes,
+		// as does UndoLocal or RedoLocal with a count greater than 1.
+		// Each ChangeList must have a unique sequence number,
+		// so the edit uses the next one.
+		ed.buffer.Sequence = ed.buffer.changed
+	}
 	cl := ChangeList{
 		Sequence: ed.buffer.Sequence + 1,
 		Changes:  ed.pending,
 	}
-	for _, c := range ed.buffer.watchers {
-		select {
-		case cls := <-c:
-			c <- append(cls, cl)
-		case c <- []ChangeList{cl}:
+	ed.buffer.changed = cl.Sequence
+	ed.buffer.record(cl)
+	for _, wr := range ed.buffer.watchers {
+		cl := cl
+		if e := wr.editor; e != nil && ed.buffer.editors[e.ID] == e {
+			cl.Marks = e.markSpans(wr.bytes)
 		}
+		ed.buffer.deliver(wr, cl)
 	}
-	ed.pending = nil
+	ed.pending, ed.prevs = nil, nil
 	return nil
 }
+
+// Merges returns whether the pending changes are to be merged
+// into the current state of the undo tree.
+// They are merged if the state was created by the editor
+// and either the editor has an open undo group
+// or the changes are an insertion just after
+// the editor's previous insertion, within the coalesce window.
+func (ed *editor) merges() bool {
+	if len(ed.pending) == 0 || ed.buffer.applied != ed {
+		return false
+	}
+	state := ed.Buffer.State()
+	if ed.group > 0 {
+		return ed.groupState == state
+	}
+	c, ok := ed.insertion()
+	in := ed.buffer.inserted
+	return ok && in.by == ed && in.state == state && in.end == c.Span[0] &&
+		time.Since(in.time) <= ed.buffer.coalesce
+}
+
+// Insertion returns the pending change and true
+// if it is a single change that inserts text without deleting any,
+// and was not made by UndoLocal or RedoLocal.
+func (ed *editor) insertion() (Change, bool) {
+	if len(ed.pending) != 1 || ed.reverting != nil {
+		return Change{}, false
+	}
+	c := ed.pending[0]
+	return c, c.Span.Size() == 0 && c.NewSize > 0
+}
+
+// Update updates the marks of ed for a change made by the editor by.
+func (ed *editor) update(by *editor, c Change) {
+	for m, s := range ed.marks {
+		if ed == by && m == '.' && c.Span[0] == s[0] {
+			// We handle dot of the current editor specially.
+			// If the change has the same start, grow dot.
+			// Otherwise, update would simply leave it
+			// as a point address and move it.
+			s[1] = s.Update(c.Span, c.NewSize)[1]
+			ed.marks[m] = s
+		} else {
+			ed.marks[m] = s.Update(c.Span, c.NewSize)
+		}
+	}
+}
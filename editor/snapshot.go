@@ -0,0 +1,362 @@
+// Copyright © 2016, The T Authors.
+
+package editor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eaburns/T/edit"
+)
+
+const (
+	// SnapshotFile is the name of the file of a snapshot directory
+	// containing the JSON-encoded serverSnapshot.
+	snapshotFile = "server.json"
+	// SnapshotBufferPrefix prefixes the buffer ID
+	// in the name of the file of a snapshot directory
+	// containing the edit.Buffer snapshot of the buffer.
+	snapshotBufferPrefix = "buffer-"
+)
+
+var errBadSnapshot = errors.New("bad snapshot")
+
+// A serverSnapshot is the state of a Server in a snapshot.
+type serverSnapshot struct {
+	NextID  int              `json:"nextID"`
+	Buffers []bufferSnapshot `json:"buffers"`
+}
+
+// A bufferSnapshot is the state of a buffer in a snapshot.
+// The text and undo tree of the buffer are in a separate file.
+type bufferSnapshot struct {
+	ID       string           `json:"id"`
+	File     string           `json:"file,omitempty"`
+	Sequence int              `json:"sequence"`
+	Changed  int              `json:"changed"`
+	Clean    int              `json:"clean"`
+	Stat     statSnapshot     `json:"stat"`
+	Editors  []editorSnapshot `json:"editors"`
+}
+
+// A statSnapshot is a fileStat in a snapshot.
+type statSnapshot struct {
+	Path    string    `json:"path,omitempty"`
+	Exists  bool      `json:"exists,omitempty"`
+	ModTime time.Time `json:"modTime"`
+	Size    int64     `json:"size,omitempty"`
+	Hash    []byte    `json:"hash,omitempty"`
+}
+
+// An editorSnapshot is the state of an editor in a snapshot.
+type editorSnapshot struct {
+	ID        string            `json:"id"`
+	Marks     Marks             `json:"marks"`
+	Registers map[string][]byte `json:"registers,omitempty"`
+	Undos     []batchSnapshot   `json:"undos,omitempty"`
+	Redos     []batchSnapshot   `json:"redos,omitempty"`
+	NextBatch int               `json:"nextBatch,omitempty"`
+}
+
+// A batchSnapshot is a localBatch in a snapshot.
+type batchSnapshot struct {
+	ID       int               `json:"id"`
+	Changes  []changeSnapshot  `json:"changes"`
+	Covered  []coveredSnapshot `json:"covered,omitempty"`
+	Conflict bool              `json:"conflict,omitempty"`
+}
+
+// A changeSnapshot is a localChange in a snapshot.
+type changeSnapshot struct {
+	Span edit.Span `json:"span"`
+	Text []byte    `json:"text"`
+	Prev []byte    `json:"prev"`
+}
+
+// A coveredSnapshot is a covered in a snapshot.
+type coveredSnapshot struct {
+	ID     int       `json:"id"`
+	Change int       `json:"change"`
+	Span   edit.Span `json:"span"`
+}
+
+// Snapshot writes a snapshot of the Server to a directory,
+// from which Restore creates a Server
+// with the same buffers and editors, having the same IDs and paths.
+//
+// The snapshot contains the text of each buffer,
+// its file and the state of the file when the buffer last read or wrote it,
+// and the marks and registers of its editors.
+// If history is true, the snapshot also contains
+// the undo tree of each buffer,
+// and the local Undo and Redo stacks of its editors.
+// Undo groups and the change history of the buffers
+// are not in the snapshot.
+//
+// The directory is created if it does not exist.
+// Snapshot replaces the files of a previous snapshot in the directory.
+func (s *Server) Snapshot(dir string, history bool) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.RLock()
+	defer s.RUnlock()
+	snap := serverSnapshot{NextID: s.nextID}
+	files := make(map[string]bool)
+	for _, buf := range s.buffers {
+		buf.Lock()
+		b, err := buf.snapshot(dir, history)
+		buf.Unlock()
+		if err != nil {
+			return err
+		}
+		snap.Buffers = append(snap.Buffers, b)
+		files[snapshotBufferPrefix+b.ID] = true
+	}
+	data, err := json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, snapshotFile), bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	// Remove the files of buffers closed since a previous snapshot.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, snapshotBufferPrefix) && !files[name] {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot writes the file of the buffer's edit.Buffer snapshot
+// and returns the bufferSnapshot of the buffer.
+// Must be called with the write Lock held.
+func (buf *buffer) snapshot(dir string, history bool) (bufferSnapshot, error) {
+	var data bytes.Buffer
+	if err := buf.buffer.Snapshot(&data, history); err != nil {
+		return bufferSnapshot{}, err
+	}
+	file := filepath.Join(dir, snapshotBufferPrefix+buf.ID)
+	if err := writeFile(file, &data); err != nil {
+		return bufferSnapshot{}, err
+	}
+	b := bufferSnapshot{
+		ID:       buf.ID,
+		File:     buf.File,
+		Sequence: buf.Sequence,
+		Changed:  buf.changed,
+		Clean:    buf.clean,
+		Stat: statSnapshot{
+			Path:    buf.stat.path,
+			Exists:  buf.stat.exists,
+			ModTime: buf.stat.modTime,
+			Size:    buf.stat.size,
+		},
+	}
+	if buf.stat.exists {
+		b.Stat.Hash = buf.stat.hash[:]
+	}
+	for _, info := range buf.Editors {
+		ed := buf.editors[info.ID]
+		e := editorSnapshot{
+			ID:        ed.ID,
+			Marks:     ed.markSpans(false),
+			Registers: make(map[string][]byte, len(ed.registers)),
+		}
+		for r, text := range ed.registers {
+			e.Registers[string(r)] = text
+		}
+		if history {
+			var err error
+			if e.Undos, err = ed.batchSnapshots(ed.undos); err != nil {
+				return bufferSnapshot{}, err
+			}
+			if e.Redos, err = ed.batchSnapshots(ed.redos); err != nil {
+				return bufferSnapshot{}, err
+			}
+			e.NextBatch = ed.nextBatch
+		}
+		b.Editors = append(b.Editors, e)
+	}
+	return b, nil
+}
+
+func (ed *editor) batchSnapshots(stack []localBatch) ([]batchSnapshot, error) {
+	var bs []batchSnapshot
+	for _, b := range stack {
+		s := batchSnapshot{ID: b.id, Conflict: b.conflict}
+		for _, c := range b.changes {
+			text, err := ioutil.ReadAll(ed.historyReader(c.text))
+			if err != nil {
+				return nil, err
+			}
+			prev, err := ioutil.ReadAll(ed.historyReader(c.prev))
+			if err != nil {
+				return nil, err
+			}
+			s.Changes = append(s.Changes, changeSnapshot{Span: c.span, Text: text, Prev: prev})
+		}
+		for _, cv := range b.covered {
+			s.Covered = append(s.Covered, coveredSnapshot{ID: cv.id, Change: cv.change, Span: cv.span})
+		}
+		bs = append(bs, s)
+	}
+	return bs, nil
+}
+
+// Restore returns a new Server
+// restored from the snapshot written by Snapshot to a directory.
+func Restore(dir string) (*Server, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	var snap serverSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	s := NewServer()
+	s.nextID = snap.NextID
+	for _, b := range snap.Buffers {
+		if err := s.restore(dir, b); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Restore adds the buffer of a bufferSnapshot to the Server.
+func (s *Server) restore(dir string, b bufferSnapshot) error {
+	if _, ok := s.buffers[b.ID]; ok || !s.validID(b.ID) {
+		return errBadSnapshot
+	}
+	f, err := os.Open(filepath.Join(dir, snapshotBufferPrefix+b.ID))
+	if err != nil {
+		return err
+	}
+	eb, err := edit.ReadSnapshot(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	buf := &buffer{
+		Buffer: Buffer{
+			ID:       b.ID,
+			Path:     path.Join("/", "buffer", b.ID),
+			File:     b.File,
+			Sequence: b.Sequence,
+		},
+		buffer:     eb,
+		editors:    make(map[string]*editor),
+		done:       make(chan struct{}),
+		maxHistory: maxHistory,
+		coalesce:   coalesceWindow,
+		changed:    b.Changed,
+		clean:      b.Clean,
+		stat: fileStat{
+			path:    b.Stat.Path,
+			exists:  b.Stat.Exists,
+			modTime: b.Stat.ModTime,
+			size:    b.Stat.Size,
+		},
+		// The ChangeLists before the snapshot are not in the history.
+		truncated: b.Sequence,
+	}
+	buf.buffer.SetMoveFunc(buf.moved)
+	copy(buf.stat.hash[:], b.Stat.Hash)
+	s.buffers[buf.ID] = buf
+
+	for _, e := range b.Editors {
+		if _, ok := s.editors[e.ID]; ok || !s.validID(e.ID) {
+			return errBadSnapshot
+		}
+		ed := &editor{
+			Editor: Editor{
+				ID:         e.ID,
+				Path:       path.Join("/", "editor", e.ID),
+				BufferPath: buf.Path,
+			},
+			buffer:    buf,
+			Buffer:    buf.buffer,
+			marks:     make(map[rune]edit.Span),
+			registers: make(map[rune][]byte),
+			nextBatch: e.NextBatch,
+		}
+		// The editor is added to the buffer before its history is restored,
+		// so that the history is closed with the buffer on error.
+		s.editors[ed.ID] = ed
+		buf.editors[ed.ID] = ed
+		buf.Editors = append(buf.Editors, ed.Editor)
+		var err error
+		if ed.undos, err = ed.localBatches(e.Undos); err != nil {
+			return err
+		}
+		if ed.redos, err = ed.localBatches(e.Redos); err != nil {
+			return err
+		}
+		if err := ed.setMarks(e.Marks, false); err != nil {
+			return errBadSnapshot
+		}
+		for name, text := range e.Registers {
+			r, w := utf8.DecodeRuneInString(name)
+			if w == 0 || w != len(name) {
+				return errBadSnapshot
+			}
+			ed.registers[r] = text
+		}
+	}
+	return nil
+}
+
+// ValidID returns whether a buffer or editor ID of a snapshot
+// is an ID that the Server could have assigned.
+// Must be called with the Lock held.
+func (s *Server) validID(id string) bool {
+	n, err := strconv.Atoi(id)
+	return err == nil && n >= 0 && n < s.nextID && strconv.Itoa(n) == id
+}
+
+func (ed *editor) localBatches(bs []batchSnapshot) ([]localBatch, error) {
+	var stack []localBatch
+	for _, s := range bs {
+		if len(s.Changes) == 0 {
+			return nil, errBadSnapshot
+		}
+		b := localBatch{id: s.ID, conflict: s.Conflict}
+		for _, c := range s.Changes {
+			text, err := ed.record(bytes.NewReader(c.Text))
+			if err != nil {
+				return nil, err
+			}
+			prev, err := ed.record(bytes.NewReader(c.Prev))
+			if err != nil {
+				return nil, err
+			}
+			b.changes = append(b.changes, localChange{span: c.Span, text: text, prev: prev})
+		}
+		for _, cv := range s.Covered {
+			b.covered = append(b.covered, covered{id: cv.ID, change: cv.Change, span: cv.Span})
+		}
+		stack = append(stack, b)
+	}
+	return stack, nil
+}
@@ -0,0 +1,412 @@
+// Copyright © 2016, The T Authors.
+
+package editor
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/eaburns/T/edit"
+	"github.com/eaburns/T/edit/runes"
+)
+
+// MaxLocalChanges is the maximum number of changes
+// in the batches of an editor's local Undo and Redo stacks.
+// Every Apply to a buffer rebases the stacks of all of its editors,
+// so the stacks are bounded to bound the cost of an Apply.
+const maxLocalChanges = 1 << 14
+
+// A localBatch is a batch of changes
+// applied by a single Apply of an editor.
+type localBatch struct {
+	// ID identifies the batch among the editor's batches.
+	id      int
+	changes []localChange
+	// Covered are the Spans, before the batch was applied,
+	// of the changes of other batches of the editor
+	// that the batch overlapped.
+	// They are restored when the batch is reverted.
+	covered []covered
+	// Conflict is whether the text of the batch
+	// was since changed by another editor.
+	// A conflicting batch cannot be undone or redone.
+	conflict bool
+}
+
+// A covered is the Span of a change of a localBatch,
+// which was overlapped by a later batch of the same editor.
+type covered struct {
+	id, change int
+	span       edit.Span
+}
+
+// A localChange is a change in a localBatch.
+type localChange struct {
+	// Span is the current location of the text of the change.
+	span edit.Span
+	// Text is the Span, in the editor's history,
+	// of the text of the change,
+	// and prev is the Span of the text that it replaced.
+	text, prev edit.Span
+}
+
+// An applied is a change as it was applied to the buffer:
+// the Span, at the time of the change, changed to size runes.
+type applied struct {
+	span edit.Span
+	size int64
+}
+
+// Temporary returns whether the editor is a temporary editor,
+// not one of its buffer's editors.
+// Temporary editors do not record local Undo and Redo stacks.
+func (ed *editor) temporary() bool { return ed.buffer.editors[ed.ID] != ed }
+
+// Close closes the editor's history
+// and clears its local Undo and Redo stacks.
+// Must be called with the buffer's write Lock held.
+func (ed *editor) close() error {
+	ed.undos, ed.redos = nil, nil
+	if ed.history == nil {
+		return nil
+	}
+	err := ed.history.Close()
+	ed.history = nil
+	return err
+}
+
+// UndoLocal undoes the batch of changes
+// at the top of the editor's local Undo stack.
+// It must only be called by an edit, with the buffer's write Lock held.
+func (ed *editor) UndoLocal() error { return ed.revert(true) }
+
+// RedoLocal redoes the batch of changes
+// at the top of the editor's local Redo stack.
+// It must only be called by an edit, with the buffer's write Lock held.
+func (ed *editor) RedoLocal() error { return ed.revert(false) }
+
+// Revert changes the text of the batch of changes
+// at the top of the local Undo stack, if undo is true,
+// or of the local Redo stack, if undo is false,
+// back to the text that it replaced.
+// Apply logs the reverting batch to the opposite stack.
+func (ed *editor) revert(undo bool) error {
+	if len(ed.pending) > 0 {
+		return edit.ErrOutOfSequence
+	}
+	stack := &ed.redos
+	if undo {
+		stack = &ed.undos
+	}
+	if len(*stack) == 0 {
+		return nil
+	}
+	b := (*stack)[len(*stack)-1]
+	if b.conflict {
+		return edit.ErrConflict
+	}
+	for _, c := range b.changes {
+		if c.span.Size() != c.text.Size() {
+			return edit.ErrConflict
+		}
+		eq, err := sameText(ed.Buffer.Reader(c.span), ed.historyReader(c.text))
+		if err != nil {
+			return err
+		}
+		if !eq {
+			return edit.ErrConflict
+		}
+	}
+	for _, c := range b.changes {
+		if _, err := ed.Change(c.span, ed.historyReader(c.prev)); err != nil {
+			return err
+		}
+	}
+	*stack = (*stack)[:len(*stack)-1]
+	ed.reverting = stack
+	err := ed.Apply()
+	ed.reverting = nil
+	if err != nil {
+		*stack = append(*stack, b)
+		return err
+	}
+	for _, cv := range b.covered {
+		if c := ed.localChange(cv.id, cv.change); c != nil {
+			c.span = cv.span
+		}
+	}
+	// Apply pushed the reverting batch onto the opposite stack.
+	// Dot is set to cover its changes.
+	stack = &ed.undos
+	if undo {
+		stack = &ed.redos
+	}
+	cs := (*stack)[len(*stack)-1].changes
+	ed.marks['.'] = edit.Span{cs[0].span[0], cs[len(cs)-1].span[1]}
+	return nil
+}
+
+// Applied returns the pending changes as they are applied to the buffer.
+// The Spans of pending changes are relative to the text before the batch,
+// but each applied change is relative to the text after the previous change.
+func (ed *editor) applied() []applied {
+	var delta int64
+	as := make([]applied, len(ed.pending))
+	for i, c := range ed.pending {
+		as[i] = applied{
+			span: edit.Span{c.Span[0] + delta, c.Span[1] + delta},
+			size: c.NewSize,
+		}
+		delta += c.NewSize - c.Span.Size()
+	}
+	return as
+}
+
+// Log logs the applied pending changes to the editor's local Undo stack,
+// or to the Redo stack if the changes revert a batch of the Undo stack.
+// Logging a new batch of changes to the Undo stack clears the Redo stack.
+// The oldest batches of the Undo stack are then dropped
+// until the stacks have at most maxLocalChanges changes.
+// Log must be called after the changes are applied to the buffer.
+//
+// If the text of the changes cannot be read,
+// the local Undo and Redo stacks are cleared.
+func (ed *editor) log(as []applied, cs []covered) {
+	ed.nextBatch++
+	b := localBatch{
+		id:      ed.nextBatch,
+		changes: make([]localChange, len(as)),
+		covered: cs,
+	}
+	for i, a := range as {
+		// Subsequent changes do not move the earlier ones,
+		// so the span of the text of change i is
+		// its start plus its new size.
+		s := edit.Span{a.span[0], a.span[0] + a.size}
+		text, err := ed.record(ed.Buffer.Reader(s))
+		if err != nil {
+			ed.undos, ed.redos = nil, nil
+			return
+		}
+		b.changes[i] = localChange{span: s, text: text, prev: ed.prevs[i]}
+	}
+	switch ed.reverting {
+	case nil:
+		ed.undos = append(ed.undos, b)
+		ed.redos = nil
+	case &ed.undos:
+		ed.redos = append(ed.redos, b)
+	default:
+		ed.undos = append(ed.undos, b)
+	}
+	ed.trim()
+}
+
+// Trim drops the oldest batches of the local Undo stack
+// until the local Undo and Redo stacks have at most maxLocalChanges changes.
+// If the newest batch of the Undo stack alone has more changes,
+// the entire Undo stack is dropped.
+func (ed *editor) trim() {
+	var n int
+	for _, b := range ed.redos {
+		n += len(b.changes)
+	}
+	i := len(ed.undos)
+	for i > 0 && n+len(ed.undos[i-1].changes) <= maxLocalChanges {
+		i--
+		n += len(ed.undos[i].changes)
+	}
+	ed.undos = ed.undos[i:]
+}
+
+// Record appends the text read from a Reader to the editor's history,
+// and returns its Span in the history.
+// The history is created on the first call to record.
+func (ed *editor) record(r io.Reader) (edit.Span, error) {
+	if ed.history == nil {
+		ed.history = runes.NewBuffer(1 << 12)
+	}
+	start := ed.history.Size()
+	rr := runes.RunesReader(bufio.NewReader(r))
+	_, err := runes.Copy(ed.history.Writer(start), rr)
+	return edit.Span{start, ed.history.Size()}, err
+}
+
+// HistoryReader returns a Reader that reads
+// the UTF-8 encoded text of a Span of the editor's history.
+func (ed *editor) historyReader(s edit.Span) io.Reader {
+	return runes.UTF8Reader(runes.LimitReader(ed.history.Reader(s[0]), s.Size()))
+}
+
+// SameText returns whether two Readers read the same text.
+func sameText(a, b io.Reader) (bool, error) {
+	var p, q [4096]byte
+	for {
+		n, err := io.ReadFull(a, p[:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		m, err := io.ReadFull(b, q[:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		if !bytes.Equal(p[:n], q[:m]) {
+			return false, nil
+		}
+		if n < len(p) {
+			return true, nil
+		}
+	}
+}
+
+// Rebase updates the editor's local Undo and Redo stacks
+// for changes applied by the editor by,
+// or by the buffer-wide Undo, Redo, or SetState if by is nil.
+// Each change must start at or after the end of the previous change,
+// as the previous change was applied.
+// A change by another editor that overlaps the text of a batch
+// marks the batch as conflicting.
+// A change by Undo, Redo, or SetState at the location
+// of a change of a batch that deleted text
+// also marks the batch as conflicting,
+// since it may re-insert the deleted text.
+// Rebase returns the Spans, before the changes,
+// of the changes of batches that were overlapped by the editor's own changes.
+//
+// Only the changes at or within the Span of a change of a batch
+// are considered individually; the others are found by binary search.
+func (ed *editor) rebase(by *editor, as []applied) []covered {
+	if len(as) == 0 {
+		return nil
+	}
+	ds := deltas(as)
+	var cs []covered
+	for _, stack := range [][]localBatch{ed.undos, ed.redos} {
+		for i := range stack {
+			b := &stack[i]
+			for j := range b.changes {
+				c := &b.changes[j]
+				span, overlap := c.span, false
+				k := first(as, ds, c.span[0])
+				c.span = edit.Span{c.span[0] + ds[k], c.span[1] + ds[k]}
+				for ; k < len(as) && as[k].span[0] <= c.span[1]; k++ {
+					a := as[k]
+					if by == nil && c.span.Size() == 0 &&
+						a.span[0] <= c.span[0] && c.span[0] <= a.span[1] {
+						b.conflict = true
+						continue
+					}
+					var ok bool
+					c.span, ok = rebaseSpan(c.span, a)
+					if ok {
+						continue
+					}
+					if ed != by {
+						b.conflict = true
+						continue
+					}
+					overlap = true
+					c.span = c.span.Update(a.span, a.size)
+				}
+				if overlap {
+					cs = append(cs, covered{id: b.id, change: j, span: span})
+				}
+			}
+			for j := range b.covered {
+				s := &b.covered[j].span
+				k := first(as, ds, s[0])
+				*s = edit.Span{s[0] + ds[k], s[1] + ds[k]}
+				for ; k < len(as) && as[k].span[0] <= s[1]; k++ {
+					*s = s.Update(as[k].span, as[k].size)
+				}
+			}
+		}
+	}
+	return cs
+}
+
+// Deltas returns, for each applied change,
+// the total change in size of the changes before it,
+// followed by the total change in size of all of the changes.
+func deltas(as []applied) []int64 {
+	ds := make([]int64, len(as)+1)
+	for i, a := range as {
+		ds[i+1] = ds[i] + a.size - a.span.Size()
+	}
+	return ds
+}
+
+// First returns the index of the first applied change
+// that ends at or after a location, before the changes.
+// The changes before it are entirely before the location,
+// so they only move it by the corresponding delta.
+func first(as []applied, ds []int64, l int64) int {
+	return sort.Search(len(as), func(i int) bool {
+		return as[i].span[1]-ds[i] >= l
+	})
+}
+
+// RebaseSpan returns the Span s updated for an applied change.
+// If the change overlaps s, s is returned unchanged along with false.
+func rebaseSpan(s edit.Span, a applied) (edit.Span, bool) {
+	switch delta := a.size - a.span.Size(); {
+	case a.span[1] <= s[0]:
+		return edit.Span{s[0] + delta, s[1] + delta}, true
+	case a.span[0] >= s[1]:
+		return s, true
+	default:
+		return s, false
+	}
+}
+
+// LocalChange returns the change with the given index
+// of the batch with the given ID
+// on the editor's local Undo or Redo stack,
+// or nil if there is no such batch.
+func (ed *editor) localChange(id, change int) *localChange {
+	for _, stack := range [][]localBatch{ed.undos, ed.redos} {
+		for i := range stack {
+			if b := &stack[i]; b.id == id && change < len(b.changes) {
+				return &b.changes[change]
+			}
+		}
+	}
+	return nil
+}
+
+// Moved records a change made by the buffer-wide Undo, Redo, or SetState.
+// It is called by the edit.Buffer as each change is made,
+// so it must be called with the write Lock held.
+// The changes are rebased onto the editors in runs
+// of changes that each start after the previous one,
+// and of at most maxMoves changes.
+func (buf *buffer) moved(s edit.Span, size int64) {
+	if n := len(buf.moves); n == maxMoves ||
+		n > 0 && s[0] < buf.moves[n-1].span[0]+buf.moves[n-1].size {
+		buf.rebaseMoves()
+	}
+	buf.moves = append(buf.moves, applied{span: s, size: size})
+}
+
+// MaxMoves is the maximum number of changes made
+// by a buffer-wide Undo, Redo, or SetState
+// that are rebased onto the editors at once.
+const maxMoves = 1 << 12
+
+// RebaseMoves rebases the local Undo and Redo stacks
+// and the watched dots of the buffer's editors
+// for the recorded changes of a buffer-wide Undo, Redo, or SetState.
+// Only the batches that the changes overlap are marked as conflicting.
+// It must be called with the write Lock held.
+func (buf *buffer) rebaseMoves() {
+	if len(buf.moves) == 0 {
+		return
+	}
+	for _, ed := range buf.editors {
+		ed.rebase(nil, buf.moves)
+		ed.rebaseWatch(buf.moves)
+	}
+	buf.moves = buf.moves[:0]
+}
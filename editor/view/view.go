@@ -106,15 +106,6 @@ func New(bufferURL *url.URL, markRunes ...rune) (*View, error) {
 	textURL := *bufferURL
 	textURL.Path = path.Join(ed.Path, "text")
 
-	changesURL := editorURL
-	changesURL.Path = path.Join(bufferURL.Path, "changes")
-	changesURL.Scheme = "ws"
-	changes, err := editor.Changes(&changesURL)
-	if err != nil {
-		editor.Close(&editorURL)
-		return nil, err
-	}
-
 	dedupedMarks := make(map[rune]bool)
 	dedupedMarks[ViewMark] = true
 	for _, r := range markRunes {
@@ -142,16 +133,28 @@ func New(bufferURL *url.URL, markRunes ...rune) (*View, error) {
 		Notify:    Notify,
 		editorURL: &editorURL,
 		textURL:   &textURL,
-		changes:   changes,
 		do:        do,
 		marks:     marks,
 	}
 
-	go v.run(do, Notify)
-
-	v.do <- doRequest{}
+	if err := v.edit(doRequest{}, Notify); err != nil {
+		editor.Close(&editorURL)
+		return nil, err
+	}
 	<-Notify
 
+	// The change stream begins after the sequence number of the initial refresh,
+	// so that it can be resumed if the connection is lost.
+	changesURL := editorURL
+	changesURL.Path = path.Join(bufferURL.Path, "changes")
+	changesURL.Scheme = "ws"
+	if v.changes, err = editor.ChangesSince(&changesURL, v.seq); err != nil {
+		editor.Close(&editorURL)
+		return nil, err
+	}
+
+	go v.run(do, Notify)
+
 	return v, nil
 }
 
@@ -228,17 +231,29 @@ func (v *View) Do(edits ...edit.Edit) ([]editor.EditResult, error) {
 // The EditResults are silently discarded.
 func (v *View) DoAsync(edits ...edit.Edit) { v.do <- doRequest{edits: edits} }
 
+// A streamed is a ChangeList read from the change stream,
+// or, if truncated is true, an indication
+// that ChangeLists were missed and the stream has reconnected.
+type streamed struct {
+	editor.ChangeList
+	truncated bool
+}
+
 func (v *View) run(do <-chan doRequest, Notify chan<- struct{}) {
-	changes := make(chan editor.ChangeList)
-	go func(changes chan<- editor.ChangeList) {
+	changes := make(chan streamed)
+	go func(changes chan<- streamed) {
 		defer close(changes)
 		for {
 			cl, err := v.changes.Next()
+			if err == editor.ErrTruncated {
+				changes <- streamed{truncated: true}
+				continue
+			}
 			if err != nil {
 				// TODO(eaburns): return error on Close.
 				return
 			}
-			changes <- cl
+			changes <- streamed{ChangeList: cl}
 		}
 	}(changes)
 
@@ -265,7 +280,9 @@ func (v *View) run(do <-chan doRequest, Notify chan<- struct{}) {
 			if !ok {
 				return
 			}
-			if v.seq >= cl.Sequence {
+			// If changes were missed, their sequence numbers are unknown,
+			// so the View is always refreshed.
+			if !cl.truncated && v.seq >= cl.Sequence {
 				break
 			}
 			// TODO(eaburns): this does a complete, blocking refresh.
@@ -11,6 +11,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+
+	"github.com/eaburns/T/auth"
 )
 
 // ErrNotFound indicates that a resource is not found.
@@ -99,6 +101,7 @@ func request(url *url.URL, method string, req interface{}, resp interface{}) err
 	if err != nil {
 		return err
 	}
+	auth.Authorize(httpReq)
 	httpResp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		return err
@@ -124,6 +124,11 @@ func (s *Server) Close() error {
 // 	• Not Found if the sheet is not found.
 //
 // Unless otherwise stated, the body of all error responses is the error message.
+//
+// The handlers accept any request.
+// To require a secret token with each request,
+// serve the Router wrapped with auth.Handler,
+// and give the token as the user name of the server's URL to clients.
 func (s *Server) RegisterHandlers(r *mux.Router) {
 	r.HandleFunc("/windows", s.listWindowsHandler).Methods(http.MethodGet)
 	r.HandleFunc("/windows", s.newWindowHandler).Methods(http.MethodPut)
@@ -2,7 +2,7 @@
 
 // Package websocket provides a wrapper for github.com/gorilla/websocket.
 // The wrapper has limited features; the point is ease of use for some common cases.
-// It does NOT check the request Origin header.
+// Upgrade rejects requests from web pages of other origins.
 // All of its methods are safe for concurrent use.
 // It automatically applies a send timeout.
 // It transparently handles the closing handshake.
@@ -16,6 +16,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/eaburns/T/auth"
 	"github.com/gorilla/websocket"
 )
 
@@ -46,9 +47,18 @@ type HandshakeError struct {
 
 func (err HandshakeError) Error() string { return err.Status }
 
+// A CloseError is returned by Recv
+// if the peer closed the connection with a reason.
+type CloseError struct {
+	// Reason is the reason given by the peer.
+	Reason string
+}
+
+func (err CloseError) Error() string { return "websocket closed: " + err.Reason }
+
 var upgrader = websocket.Upgrader{
 	HandshakeTimeout: HandshakeTimeout,
-	CheckOrigin:      func(*http.Request) bool { return true },
+	CheckOrigin:      auth.SameOrigin,
 }
 
 // A Conn is a websocket connection.
@@ -62,10 +72,19 @@ type Conn struct {
 
 // Dial dials a websocket and returns a new Conn.
 //
+// If the URL has a token, as its user name,
+// it is sent in the Authorization header, as a bearer token.
+//
 // If the handshake fails, a HandshakeError is returned.
 func Dial(URL *url.URL) (*Conn, error) {
 	hdr := make(http.Header)
-	conn, resp, err := websocket.DefaultDialer.Dial(URL.String(), hdr)
+	urlCopy := *URL
+	if token := auth.Token(URL); token != "" {
+		hdr.Set("Authorization", "Bearer "+token)
+	}
+	// User information is not allowed in websocket URLs.
+	urlCopy.User = nil
+	conn, resp, err := websocket.DefaultDialer.Dial(urlCopy.String(), hdr)
 	if err == websocket.ErrBadHandshake && resp.StatusCode != http.StatusOK {
 		return nil, HandshakeError{Status: resp.Status, StatusCode: resp.StatusCode}
 	}
@@ -101,10 +120,21 @@ func newConn(conn *websocket.Conn) *Conn {
 // or CloseRecvTimeout timeout expires.
 //
 // Close should not be called more than once.
-func (c *Conn) Close() error {
+func (c *Conn) Close() error { return c.close(nil) }
+
+// CloseWithReason is like Close,
+// but the peer's Recv returns a CloseError with the reason.
+// The Close message has the Policy Violation status code.
+//
+// Neither Close nor CloseWithReason should be called more than once.
+func (c *Conn) CloseWithReason(reason string) error {
+	return c.close(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+}
+
+func (c *Conn) close(msg []byte) error {
 	close(c.send)
 
-	err := c.sendClose()
+	err := c.sendClose(msg)
 	timer := time.NewTimer(CloseRecvTimeout)
 	if err != nil {
 		timer.Stop()
@@ -155,6 +185,8 @@ func (c *Conn) goSend() {
 // This function must be called continually until Close() is called,
 // otherwise the connection will not respond to ping/pong messages.
 //
+// If the peer closed the connection with a reason,
+// Recv returns a CloseError with the reason.
 // Calling Recv on a closed connection returns io.EOF.
 func (c *Conn) Recv(msg interface{}) error {
 	r, ok := <-c.recv
@@ -183,9 +215,12 @@ func (c *Conn) goRecv() {
 		if messageType == websocket.TextMessage {
 			c.recv <- recvMsg{p: p, err: err}
 		}
+		if cerr, ok := err.(*websocket.CloseError); ok && cerr.Text != "" {
+			c.recv <- recvMsg{err: CloseError{Reason: cerr.Text}}
+		}
 		if err != nil {
 			// If this errors, a subsequent call to Close will return the error.
-			c.sendClose()
+			c.sendClose(nil)
 			// ReadMessage cannot receive messages after it returns an error.
 			// So give up on waiting for a Close from the peer.
 			return
@@ -193,10 +228,12 @@ func (c *Conn) goRecv() {
 	}
 }
 
-func (c *Conn) sendClose() error {
+// SendClose sends a Close message with the given data,
+// unless a Close message was already sent.
+func (c *Conn) sendClose(msg []byte) error {
 	c.sendCloseOnce.Do(func() {
 		dl := time.Now().Add(SendTimeout)
-		c.sendCloseError = c.conn.WriteControl(websocket.CloseMessage, nil, dl)
+		c.sendCloseError = c.conn.WriteControl(websocket.CloseMessage, msg, dl)
 		// If we receive a Close from the peer,
 		// gorilla will send the Close response for us.
 		// We don't bother tracking this, so just ignore this. error.
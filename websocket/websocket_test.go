@@ -68,6 +68,66 @@ func TestEcho(t *testing.T) {
 	}
 }
 
+func TestUpgradeCrossOrigin(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := Upgrade(w, r); err == nil {
+			t.Errorf("Upgrade(w, r)=_,nil, want error")
+			conn.Close()
+		}
+	})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(GET, %q, nil)=_,%v", s.URL, err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "http://example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do(%q)=_,%v", s.URL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestDialToken(t *testing.T) {
+	echo := echoUntilClose(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			http.Error(w, "bad Authorization: "+auth, http.StatusUnauthorized)
+			return
+		}
+		echo(w, r)
+	})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	URL, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q)=_,%v", s.URL, err)
+	}
+	URL.Scheme = "ws"
+	if conn, err := Dial(URL); err == nil {
+		conn.Close()
+		t.Errorf("Dial(%s)=_,nil, want HandshakeError", URL)
+	}
+	URL.User = url.User("secret")
+	conn, err := Dial(URL)
+	if err != nil {
+		t.Fatalf("Dial(%s)=_,%v", URL, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("client conn.Close()=%v", err)
+	}
+}
+
 func TestRecvOnClosedConn(t *testing.T) {
 	handler := http.HandlerFunc(recvUntilClose(t))
 	s := httptest.NewServer(handler)
@@ -93,6 +153,37 @@ func TestRecvOnClosedConn(t *testing.T) {
 	}
 }
 
+func TestCloseWithReason(t *testing.T) {
+	const reason = "go away"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			t.Fatalf("Upgrade(w, r)=%v", err)
+		}
+		if err := conn.CloseWithReason(reason); err != nil {
+			t.Errorf("server conn.CloseWithReason(%q)=%v", reason, err)
+		}
+	})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	URL, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q)=_,%v", s.URL, err)
+	}
+	URL.Scheme = "ws"
+	conn, err := Dial(URL)
+	if err != nil {
+		t.Fatalf("Dial(%s)=_,%v", URL, err)
+	}
+	defer conn.Close()
+
+	want := CloseError{Reason: reason}
+	if err := conn.Recv(nil); err != want {
+		t.Errorf("client conn.Recv(nil)=%v, want %v", err, want)
+	}
+}
+
 func TestRecvNill(t *testing.T) {
 	handler := http.HandlerFunc(echoUntilClose(t))
 	s := httptest.NewServer(handler)